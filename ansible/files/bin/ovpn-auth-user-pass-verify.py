@@ -1,18 +1,41 @@
 #!/usr/bin/env python2
 
-import sys, os, sqlite3, pyotp, ldap
+import sys, os, sqlite3, pyotp, ldap, json, hashlib, base64
+
+ENCRYPTED_SEED_PREFIX = "enc:v1:"
+
+# decrypts a seed stored by Heimdall with SeedEncryptionKey set; see src/heimdall/cmd/seedcrypt.go
+def decrypt_seed(stored, passphrase):
+  from cryptography.hazmat.primitives.ciphers.aead import AESGCM
+  raw = base64.b64decode(stored[len(ENCRYPTED_SEED_PREFIX):])
+  key = hashlib.sha256(passphrase.encode("utf-8")).digest()
+  return AESGCM(key).decrypt(raw[:12], raw[12:], None)
+
+# returns SeedEncryptionKey with the same precedence as Heimdall: HEIMDALL_SEED_ENCRYPTION_KEY if
+# it's in the environment (even if empty), else the contents of key_file, less a trailing newline.
+# For older deployments, key_file may instead be Heimdall's whole .json config.
+def seed_encryption_key(key_file):
+  if "HEIMDALL_SEED_ENCRYPTION_KEY" in os.environ:
+    return os.environ["HEIMDALL_SEED_ENCRYPTION_KEY"]
+  if not key_file:
+    return ""
+  with open(key_file) as f:
+    if key_file.endswith(".json"):
+      return json.load(f).get("SeedEncryptionKey", "")
+    return f.read().rstrip("\r\n")
 
 try:
   PASSWORD = os.environ.get("password", '')
   USERNAME = os.environ.get("username", '')
   SQLITE_FILE = sys.argv[1]
+  KEY_FILE = sys.argv[2] if len(sys.argv) > 2 else ''
 
   if not PASSWORD or not SQLITE_FILE or not USERNAME:
     print "missing required env var"
     raise SystemExit(1)
 
   cxn = sqlite3.connect(SQLITE_FILE)
-  query = cxn.execute('select seed from totp where email=?', [USERNAME])
+  query = cxn.execute('select seed from totp where email=? and archived is null', [USERNAME])
   result = query.fetchone()
   if not result or len(result) != 1:
     print "no seed for", USERNAME
@@ -26,6 +49,13 @@ try:
   except:
     pass
 
+  if seed.startswith(ENCRYPTED_SEED_PREFIX):
+    passphrase = seed_encryption_key(KEY_FILE)
+    if not passphrase:
+      print "seed is encrypted but SeedEncryptionKey is not set"
+      raise SystemExit(1)
+    seed = decrypt_seed(seed, passphrase)
+
   totp = pyotp.TOTP(seed)
   expected = totp.now()
 
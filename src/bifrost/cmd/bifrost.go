@@ -15,9 +15,13 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
@@ -97,16 +101,16 @@ func main() {
 
 	// API endpoints
 	w := httputil.Wrapper().WithPanicHandler().WithSessionSentry(authError)
-	mux.HandleFunc("/api/init", w.WithMethodSentry("GET").Wrap(initHandler))
-	mux.HandleFunc("/api/config", w.WithMethodSentry("GET", "PUT").Wrap(configHandler))
-	mux.HandleFunc("/api/whitelist", w.WithMethodSentry("GET").Wrap(whitelistHandler))
-	mux.HandleFunc("/api/whitelist/", w.WithMethodSentry("PUT", "DELETE").Wrap(whitelistHandler))
-	mux.HandleFunc("/api/users", w.WithMethodSentry("GET").Wrap(usersHandler))
-	mux.HandleFunc("/api/users/", w.WithMethodSentry("GET", "PUT", "DELETE").Wrap(usersHandler))
-	mux.HandleFunc("/api/certs", w.WithMethodSentry("GET", "POST").Wrap(certsHandler))
-	mux.HandleFunc("/api/certs/", w.WithMethodSentry("DELETE").Wrap(certsHandler))
-	mux.HandleFunc("/api/totp", w.WithMethodSentry("GET", "POST").Wrap(totpHandler))
-	mux.HandleFunc("/api/events", w.WithMethodSentry("GET").Wrap(eventsHandler))
+	mux.HandleFunc("/api/init", w.Wrap(withMethodSentry(initHandler, "GET")))
+	mux.HandleFunc("/api/config", w.Wrap(withMethodSentry(withMaxBodySize(configHandler), "GET", "PUT")))
+	mux.HandleFunc("/api/whitelist", w.Wrap(withMethodSentry(whitelistHandler, "GET")))
+	mux.HandleFunc("/api/whitelist/", w.Wrap(withMethodSentry(whitelistHandler, "PUT", "DELETE")))
+	mux.HandleFunc("/api/users", w.Wrap(withMethodSentry(usersHandler, "GET")))
+	mux.HandleFunc("/api/users/", w.Wrap(withMethodSentry(usersHandler, "GET", "PUT", "DELETE")))
+	mux.HandleFunc("/api/certs", w.Wrap(withMethodSentry(withMaxBodySize(certsHandler), "GET", "POST")))
+	mux.HandleFunc("/api/certs/", w.Wrap(withMethodSentry(certsHandler, "DELETE")))
+	mux.HandleFunc("/api/totp", w.Wrap(withMethodSentry(totpHandler, "GET", "POST")))
+	mux.HandleFunc("/api/events", w.Wrap(withMethodSentry(eventsHandler, "GET")))
 
 	if cfg.HTTPSCertFile != "" { // HTTPS mode -- not behind reverse proxy
 		// start up an HSTS redirector if requested
@@ -136,14 +140,85 @@ func extractSegment(path string, n int) string {
 
 // create some frequently-used error responses for readability later
 var (
-	authError       = &apiError{"You must be logged in to use this application.", "Please reload the page.", false}
-	eventsError     = &apiError{"You must be an administrator to view events.", "", false}
-	clientJSONError = &apiError{"There was an error in data your client sent.", "Please reload the page.", false}
-	clientURLError  = &apiError{"There was an error in data your client sent.", "Please reload the page.", false}
-	settingsError   = &apiError{"You must be an administrator to access settings.", "", false}
-	usersError      = &apiError{"You must be an administrator to manage users.", "", false}
+	authError        = &apiError{"You must be logged in to use this application.", "Please reload the page.", false}
+	eventsError      = &apiError{"You must be an administrator to view events.", "", false}
+	clientJSONError  = &apiError{"There was an error in data your client sent.", "Please reload the page.", false}
+	clientURLError   = &apiError{"There was an error in data your client sent.", "Please reload the page.", false}
+	settingsError    = &apiError{"You must be an administrator to access settings.", "", false}
+	usersError       = &apiError{"You must be an administrator to manage users.", "", false}
+	limitError       = &apiError{"You have reached your limit of devices.", "Revoke a device to create a new one.", true}
+	duplicateError   = &apiError{"You already have a device with that name.", "Choose a different name, or revoke the existing device.", true}
+	bodySizeError    = &apiError{"Your client sent too much data.", "Please reload the page.", false}
+	capacityError    = &apiError{"The VPN is at its limit of devices.", "Please contact an administrator.", false}
+	unavailableError = &apiError{"The VPN service is temporarily unavailable.", "Please try again in a few minutes.", true}
+	approvalError    = &apiError{"Your request has been submitted for approval.", "You can create your configuration once an administrator approves it.", true}
+	methodError      = &apiError{"Your client made an unsupported request.", "Please reload the page.", false}
 )
 
+// heimdallCapacityMessage is the Error in Heimdall's 503 when its GlobalCertLimit is reached, as
+// opposed to one for maintenance mode or a transient failure
+const heimdallCapacityMessage = "the system is at its limit of active certificates"
+
+// cooldownError is the error for a cert refused by Heimdall's issuance cooldown, which lifts in
+// retryAfter seconds, if known
+func cooldownError(retryAfter int) *apiError {
+	extra := "Please try again later."
+	if retryAfter > 0 {
+		minutes := (retryAfter + 59) / 60
+		unit := "minutes"
+		if minutes == 1 {
+			unit = "minute"
+		}
+		extra = fmt.Sprintf("Please try again in %d %s.", minutes, unit)
+	}
+	return &apiError{"You have created too many devices recently.", extra, true}
+}
+
+// maxRequestBodyBytes bounds request bodies, which are small JSON objects
+const maxRequestBodyBytes = 64 * 1024
+
+// withMaxBodySize wraps a handler such that request bodies over maxRequestBodyBytes are refused
+// with a 413 (request entity too large) instead of being read into memory
+func withMaxBodySize(handler http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, req *http.Request) {
+		if req.Body == nil || req.ContentLength == 0 {
+			handler(writer, req)
+			return
+		}
+		body, err := ioutil.ReadAll(io.LimitReader(req.Body, maxRequestBodyBytes+1))
+		req.Body.Close()
+		if err != nil {
+			log.Warn("withMaxBodySize", "error reading request body", req.Method, req.URL.Path, err)
+			httputil.SendJSON(writer, http.StatusBadRequest, &apiResponse{Error: clientJSONError})
+			return
+		}
+		if len(body) > maxRequestBodyBytes {
+			log.Warn("withMaxBodySize", "request body too large", req.Method, req.URL.Path)
+			httputil.SendJSON(writer, http.StatusRequestEntityTooLarge, &apiResponse{Error: bodySizeError})
+			return
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		handler(writer, req)
+	}
+}
+
+// withMethodSentry wraps a handler such that only the given methods reach it. Others get a 405
+// (method not allowed), with the permitted methods in the Allow header and as the Artifact.
+func withMethodSentry(handler http.HandlerFunc, methods ...string) http.HandlerFunc {
+	allow := strings.Join(methods, ", ")
+	return func(writer http.ResponseWriter, req *http.Request) {
+		for _, m := range methods {
+			if req.Method == m {
+				handler(writer, req)
+				return
+			}
+		}
+		log.Warn("withMethodSentry", "disallowed method", req.Method, req.URL.Path)
+		writer.Header().Set("Allow", allow)
+		httputil.SendJSON(writer, http.StatusMethodNotAllowed, &apiResponse{Error: methodError, Artifact: struct{ Allow []string }{methods}})
+	}
+}
+
 /* All handlers that return JSON use this general structure:
  *
  * {
@@ -168,6 +243,25 @@ type apiResponse struct {
 type settings struct {
 	ServiceName                     string
 	ClientLimit, IssuedCertDuration int
+	IssuedCertKeyBits               int
+	SigningCA                       string
+	ExpiringSoonDays                int
+	UniqueDescriptions              bool
+	CertBackdateMinutes             int
+	EventRetentionDays              int
+	OrgUnit, Country, Locality      string
+	RequireApproval                 bool
+	AllowSeedExport                 bool
+	SerialMode                      string
+	GlobalCertLimit                 int
+	IssuanceCooldownCerts           int
+	IssuanceCooldownMinutes         int
+	RequireDescription              bool
+	DefaultCertDescription          string
+	MinDescriptionLength            int
+	RevokeExpiredCerts              bool
+	DomainProfiles                  map[string]string
+	TemplateExtra                   map[string]string
 	WhitelistedDomains              []string
 	WhitelistedUsers                []string `json:",omitEmpty"`
 }
@@ -241,6 +335,16 @@ func initHandler(writer http.ResponseWriter, req *http.Request) {
 
 	res.ServiceName = s.ServiceName
 	res.MaxClients = s.ClientLimit
+
+	// a per-user limit, if the admin has set one, overrides the global setting
+	user := &struct{ ClientLimit *int }{}
+	status, err := cfg.APIClient.Call(apiclient.URLJoin("user", ssn.Email), "GET", nil, struct{}{}, user)
+	if err != nil {
+		panic(err)
+	}
+	if status < 300 && user.ClientLimit != nil {
+		res.MaxClients = *user.ClientLimit
+	}
 	if isAllowed {
 		res.DefaultPath = "/devices"
 	}
@@ -290,6 +394,10 @@ func configHandler(writer http.ResponseWriter, req *http.Request) {
 		if err != nil {
 			panic(err)
 		}
+		if status == http.StatusBadRequest { // Heimdall rejected one or more of the values
+			httputil.SendJSON(writer, http.StatusBadRequest, &apiResponse{Error: clientJSONError})
+			return
+		}
 		if status >= 300 {
 			panic(fmt.Sprintf("non-200 status code %d from API server", status))
 		}
@@ -470,14 +578,19 @@ func usersHandler(writer http.ResponseWriter, req *http.Request) {
 func certsHandler(writer http.ResponseWriter, req *http.Request) {
 	// GET /api/certs -- fetch all certs for the current user (i.e. the one making the request)
 	//   I: none
-	//   O: {Certs: [{Fingerprint: "", Description: "", Expires: ""}]}
+	//   O: {Certs: [{Fingerprint: "", Description: "", Expires: "", LastSeen: ""}]}
 	//   200: success
+	//   LastSeen is when the cert was last seen connected to the VPN, or "" if never.
 	// POST /api/certs -- create a new client cert
-	//   I: {Email: "", Desc: ""}
+	//   I: {Email: "", Desc: "", Profile: ""}
 	//   O: {OVPN: ""}
-	//   200: success; 400 (bad request): missing or bad fields;
+	//   200: success; 400 (bad request): missing or bad fields, or unknown Profile;
 	//   403: requested email doesn't match session email; 404: Email not known to system (i.e. no TOTP creds)
+	//   503 (service unavailable): Heimdall's GlobalCertLimit setting has been reached
 	//   Note that unless current user is admin, Email is optional but if present must match session email.
+	//   Profile optionally names one of Heimdall's OVPNTemplateProfiles, e.g. "mobile".
+	//   202 (accepted), with Error set and no Artifact: Heimdall requires certs to be approved, and
+	//   has recorded the request instead.
 	// DELETE /api/certs/<fingerprint> -- fetch details of a client cert
 	//   I: none
 	//   O: same as GET (above), except that it returns all fingerprints for the user owning the one that was revoked
@@ -503,6 +616,7 @@ func certsHandler(writer http.ResponseWriter, req *http.Request) {
 		Expires     string
 		Created     string `json:",omitEmpty"`
 		Revoked     string `json:",omitEmpty"`
+		LastSeen    string
 	}
 	switch req.Method {
 	case "GET":
@@ -539,7 +653,7 @@ func certsHandler(writer http.ResponseWriter, req *http.Request) {
 
 		httputil.SendJSON(writer, http.StatusOK, apiResponse{nil, &struct{ Certs []*certMeta }{apiRes.ActiveCerts}})
 	case "POST":
-		incert := &struct{ Email, Description string }{}
+		incert := &struct{ Email, Description, Profile string }{}
 
 		if err := httputil.PopulateFromBody(incert, req); err != nil {
 			httputil.SendJSON(writer, http.StatusBadRequest, apiResponse{Error: clientJSONError})
@@ -557,16 +671,57 @@ func certsHandler(writer http.ResponseWriter, req *http.Request) {
 
 		incert.Email = email
 
-		res := &struct{ OVPNDataURL string }{}
-		status, err := cfg.APIClient.Call(apiclient.URLJoin("certs", email), "POST", nil, incert, res)
+		// Error and RetryAfter are only set when Heimdall refuses the request
+		apiRes := &struct {
+			OVPNDataURL, Error string
+			RetryAfter         int
+		}{}
+		status, err := cfg.APIClient.Call(apiclient.URLJoin("certs", email), "POST", nil, incert, apiRes)
 		if err != nil {
 			panic(err)
 		}
+		if status == http.StatusForbidden { // Heimdall enforces the cert limit
+			log.Warn(TAG, fmt.Sprintf("'%s' is at their cert limit", email))
+			httputil.SendJSON(writer, http.StatusForbidden, apiResponse{Error: limitError})
+			return
+		}
+		if status == http.StatusConflict { // Heimdall enforces UniqueDescriptions
+			httputil.SendJSON(writer, http.StatusConflict, apiResponse{Error: duplicateError})
+			return
+		}
+		if status == http.StatusBadRequest { // e.g. an unknown Profile
+			httputil.SendJSON(writer, http.StatusBadRequest, apiResponse{Error: clientJSONError})
+			return
+		}
+		if status == http.StatusTooManyRequests { // Heimdall's issuance cooldown
+			log.Warn(TAG, fmt.Sprintf("'%s' could not create a certificate; too many issued recently", email))
+			if apiRes.RetryAfter > 0 {
+				writer.Header().Set("Retry-After", strconv.Itoa(apiRes.RetryAfter))
+			}
+			httputil.SendJSON(writer, http.StatusTooManyRequests, apiResponse{Error: cooldownError(apiRes.RetryAfter)})
+			return
+		}
+		if status == http.StatusServiceUnavailable {
+			// Heimdall's GlobalCertLimit, or else maintenance mode or a transient failure
+			if apiRes.Error == heimdallCapacityMessage {
+				log.Warn(TAG, fmt.Sprintf("'%s' could not create a certificate; the system is at capacity", email))
+				httputil.SendJSON(writer, http.StatusServiceUnavailable, apiResponse{Error: capacityError})
+			} else {
+				log.Warn(TAG, fmt.Sprintf("'%s' could not create a certificate; the API server is unavailable", email), apiRes.Error)
+				httputil.SendJSON(writer, http.StatusServiceUnavailable, apiResponse{Error: unavailableError})
+			}
+			return
+		}
+		if status == http.StatusAccepted { // Heimdall's RequireApproval setting is on
+			log.Status(TAG, fmt.Sprintf("'%s' requested new certificate '%s' pending approval", email, incert.Description))
+			httputil.SendJSON(writer, http.StatusAccepted, apiResponse{Error: approvalError})
+			return
+		}
 		if status >= 300 {
 			panic(fmt.Sprintf("non-200 status code %d from API server", status))
 		}
 		log.Status(TAG, fmt.Sprintf("'%s' created new certificate '%s'", email, incert.Description))
-		httputil.SendJSON(writer, http.StatusOK, apiResponse{nil, res})
+		httputil.SendJSON(writer, http.StatusOK, apiResponse{nil, &struct{ OVPNDataURL string }{apiRes.OVPNDataURL}})
 	case "DELETE":
 		fp := extractSegment(req.URL.Path, 3)
 		if fp == "" {
@@ -704,7 +859,7 @@ func totpHandler(writer http.ResponseWriter, req *http.Request) {
 func eventsHandler(writer http.ResponseWriter, req *http.Request) {
 	// GET /api/events -- returns whether the current user has TOTP configured
 	//   I: none
-	//   O: {Events: [{Event: "", Email: "", Value: "", Timestamp: ""}]}
+	//   O: {Events: [{Event: "", Email: "", Value: "", Timestamp: "", SourceIP: "", UserAgent: "", RequestID: "", Operator: ""}]}
 	//   200: success
 	// non-GET: 405 (method not allowed)
 	// Accepts a GET query parameter of "?before=" which is passed to the API server, for pagination
@@ -720,7 +875,7 @@ func eventsHandler(writer http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	type event struct{ Event, Email, Value, Timestamp string }
+	type event struct{ Event, Email, Value, Timestamp, SourceIP, UserAgent, RequestID, Operator string }
 	res := &struct{ Events []*event }{}
 
 	if err := req.ParseForm(); err != nil {
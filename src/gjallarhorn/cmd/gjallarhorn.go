@@ -84,7 +84,7 @@ type resultSet struct {
 }
 
 func fetchExpirations(cxn *sql.DB, window string) ([]*result, error) {
-	q := "select email, desc, expires, fingerprint from certs where revoked is null and expires = date('now', 'localtime', ?)"
+	q := "select email, desc, expires, fingerprint from certs where revoked is null and date(expires) = date('now', 'localtime', ?)"
 	rows, err := cxn.Query(q, window)
 	if err != nil {
 		return nil, err
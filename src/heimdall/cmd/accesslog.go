@@ -0,0 +1,73 @@
+// Copyright © 2018 Playground Global, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// statusRecorder notes the status and body size of the response passing through it
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += n
+	return n, err
+}
+
+// withAccessLog wraps a handler such that each request is logged once it completes, with its
+// method, path, status, response size, duration, and client address, if AccessLog is set. It goes
+// outside withRequestID, so the line includes the request ID too. In Debug mode the request headers
+// are also logged, with the APIHeader value redacted.
+func withAccessLog(handler http.HandlerFunc) http.HandlerFunc {
+	if !cfg.AccessLog {
+		return handler
+	}
+	return func(writer http.ResponseWriter, req *http.Request) {
+		TAG := "access"
+
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: writer}
+		defer func() {
+			status := rec.status
+			if status == 0 { // the handler wrote nothing, so net/http sends a 200
+				status = http.StatusOK
+			}
+			log.Status(TAG, req.Method, req.URL.RequestURI(), status, rec.bytes,
+				fmt.Sprintf("%dms", time.Since(start)/time.Millisecond), clientAddress(req),
+				operator(req), writer.Header().Get("X-Request-ID"))
+		}()
+		if cfg.Debug {
+			log.Debug(TAG, "request headers", redactedHeaders(req.Header))
+		}
+		handler(rec, req)
+	}
+}
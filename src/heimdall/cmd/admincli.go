@@ -0,0 +1,160 @@
+// Copyright © 2018 Playground Global, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Admin subcommands, e.g. "heimdall user add alice@domain.tld", for scripts and for recovery when
+// the server is down. Each one is carried out by the same handler as the equivalent API call,
+// invoked in-process against the configured database, so the two can't disagree; the handler's
+// JSON response is printed to stdout, and anything logged goes to stderr rather than LogFile.
+// Flags, including -yes, must precede the subcommand.
+//
+// The settings cache is per-process, so changes to settings or the whitelist wouldn't be seen by a
+// running server; hence there are no subcommands for those.
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/user"
+	"strings"
+)
+
+var confirmFlag = flag.Bool("yes", false, "confirm a destructive admin subcommand, e.g. \"cert revoke\"")
+
+type adminCommand struct {
+	args        string // usage of the subcommand's arguments
+	help        string
+	nargs       int  // minimum number of arguments
+	destructive bool // requires -yes
+	run         func(args []string) (*http.Request, http.HandlerFunc)
+}
+
+// adminRequest builds the API request an admin subcommand stands for
+func adminRequest(method, path string, body interface{}) *http.Request {
+	var r io.Reader
+	if body != nil {
+		buf, err := json.Marshal(body)
+		if err != nil {
+			panic(err)
+		}
+		r = bytes.NewReader(buf)
+	}
+	req, err := http.NewRequest(method, path, r)
+	if err != nil {
+		panic(err)
+	}
+
+	// events record the user agent, which is the only clue to who ran the command
+	who := "unknown"
+	if u, err := user.Current(); err == nil {
+		who = u.Username
+	}
+	req.Header.Set("User-Agent", fmt.Sprintf("heimdall-cli (%s)", who))
+	return req
+}
+
+var adminCommands = map[string]*adminCommand{
+	"user list": {"", "list all users", 0, false, func(args []string) (*http.Request, http.HandlerFunc) {
+		return adminRequest("GET", "/users", nil), usersHandler
+	}},
+	"user show": {"<email>", "show a user and their certs", 1, false, func(args []string) (*http.Request, http.HandlerFunc) {
+		return adminRequest("GET", "/user/"+url.PathEscape(args[0]), nil), userHandler
+	}},
+	"user add": {"<email>", "create a user with a new TOTP seed; refuses existing users", 1, false, func(args []string) (*http.Request, http.HandlerFunc) {
+		return adminRequest("PUT", "/user/"+url.PathEscape(args[0]), nil), func(writer http.ResponseWriter, req *http.Request) {
+			rec := httptest.NewRecorder()
+			userHandler(rec, adminRequest("GET", req.URL.Path, nil).WithContext(req.Context()))
+			if rec.Code != http.StatusNotFound {
+				writer.WriteHeader(http.StatusConflict)
+				fmt.Fprintln(writer, `{"Error":"user already exists; use \"user reset-totp\" to replace their seed"}`)
+				return
+			}
+			userHandler(writer, req)
+		}
+	}},
+	"user reset-totp": {"<email>", "replace a user's TOTP seed", 1, true, func(args []string) (*http.Request, http.HandlerFunc) {
+		return adminRequest("PUT", "/user/"+url.PathEscape(args[0]), nil), userHandler
+	}},
+	"user archive": {"<email>", "archive a user and revoke all their certs", 1, true, func(args []string) (*http.Request, http.HandlerFunc) {
+		return adminRequest("DELETE", "/user/"+url.PathEscape(args[0]), nil), userHandler
+	}},
+	"user restore": {"<email>", "reactivate an archived user", 1, false, func(args []string) (*http.Request, http.HandlerFunc) {
+		return adminRequest("POST", "/user/"+url.PathEscape(args[0])+"/restore", nil), userHandler
+	}},
+	"cert list": {"<email>", "list a user's certs", 1, false, func(args []string) (*http.Request, http.HandlerFunc) {
+		return adminRequest("GET", "/certs/"+url.PathEscape(args[0]), nil), certsHandler
+	}},
+	"cert show": {"<fingerprint>", "show a cert", 1, false, func(args []string) (*http.Request, http.HandlerFunc) {
+		return adminRequest("GET", "/cert/"+url.PathEscape(args[0]), nil), certHandler
+	}},
+	"cert revoke": {"<fingerprint> [reason]", "revoke a cert, optionally giving an RFC 5280 reason, e.g. key-compromise", 1, true, func(args []string) (*http.Request, http.HandlerFunc) {
+		var body interface{}
+		if len(args) > 1 {
+			body = struct{ Reason string }{args[1]}
+		}
+		return adminRequest("DELETE", "/cert/"+url.PathEscape(args[0]), body), certHandler
+	}},
+	"settings get": {"", "show the current settings", 0, false, func(args []string) (*http.Request, http.HandlerFunc) {
+		return adminRequest("GET", "/settings", nil), settingsHandler
+	}},
+}
+
+// adminUsage prints the list of admin subcommands to stderr
+func adminUsage() {
+	fmt.Fprintln(os.Stderr, "admin subcommands (flags such as -yes must come first):")
+	for _, name := range []string{"user list", "user show", "user add", "user reset-totp", "user archive", "user restore", "cert list", "cert show", "cert revoke", "settings get"} {
+		c := adminCommands[name]
+		confirm := ""
+		if c.destructive {
+			confirm = " (requires -yes)"
+		}
+		fmt.Fprintf(os.Stderr, "  heimdall %s %s\n    \t%s%s\n", name, c.args, c.help, confirm)
+	}
+}
+
+// adminCommandAndExit runs the admin subcommand named by args, e.g. ["cert", "revoke", "<fp>"],
+// and exits the process: 0 if it succeeded, 1 if the handler refused it, 2 if it was malformed
+func adminCommandAndExit(args []string) {
+	var c *adminCommand
+	if len(args) >= 2 {
+		c = adminCommands[args[0]+" "+args[1]]
+	}
+	if c == nil || len(args)-2 < c.nargs {
+		fmt.Fprintf(os.Stderr, "unknown or incomplete subcommand '%s'\n", strings.Join(args, " "))
+		adminUsage()
+		os.Exit(2)
+	}
+	if c.destructive && !*confirmFlag {
+		fmt.Fprintf(os.Stderr, "'%s %s' is destructive; rerun with -yes (before the subcommand) to confirm\n", args[0], args[1])
+		os.Exit(2)
+	}
+
+	req, handler := c.run(args[2:])
+	rec := httptest.NewRecorder()
+	withRequestID(withPanicRecovery(withDBDeadline(handler)))(rec, req)
+
+	os.Stdout.Write(rec.Body.Bytes())
+	if rec.Code >= 400 {
+		fmt.Fprintf(os.Stderr, "failed with status %d (%s)\n", rec.Code, http.StatusText(rec.Code))
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
@@ -0,0 +1,65 @@
+// Copyright © 2018 Playground Global, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// An optional second listener, on AdminBindAddress:AdminPort, for load balancer probes and
+// monitoring that can't present a client cert or API secret. It serves plain HTTP, and only
+// endpoints that reveal nothing about users or certs; everything else stays on the main listener.
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"playground/httputil"
+)
+
+// startAdminListener starts serving /healthz and /version on AdminPort in the background, unless
+// AdminPort is 0. A failure to listen panics, so that a typo'd port fails at startup.
+func startAdminListener() {
+	TAG := "server.admin"
+
+	if cfg.AdminPort == 0 {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", withAccessLog(withRequestID(withPanicRecovery(withMethodSentry(withDBDeadline(healthzHandler), "GET")))))
+	mux.HandleFunc("/version", withAccessLog(withRequestID(withPanicRecovery(withMethodSentry(versionHandler, "GET")))))
+	mux.HandleFunc("/", func(writer http.ResponseWriter, req *http.Request) {
+		log.Warn(TAG, "incoming unknown request to '"+req.URL.Path+"'")
+		httputil.SendJSON(writer, http.StatusNotFound, struct{}{})
+	})
+
+	addr := net.JoinHostPort(cfg.AdminBindAddress, strconv.Itoa(cfg.AdminPort))
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		panic(err)
+	}
+	server := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       10 * time.Second,
+		WriteTimeout:      30 * time.Second,
+		IdleTimeout:       60 * time.Second,
+		MaxHeaderBytes:    1 << 16,
+	}
+
+	log.Status(TAG, "starting admin HTTP on "+addr)
+	go func() {
+		log.Error(TAG, "shutting down; error?", server.Serve(l))
+	}()
+}
@@ -0,0 +1,253 @@
+// Copyright © 2018 Playground Global, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Two-step issuance, for when the RequireApproval setting is on: POST /certs/<email> records a
+// request, and a different operator must approve it before the cert is actually issued.
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"playground/httputil"
+)
+
+// requestCert handles POST /certs/<email> when RequireApproval is set; see certsHandler
+func requestCert(writer http.ResponseWriter, req *http.Request, s *settings, email, desc string, keyBits int, profile string) {
+	TAG := "/certs/"
+	ctx := req.Context()
+
+	if !checkIssuable(writer, req, s, email, desc) {
+		return
+	}
+
+	q := "insert into pending_certs (email, desc, key_bits, profile, requested_by) values (?, ?, ?, ?, ?)"
+	cxn := getDB()
+	defer cxn.Close()
+	res, err := cxn.ExecContext(ctx, q, email, desc, keyBits, profile, operator(req))
+	if err != nil {
+		panic(err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		panic(err)
+	}
+
+	recordEvent(req, "cert requested", email, fmt.Sprintf("%d - %s", id, desc))
+	log.Status(TAG, fmt.Sprintf("recorded cert request %d for '%s'", id, email), requestID(req))
+	httputil.SendJSON(writer, http.StatusAccepted, struct{ RequestID int64 }{id})
+}
+
+func certRequestsHandler(writer http.ResponseWriter, req *http.Request) {
+	// GET /cert-requests?status=pending -- list cert requests, oldest first
+	//   I: None
+	//   O: {Requests: [{ID: 0, Email: "", Description: "", KeyBits: 0, Profile: "", Requested: "", RequestedBy: "", Status: "", Decided: "", DecidedBy: "", Fingerprint: ""}]}
+	//   200: the object above; 400 (bad request): unknown status
+	//   status is "pending" (the default), "approved", "rejected", or "all". Decided and DecidedBy
+	//   are "" until the request is approved or rejected, and Fingerprint until it's approved.
+	// Non-GET: 405 (method not allowed)
+
+	TAG := "/cert-requests"
+
+	status := req.URL.Query().Get("status")
+	if status == "" {
+		status = "pending"
+	}
+	where, params := "", []interface{}{}
+	switch status {
+	case "pending", "approved", "rejected":
+		where, params = "where status=?", append(params, status)
+	case "all":
+	default:
+		log.Warn(TAG, "unknown status", status)
+		httputil.SendJSON(writer, http.StatusBadRequest, struct{}{})
+		return
+	}
+
+	type certRequest struct {
+		ID                                      int64
+		Email, Description                      string
+		KeyBits                                 int
+		Profile, Requested, RequestedBy         string
+		Status, Decided, DecidedBy, Fingerprint string
+	}
+	res := struct{ Requests []*certRequest }{[]*certRequest{}}
+
+	q := `select rowid, email, desc, key_bits, profile, requested, requested_by, status,
+	        coalesce(strftime('%Y-%m-%dT%H:%M:%SZ', decided), ''), decided_by, fingerprint
+	      from pending_certs ` + where + ` order by rowid`
+	cxn := getDB()
+	defer cxn.Close()
+	rows, err := cxn.QueryContext(req.Context(), q, params...)
+	if err != nil {
+		panic(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		r := &certRequest{}
+		if err := rows.Scan(&r.ID, &r.Email, &r.Description, &r.KeyBits, &r.Profile, &r.Requested, &r.RequestedBy, &r.Status, &r.Decided, &r.DecidedBy, &r.Fingerprint); err != nil {
+			panic(err)
+		}
+		res.Requests = append(res.Requests, r)
+	}
+	if err := rows.Err(); err != nil {
+		panic(err)
+	}
+
+	httputil.SendJSON(writer, http.StatusOK, &res)
+}
+
+func certRequestHandler(writer http.ResponseWriter, req *http.Request) {
+	// POST /cert-request/<id>/approve -- issue the cert a pending request asked for
+	//   I: None
+	//   O: {OVPNDataURL: ""}, as for POST /certs/<email>
+	//   201: created; 400 (bad request): malformed ID; 403 (forbidden): the approving operator is
+	//   the one who requested the cert, or the user is now at their cert limit, with body
+	//   {Errors: {ClientLimit: "problem"}}; 404: no such request, or its user no longer exists;
+	//   409 (conflict): the request was already decided, UniqueDescriptions is set and the user now
+	//   has an active cert with this description, or the requested profile is no longer
+	//   configured; 503 (service unavailable): the GlobalCertLimit setting has been reached
+	//   Operators are identified by client cert CN, so requests made through Bifröst must be
+	//   approved by someone calling Heimdall directly. The approving operator receives the .ovpn,
+	//   and is responsible for getting it to the user. A request that can't be issued now (e.g. a
+	//   cert limit) remains pending, so it can be approved later or rejected.
+	// POST /cert-request/<id>/reject -- decline (or, by its requester, withdraw) a pending request
+	//   I: None
+	//   O: {}
+	//   200: rejected; 400: malformed ID; 404: no such request; 409: the request was already decided
+	// Non-POST: 405 (method not allowed)
+
+	TAG := "/cert-request/"
+	ctx := req.Context()
+
+	id, err := strconv.ParseInt(extractSegment(req.URL.Path, 2), 10, 64)
+	if err != nil || id < 1 {
+		log.Warn(TAG, "malformed request ID", req.URL.Path)
+		httputil.SendJSON(writer, http.StatusBadRequest, struct{}{})
+		return
+	}
+	action := extractSegment(req.URL.Path, 3)
+	if action != "approve" && action != "reject" {
+		log.Warn(TAG, "unknown cert request action", req.URL.Path)
+		httputil.SendJSON(writer, http.StatusNotFound, struct{}{})
+		return
+	}
+
+	var email, desc, profile, requestedBy, status string
+	var keyBits int
+	q := "select email, desc, key_bits, profile, requested_by, status from pending_certs where rowid=?"
+	cxn := getDB()
+	defer cxn.Close()
+	err = cxn.QueryRowContext(ctx, q, id).Scan(&email, &desc, &keyBits, &profile, &requestedBy, &status)
+	if err == sql.ErrNoRows {
+		log.Warn(TAG, "nonexistent cert request", id)
+		httputil.SendJSON(writer, http.StatusNotFound, struct{}{})
+		return
+	} else if err != nil {
+		panic(err)
+	}
+
+	// the whole point is a second pair of eyes, so an operator can't approve their own request
+	// (though they may withdraw it by rejecting it)
+	op := operator(req)
+	if action == "approve" && op == requestedBy {
+		log.Warn(TAG, "operator attempted to decide own cert request", id, op)
+		httputil.SendJSON(writer, http.StatusForbidden, struct{}{})
+		return
+	}
+
+	// claim the request, so that concurrent approvals can't both issue a cert
+	q = "update pending_certs set status=?, decided=datetime('now'), decided_by=? where rowid=? and status='pending'"
+	decided := map[string]string{"approve": "approved", "reject": "rejected"}[action]
+	res, err := cxn.ExecContext(ctx, q, decided, op, id)
+	if err != nil {
+		panic(err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		panic(err)
+	} else if n == 0 {
+		log.Warn(TAG, "cert request already decided", id, status)
+		httputil.SendJSON(writer, http.StatusConflict, struct{}{})
+		return
+	}
+
+	if action == "reject" {
+		recordEvent(req, "cert request rejected", email, fmt.Sprintf("%d - %s", id, desc))
+		log.Status(TAG, fmt.Sprintf("rejected cert request %d for '%s'", id, email), requestID(req))
+		httputil.SendJSON(writer, http.StatusOK, struct{}{})
+		return
+	}
+
+	// from here on, anything that prevents issuance -- including a panic -- puts the request back as
+	// it was. That's done without the request's context, which may be what ran out.
+	issued := false
+	defer func() {
+		if !issued {
+			q := "update pending_certs set status='pending', decided=null, decided_by='' where rowid=?"
+			writeDatabaseByQuery(context.Background(), q, id)
+		}
+	}()
+
+	tmpl := ovpnTemplate
+	if profile != "" {
+		if tmpl = ovpnProfiles[profile]; tmpl == nil {
+			log.Warn(TAG, "cert request names a profile no longer configured", id, profile)
+			httputil.SendJSON(writer, http.StatusConflict, struct{}{})
+			return
+		}
+	}
+
+	s := loadSettings(ctx)
+	if !checkIssuable(writer, req, s, email, desc) {
+		return
+	}
+
+	cert, ovpn, genTime, err := renderCert(req, s, email, keyBits, "", tmpl)
+	if err != nil {
+		log.Error(TAG, "rendered .ovpn is malformed; check the template", profile, err)
+		httputil.SendJSON(writer, http.StatusInternalServerError, struct{ Error string }{"internal"})
+		return
+	}
+
+	// the cert and the request's outcome are recorded together, so that if the deadline runs out
+	// (e.g. after slow key generation), neither is, and the request goes back to pending
+	fp := certFingerprint(cert)
+	tx, err := cxn.BeginTx(ctx, nil)
+	if err != nil {
+		panic(err)
+	}
+	defer tx.Rollback()
+	if err := recordIssuedCertTx(tx, req, email, desc, cert); err != nil {
+		panic(err)
+	}
+	if _, err := tx.ExecContext(ctx, "update pending_certs set fingerprint=? where rowid=?", fp, id); err != nil {
+		panic(err)
+	}
+	if err := recordEventTx(tx, req, "cert request approved", email, fmt.Sprintf("%d - %s", id, fp)); err != nil {
+		panic(err)
+	}
+	if err := tx.Commit(); err != nil {
+		panic(err)
+	}
+	issued = true
+
+	log.Status(TAG, fmt.Sprintf("issued certificate '%s' for '%s' on approval of request %d", fp, email, id), requestID(req))
+	writer.Header().Set("X-Gen-Time-Ms", strconv.FormatInt(int64(genTime/time.Millisecond), 10))
+	httputil.SendJSON(writer, http.StatusCreated, struct{ OVPNDataURL string }{ovpnDataURL(ovpn)})
+}
@@ -0,0 +1,297 @@
+// Copyright © 2018 Playground Global, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Whole-dataset backup and restore, for disaster recovery. Events are not included.
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"time"
+
+	"playground/httputil"
+)
+
+// backupVersion is the format version of the backup document; bump it when the format changes
+// incompatibly, so that /import can refuse documents it doesn't understand
+const backupVersion = 1
+
+type backupUser struct {
+	Email, Seed, Created, Updated string
+	Archived                      *string
+	ClientLimit                   *int
+	Issuer                        string `json:",omitempty"` // so backups without any still import into older servers
+}
+
+type backupCert struct {
+	Email, Fingerprint, Created, Expires, Serial, RevocationReason, PEM string
+	Description, Revoked                                                *string
+	Imported                                                            bool `json:",omitempty"`
+}
+
+type backupSetting struct {
+	Key, Value string
+}
+
+type backup struct {
+	Version   int
+	Exported  string
+	Users     []*backupUser
+	Certs     []*backupCert
+	Settings  []*backupSetting
+	Whitelist []string
+}
+
+func exportHandler(writer http.ResponseWriter, req *http.Request) {
+	// GET /export -- dump users, certs, settings, and whitelist as a backup document
+	//   I: None
+	//   O: {Version: 1, Exported: "", Users: [<user>], Certs: [<cert>], Settings: [{Key: "", Value: ""}], Whitelist: [""]}
+	//   200: the object above; 403 (forbidden): not an admin-scoped API key, or includeSeeds with
+	//   the AllowSeedExport setting off
+	//   <user>: {Email: "", Seed: "", Created: "", Updated: "", Archived: "", ClientLimit: 5, Issuer: ""}
+	//   <cert>: {Email: "", Fingerprint: "", Description: "", Created: "", Expires: "", Revoked: "", Serial: "", RevocationReason: "", PEM: ""}
+	// Non-GET: 405 (method not allowed)
+	// TOTP seeds are omitted (i.e. Seed is "") unless the query parameter "?includeSeeds=true" is
+	// given, which requires the AllowSeedExport setting; users restored without seeds must have
+	// their TOTP reset before they can log in. Seeds are exported as stored, so ones encrypted at
+	// rest stay encrypted under SeedEncryptionKey, and the importing server must have the same key.
+
+	TAG := "/export"
+	ctx := req.Context()
+	includeSeeds := req.URL.Query().Get("includeSeeds") == "true"
+	if includeSeeds && !loadSettings(ctx).AllowSeedExport {
+		log.Warn(TAG, "refused export with TOTP seeds; AllowSeedExport is off", operator(req))
+		httputil.SendJSON(writer, http.StatusForbidden, struct{}{})
+		return
+	}
+
+	b := &backup{
+		Version:   backupVersion,
+		Exported:  time.Now().UTC().Format(time.RFC3339),
+		Users:     []*backupUser{},
+		Certs:     []*backupCert{},
+		Settings:  []*backupSetting{},
+		Whitelist: []string{},
+	}
+
+	cxn := getDB()
+	defer cxn.Close()
+
+	rows, err := cxn.QueryContext(ctx, "select email, seed, cast(created as text), cast(updated as text), cast(archived as text), client_limit, issuer from totp order by email")
+	if err != nil {
+		panic(err)
+	}
+	for rows.Next() {
+		u := &backupUser{}
+		if err := rows.Scan(&u.Email, &u.Seed, &u.Created, &u.Updated, &u.Archived, &u.ClientLimit, &u.Issuer); err != nil {
+			panic(err)
+		}
+		if !includeSeeds {
+			u.Seed = ""
+		}
+		b.Users = append(b.Users, u)
+	}
+	rows.Close()
+
+	// timestamps are cast to text so that they round-trip in SQLite's own format
+	q := `select email, fingerprint, desc, cast(created as text), cast(expires as text), cast(revoked as text), serial, revocation_reason, pem, imported
+	      from certs order by rowid`
+	if rows, err = cxn.QueryContext(ctx, q); err != nil {
+		panic(err)
+	}
+	for rows.Next() {
+		c := &backupCert{}
+		if err := rows.Scan(&c.Email, &c.Fingerprint, &c.Description, &c.Created, &c.Expires, &c.Revoked, &c.Serial, &c.RevocationReason, &c.PEM, &c.Imported); err != nil {
+			panic(err)
+		}
+		b.Certs = append(b.Certs, c)
+	}
+	rows.Close()
+
+	if rows, err = cxn.QueryContext(ctx, "select key, value from settings order by key"); err != nil {
+		panic(err)
+	}
+	for rows.Next() {
+		s := &backupSetting{}
+		if err := rows.Scan(&s.Key, &s.Value); err != nil {
+			panic(err)
+		}
+		b.Settings = append(b.Settings, s)
+	}
+	rows.Close()
+
+	if rows, err = cxn.QueryContext(ctx, "select email from whitelist order by email"); err != nil {
+		panic(err)
+	}
+	for rows.Next() {
+		var email string
+		if err := rows.Scan(&email); err != nil {
+			panic(err)
+		}
+		b.Whitelist = append(b.Whitelist, email)
+	}
+	rows.Close()
+
+	recordEvent(req, "data exported", "", fmt.Sprintf("%d users, %d certs, seeds included: %t", len(b.Users), len(b.Certs), includeSeeds))
+	log.Status(TAG, "exported backup", len(b.Users), len(b.Certs), includeSeeds)
+	httputil.SendJSON(writer, http.StatusOK, b)
+}
+
+func importHandler(writer http.ResponseWriter, req *http.Request) {
+	// POST /import -- restore a backup document produced by /export into an empty database
+	//   I: {Version: 1, Users: [<user>], Certs: [<cert>], Settings: [{Key: "", Value: ""}], Whitelist: [""]}
+	//   O: {Users: 0, Certs: 0, Settings: 0, Whitelist: 0} (counts of records restored)
+	//   200: restored; 400 (bad request): malformed document, unsupported Version, or invalid
+	//   settings or emails, with body {Errors: {<field>: "problem"}}; 403 (forbidden): not an
+	//   admin-scoped API key; 409 (conflict): database is not empty
+	// Non-POST: 405 (method not allowed)
+	// The restore is all-or-nothing. Input is as documented for GET /export. Settings are checked
+	// and normalized as by PUT /settings, and emails as by PUT /user/<email>, before anything is
+	// written, so a bad document can't leave settings that break later requests.
+
+	TAG := "/import"
+	ctx := req.Context()
+
+	b := &backup{}
+	if errs := decodeStrictJSON(b, req); errs != nil {
+		log.Warn(TAG, "malformed backup document", errs)
+		sendFieldErrors(writer, errs)
+		return
+	}
+	if b.Version != backupVersion {
+		log.Warn(TAG, "unsupported backup version", b.Version)
+		sendFieldErrors(writer, fieldErrors{"Version": fmt.Sprintf("must be %d", backupVersion)})
+		return
+	}
+	if errs := normalizeBackup(b); len(errs) > 0 {
+		log.Warn(TAG, "invalid backup document", errs)
+		sendFieldErrors(writer, errs)
+		return
+	}
+
+	cxn := getDB()
+	defer cxn.Close()
+
+	tx, err := cxn.BeginTx(ctx, nil)
+	if err != nil {
+		panic(err)
+	}
+	defer tx.Rollback() // no-op once committed
+
+	var existing int
+	q := "select (select count(*) from totp) + (select count(*) from certs) + (select count(*) from settings) + (select count(*) from whitelist)"
+	if err = tx.QueryRowContext(ctx, q).Scan(&existing); err != nil {
+		panic(err)
+	}
+	if existing > 0 {
+		log.Warn(TAG, "refusing to import into non-empty database", existing)
+		httputil.SendJSON(writer, http.StatusConflict, struct{}{})
+		return
+	}
+
+	if err = restoreBackup(ctx, tx, b); err != nil {
+		log.Warn(TAG, "backup document rejected by database", err)
+		sendFieldErrors(writer, fieldErrors{"": err.Error()})
+		return
+	}
+	if err = tx.Commit(); err != nil {
+		panic(err)
+	}
+	invalidateSettings()
+
+	recordEvent(req, "data imported", "", fmt.Sprintf("%d users, %d certs from backup of %s", len(b.Users), len(b.Certs), b.Exported))
+	log.Status(TAG, "imported backup", len(b.Users), len(b.Certs))
+	httputil.SendJSON(writer, http.StatusOK, &struct{ Users, Certs, Settings, Whitelist int }{
+		len(b.Users), len(b.Certs), len(b.Settings), len(b.Whitelist),
+	})
+}
+
+// normalizeBackup checks b's settings and emails as the handlers that would otherwise have stored
+// them do, replacing them with their normalized forms. Errors are keyed by e.g.
+// "Settings.ClientLimit" or "Users.Email".
+func normalizeBackup(b *backup) fieldErrors {
+	errs := fieldErrors{}
+
+	s := defaultSettings()
+	for _, bs := range b.Settings {
+		if err := parseSetting(s, bs.Key, bs.Value); err != nil {
+			errs["Settings."+bs.Key] = err.Error()
+		}
+	}
+	for field, problem := range validateSettings(s) {
+		errs["Settings."+field] = problem
+	}
+	if len(errs) == 0 {
+		rows := map[string]string{}
+		for _, row := range settingRows(s) {
+			rows[row[0]] = row[1]
+		}
+		for _, bs := range b.Settings {
+			bs.Value = rows[bs.Key]
+		}
+	}
+
+	normalize := func(field string, email *string) {
+		if normalized, err := normalizeEmail(*email); err != nil {
+			errs[field] = fmt.Sprintf("'%s': %s", *email, err)
+		} else {
+			*email = normalized
+		}
+	}
+	for _, u := range b.Users {
+		normalize("Users.Email", &u.Email)
+	}
+	for _, c := range b.Certs {
+		normalize("Certs.Email", &c.Email)
+	}
+	for i := range b.Whitelist {
+		normalize("Whitelist", &b.Whitelist[i])
+	}
+	return errs
+}
+
+// restoreBackup inserts the contents of b within tx; returns an error (e.g. a constraint violation
+// from duplicate records) if the document can't be stored as-is
+func restoreBackup(ctx context.Context, tx *sql.Tx, b *backup) error {
+	for _, u := range b.Users {
+		// seeds exported encrypted are stored as-is, so they must be under this server's key
+		if _, err := decryptSeed(u.Seed); err != nil {
+			return fmt.Errorf("TOTP seed of '%s' can't be decrypted with this server's SeedEncryptionKey: %s", u.Email, err)
+		}
+		q := "insert into totp (email, seed, created, updated, archived, client_limit, issuer) values (?, ?, ?, ?, ?, ?, ?)"
+		if _, err := tx.ExecContext(ctx, q, u.Email, encryptSeed(u.Seed), u.Created, u.Updated, u.Archived, u.ClientLimit, u.Issuer); err != nil {
+			return fmt.Errorf("user '%s': %s", u.Email, err)
+		}
+	}
+	for _, c := range b.Certs {
+		q := "insert into certs (email, fingerprint, desc, created, expires, revoked, serial, revocation_reason, pem, imported) values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"
+		if _, err := tx.ExecContext(ctx, q, c.Email, c.Fingerprint, c.Description, c.Created, c.Expires, c.Revoked, c.Serial, c.RevocationReason, c.PEM, c.Imported); err != nil {
+			return fmt.Errorf("cert '%s': %s", c.Fingerprint, err)
+		}
+	}
+	for _, s := range b.Settings {
+		if _, err := tx.ExecContext(ctx, "insert into settings (key, value) values (?, ?)", s.Key, s.Value); err != nil {
+			return fmt.Errorf("setting '%s': %s", s.Key, err)
+		}
+	}
+	for _, email := range b.Whitelist {
+		if _, err := tx.ExecContext(ctx, "insert into whitelist (email) values (?)", email); err != nil {
+			return fmt.Errorf("whitelist entry '%s': %s", email, err)
+		}
+	}
+	return nil
+}
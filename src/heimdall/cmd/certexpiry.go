@@ -0,0 +1,83 @@
+// Copyright © 2018 Playground Global, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Background revocation of expired certs, per the RevokeExpiredCerts setting, so that they stop
+// counting as active toward cert limits.
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// certExpiryInterval is how often unrevoked certs are checked for expiry; see runPeriodically
+const certExpiryInterval = time.Hour
+
+// revokeExpiredCerts revokes certs past their expiry (if RevokeExpiredCerts is set), recording a
+// "certificate revoked" event for each
+func revokeExpiredCerts(ctx context.Context) {
+	TAG := "revokeExpiredCerts"
+
+	if !loadSettings(ctx).RevokeExpiredCerts {
+		return
+	}
+
+	cxn := getDB()
+	defer cxn.Close()
+	tx, err := cxn.BeginTx(ctx, nil)
+	if err != nil {
+		panic(err)
+	}
+	defer tx.Rollback()
+
+	type expired struct{ Email, Fingerprint string }
+	certs := []expired{}
+	rows, err := tx.QueryContext(ctx, "select email, fingerprint from certs where revoked is null and expires <= datetime('now')")
+	if err != nil {
+		panic(err)
+	}
+	for rows.Next() {
+		c := expired{}
+		if err := rows.Scan(&c.Email, &c.Fingerprint); err != nil {
+			rows.Close()
+			panic(err)
+		}
+		certs = append(certs, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		panic(err)
+	}
+	if len(certs) == 0 {
+		return
+	}
+
+	for _, c := range certs {
+		q := "update certs set revoked=datetime('now'), revocation_reason='cessation-of-operation' where fingerprint=? and revoked is null"
+		if _, err := tx.ExecContext(ctx, q, c.Fingerprint); err != nil {
+			panic(err)
+		}
+		q = "insert into events (event, email, value) values (?, ?, ?)"
+		if _, err := tx.ExecContext(ctx, q, "certificate revoked", c.Email, fmt.Sprintf("%s - expired", c.Fingerprint)); err != nil {
+			panic(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		panic(err)
+	}
+	resetOCSPCache()
+	log.Status(TAG, "revoked expired certs", len(certs))
+}
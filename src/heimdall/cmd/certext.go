@@ -0,0 +1,99 @@
+// Copyright © 2018 Playground Global, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Static custom extensions, per the CertExtensions config field, added to every issued client cert
+// for VPN policy engines that key off them. They're read at startup and apply only to certs issued
+// afterward; certs already issued keep whatever extensions they were issued with.
+
+import (
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// certExtension is a CertExtensions entry: an OID in dotted form (e.g. "1.3.6.1.4.1.99999.1") and
+// either a Value, encoded as an ASN.1 UTF8String, or DER, the hex of an arbitrary DER encoding
+type certExtension struct {
+	OID, Value, DER string
+	Critical        bool
+}
+
+// certExtensions is CertExtensions, parsed once at startup by initConfig
+var certExtensions []pkix.Extension
+
+// parseCertExtensions converts CertExtensions entries to the extensions to add to certs, returning
+// an error for a malformed OID or value, a duplicate OID, or one in the X.509 standard extensions'
+// arc (2.5.29), which Heimdall sets itself
+func parseCertExtensions(exts []*certExtension) ([]pkix.Extension, error) {
+	ret := []pkix.Extension{}
+	seen := map[string]bool{}
+	for _, e := range exts {
+		oid, err := parseOID(e.OID)
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(oid.String()+".", "2.5.29.") {
+			return nil, fmt.Errorf("OID %s is a standard X.509 extension, which can't be overridden", oid)
+		}
+		if seen[oid.String()] {
+			return nil, fmt.Errorf("OID %s is listed more than once", oid)
+		}
+		seen[oid.String()] = true
+
+		var value []byte
+		switch {
+		case e.Value != "" && e.DER != "":
+			return nil, fmt.Errorf("OID %s has both a Value and DER", oid)
+		case e.DER != "":
+			if value, err = hex.DecodeString(e.DER); err != nil {
+				return nil, fmt.Errorf("OID %s: DER is not hex: %s", oid, err)
+			}
+			var v asn1.RawValue
+			if rest, err := asn1.Unmarshal(value, &v); err != nil || len(rest) > 0 {
+				return nil, fmt.Errorf("OID %s: DER is not a single DER value", oid)
+			}
+		default:
+			if value, err = asn1.MarshalWithParams(e.Value, "utf8"); err != nil {
+				return nil, fmt.Errorf("OID %s: %s", oid, err)
+			}
+		}
+		ret = append(ret, pkix.Extension{Id: oid, Critical: e.Critical, Value: value})
+	}
+	return ret, nil
+}
+
+// parseOID parses a dotted OID, which must have at least two arcs, the first 0, 1, or 2
+func parseOID(s string) (asn1.ObjectIdentifier, error) {
+	parts := strings.Split(strings.TrimSpace(s), ".")
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("'%s' is not a dotted OID", s)
+	}
+	oid := make(asn1.ObjectIdentifier, len(parts))
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 || p != strconv.Itoa(n) {
+			return nil, fmt.Errorf("'%s' is not a dotted OID", s)
+		}
+		oid[i] = n
+	}
+	if oid[0] > 2 || (oid[0] < 2 && oid[1] > 39) {
+		return nil, fmt.Errorf("'%s' is not a valid OID", s)
+	}
+	return oid, nil
+}
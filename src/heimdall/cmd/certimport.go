@@ -0,0 +1,110 @@
+// Copyright © 2018 Playground Global, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Import of certs issued outside Heimdall (e.g. by hand, before migrating to it) by the same CA,
+// so that they can be listed, revoked, and covered by the CRL without being reissued.
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"time"
+
+	"playground/httputil"
+)
+
+// issuedByTrustedCA reports whether cert is signed by the current CA or, during a rotation, the next
+func issuedByTrustedCA(cert *x509.Certificate) bool {
+	for _, signer := range loadCASigners() {
+		if cert.CheckSignatureFrom(signer.Cert) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// importCert handles POST /certs/<email>/import; see certsHandler. The user's cert limit isn't
+// enforced, since the cert already exists either way.
+func importCert(writer http.ResponseWriter, req *http.Request, email string) {
+	TAG := "/certs/import"
+	ctx := req.Context()
+
+	reqBody := &struct{ PEM, Description string }{}
+	if errs := decodeStrictJSON(reqBody, req); errs != nil {
+		log.Warn(TAG, "missing or malformed request JSON", req.URL.Path, errs)
+		sendFieldErrors(writer, errs)
+		return
+	}
+
+	errs := fieldErrors{}
+	s := loadSettings(ctx)
+	var problem string
+	if reqBody.Description, problem = normalizeCertDescription(s, email, reqBody.Description); problem != "" {
+		errs["Description"] = problem
+	}
+	var cert *x509.Certificate
+	if block, _ := pem.Decode([]byte(reqBody.PEM)); block == nil || block.Type != "CERTIFICATE" {
+		errs["PEM"] = "must be a PEM-encoded certificate"
+	} else if parsed, err := x509.ParseCertificate(block.Bytes); err != nil {
+		errs["PEM"] = "must be a PEM-encoded certificate"
+	} else if parsed.IsCA {
+		errs["PEM"] = "must be a client certificate, not a CA"
+	} else if !issuedByTrustedCA(parsed) {
+		errs["PEM"] = "not issued by the configured CA"
+	} else if time.Now().After(parsed.NotAfter) {
+		errs["PEM"] = "has expired"
+	} else {
+		cert = parsed
+	}
+	if len(errs) > 0 {
+		log.Warn(TAG, "invalid import request", req.URL.Path, errs)
+		sendFieldErrors(writer, errs)
+		return
+	}
+
+	cxn := getDB()
+	defer cxn.Close()
+	var exists bool
+	if err := cxn.QueryRowContext(ctx, "select count(*) > 0 from totp where email=? and archived is null", email).Scan(&exists); err != nil {
+		panic(err)
+	}
+	if !exists {
+		log.Warn(TAG, "attempt to import cert for nonexistent user", email)
+		httputil.SendJSON(writer, http.StatusNotFound, struct{}{})
+		return
+	}
+	fp := certFingerprint(cert)
+	if err := cxn.QueryRowContext(ctx, "select count(*) > 0 from certs where fingerprint=?", fp).Scan(&exists); err != nil {
+		panic(err)
+	}
+	if exists {
+		log.Warn(TAG, "attempt to import a cert already recorded", email, fp)
+		httputil.SendJSON(writer, http.StatusConflict, struct{}{})
+		return
+	}
+	cxn.Close()
+
+	q := "insert into certs (email, fingerprint, desc, serial, created, expires, pem, imported) values (?, ?, ?, ?, ?, ?, ?, 1)"
+	created, expires := cert.NotBefore.UTC().Format("2006-01-02 15:04:05"), cert.NotAfter.UTC().Format("2006-01-02 15:04:05")
+	serial := fmt.Sprintf("%x", cert.SerialNumber)
+	crt := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	writeDatabaseByQuery(ctx, q, email, fp, reqBody.Description, serial, created, expires, string(crt))
+	recordEvent(req, "certificate imported", email, fmt.Sprintf("%s - serial %s - %s", fp, serial, reqBody.Description))
+
+	log.Status(TAG, fmt.Sprintf("imported certificate '%s' for '%s'", fp, email), requestID(req))
+	httputil.SendJSON(writer, http.StatusCreated, struct{ Fingerprint, Expires string }{fp, expires})
+}
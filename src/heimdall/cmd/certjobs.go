@@ -0,0 +1,197 @@
+// Copyright © 2018 Playground Global, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Asynchronous cert issuance, for POST /certs/<email>?async=true: the request is queued and
+// answered at once with a job ID, and a fixed pool of workers does the key generation, so that a
+// burst of requests can't tie up every CPU. Like Idempotency-Key results, jobs are held only in
+// memory, since a finished job holds the private key; they don't survive a restart.
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"playground/httputil"
+)
+
+// certJobQueueSize is how many jobs may wait for a worker before further requests are refused
+const certJobQueueSize = 100
+
+// certJobTTL is how long a finished job's result is kept for collection
+const certJobTTL = 15 * time.Minute
+
+type certJob struct {
+	id       string
+	req      *http.Request // a copy of the original request, detached from its context
+	s        *settings
+	email    string
+	desc     string
+	keyBits  int
+	keyPass  string // for the issued key; held only until the job runs
+	profile  string
+	tmpl     *template.Template
+	status   string // "queued", "running", "done", or "failed"
+	dataURL  string // once done
+	errMsg   string // once failed
+	finished time.Time
+}
+
+var certJobs = struct {
+	sync.Mutex
+	jobs  map[string]*certJob
+	queue chan *certJob
+}{jobs: make(map[string]*certJob), queue: make(chan *certJob, certJobQueueSize)}
+
+// startCertJobWorkers starts the pool of IssuanceWorkers goroutines that run queued jobs; 0 means
+// one per CPU
+func startCertJobWorkers() {
+	n := cfg.IssuanceWorkers
+	if n <= 0 {
+		n = runtime.NumCPU()
+	}
+	for i := 0; i < n; i++ {
+		go func() {
+			for job := range certJobs.queue {
+				runCertJob(job)
+			}
+		}()
+	}
+}
+
+// enqueueCertJob queues issuance of a cert, returning its job ID, or "" if the queue is full. The
+// request is copied without its context, which is canceled once the handler returns; the copy
+// keeps the request ID, and the client details recorded in events.
+func enqueueCertJob(req *http.Request, s *settings, email, desc string, keyBits int, keyPass, profile string, tmpl *template.Template) string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	job := &certJob{
+		id:      hex.EncodeToString(buf),
+		req:     req.Clone(context.WithValue(context.Background(), requestIDKey{}, requestID(req))),
+		s:       s,
+		email:   email,
+		desc:    desc,
+		keyBits: keyBits,
+		keyPass: keyPass,
+		profile: profile,
+		tmpl:    tmpl,
+		status:  "queued",
+	}
+
+	certJobs.Lock()
+	defer certJobs.Unlock()
+	now := time.Now()
+	for id, j := range certJobs.jobs {
+		if !j.finished.IsZero() && now.Sub(j.finished) > certJobTTL {
+			delete(certJobs.jobs, id)
+		}
+	}
+	select {
+	case certJobs.queue <- job:
+		certJobs.jobs[job.id] = job
+		return job.id
+	default:
+		return ""
+	}
+}
+
+// runCertJob issues the cert a job describes, recording the result in the job. The checks made
+// when the job was queued (see checkIssuable) are repeated, since the user may have been archived
+// or reached a limit while the job waited, and the job fails if they now refuse; as it does in
+// maintenance mode.
+func runCertJob(job *certJob) {
+	TAG := "runCertJob"
+
+	setJob := func(status, dataURL, errMsg string) {
+		certJobs.Lock()
+		defer certJobs.Unlock()
+		job.status, job.dataURL, job.errMsg = status, dataURL, errMsg
+		if status == "done" || status == "failed" {
+			job.finished = time.Now()
+		}
+	}
+	setJob("running", "", "")
+
+	// there's no handler here to recover a panic, and an unrecovered one would take down the server
+	defer func() {
+		if r := recover(); r != nil {
+			log.Error(TAG, fmt.Sprintf("panic in cert job %s: %v\n%s", job.id, r, debug.Stack()), requestID(job.req))
+			setJob("failed", "", "internal")
+		}
+	}()
+
+	if inMaintenance() {
+		log.Warn(TAG, "cert job refused during maintenance", job.id, job.email)
+		setJob("failed", "", "maintenance mode")
+		return
+	}
+	discard := &discardResponse{}
+	if !checkIssuable(discard, job.req, job.s, job.email, job.desc) {
+		log.Warn(TAG, "cert job no longer issuable", job.id, job.email, discard.status)
+		setJob("failed", "", "refused: "+strings.ToLower(http.StatusText(discard.status)))
+		return
+	}
+
+	fp, ovpn, _, err := issueCert(job.req, job.s, job.email, job.desc, job.keyBits, job.keyPass, job.tmpl)
+	job.keyPass = ""
+	if err != nil {
+		log.Error(TAG, "rendered .ovpn is malformed; check the template", job.profile, err)
+		setJob("failed", "", "internal")
+		return
+	}
+	log.Status(TAG, fmt.Sprintf("issued new certificate '%s' for '%s' in job %s", fp, job.email, job.id), requestID(job.req))
+	setJob("done", ovpnDataURL(ovpn), "")
+}
+
+func certJobHandler(writer http.ResponseWriter, req *http.Request) {
+	// GET /cert-job/<id> -- poll an asynchronous issuance started by POST /certs/<email>?async=true
+	//   I: None
+	//   O: {Status: "", OVPNDataURL: "", Error: ""}
+	//   200: the object above; 404: no such job, or its result was already collected or expired
+	//   Status is "queued", "running", "done", or "failed". OVPNDataURL is set only once done, as
+	//   for POST /certs/<email>, and can be collected only once: the job is then forgotten, since
+	//   it holds the private key. Error is set only if failed, e.g. "refused: not found" if the user
+	//   was archived while the job was queued, since the issuance checks are made again when it
+	//   runs. Uncollected results are discarded 15 minutes after the job finishes.
+	// Non-GET: 405 (method not allowed)
+
+	TAG := "/cert-job/"
+
+	id := extractSegment(req.URL.Path, 2)
+
+	certJobs.Lock()
+	defer certJobs.Unlock()
+	job, ok := certJobs.jobs[id]
+	if !ok || (!job.finished.IsZero() && time.Since(job.finished) > certJobTTL) {
+		log.Warn(TAG, "unknown or expired cert job", id)
+		httputil.SendJSON(writer, http.StatusNotFound, struct{}{})
+		return
+	}
+	if job.status == "done" {
+		delete(certJobs.jobs, id)
+		log.Status(TAG, fmt.Sprintf("delivered cert job %s for '%s'", id, job.email), requestID(req))
+	}
+	httputil.SendJSON(writer, http.StatusOK, struct{ Status, OVPNDataURL, Error string }{job.status, job.dataURL, job.errMsg})
+}
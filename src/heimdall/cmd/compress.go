@@ -0,0 +1,106 @@
+// Copyright © 2018 Playground Global, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Response compression. This would more naturally be a stage on httputil.Wrapper, but since that
+// package is vendored from upstream, it lives here as a handler wrapper like withDBDeadline.
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// compressionThreshold is the smallest response body, in bytes, worth gzipping
+const compressionThreshold = 1024
+
+// bufferedWriter holds a handler's response so that it can be compressed (or not) once its final
+// size is known
+type bufferedWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *bufferedWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *bufferedWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.body.Write(b)
+}
+
+// acceptsGzip indicates whether the request's Accept-Encoding permits a gzip response
+func acceptsGzip(req *http.Request) bool {
+	for _, enc := range strings.Split(req.Header.Get("Accept-Encoding"), ",") {
+		parts := strings.Split(enc, ";")
+		if strings.ToLower(strings.TrimSpace(parts[0])) != "gzip" {
+			continue
+		}
+		for _, param := range parts[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil && q == 0 {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// withCompression wraps a handler such that responses of at least compressionThreshold bytes are
+// gzipped for clients that send "Accept-Encoding: gzip". Smaller responses, and those to clients
+// that don't accept gzip, are sent as-is. Either way Content-Length is set to the actual size sent.
+func withCompression(handler http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, req *http.Request) {
+		writer.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsGzip(req) {
+			handler(writer, req)
+			return
+		}
+
+		bw := &bufferedWriter{ResponseWriter: writer}
+		handler(bw, req)
+		if bw.status == 0 {
+			bw.status = http.StatusOK
+		}
+
+		body := bw.body.Bytes()
+		if len(body) >= compressionThreshold && writer.Header().Get("Content-Encoding") == "" {
+			var gz bytes.Buffer
+			zw := gzip.NewWriter(&gz)
+			if _, err := zw.Write(body); err != nil {
+				panic(err)
+			}
+			if err := zw.Close(); err != nil {
+				panic(err)
+			}
+			body = gz.Bytes()
+			writer.Header().Set("Content-Encoding", "gzip")
+		}
+		writer.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		writer.WriteHeader(bw.status)
+		writer.Write(body)
+	}
+}
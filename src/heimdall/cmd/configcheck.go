@@ -0,0 +1,182 @@
+// Copyright © 2018 Playground Global, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Startup validation of the config, so that a missing file or a wrong CA key password is reported
+// plainly, all at once, instead of as a panic from deep in whatever first trips over it.
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// validateConfig returns a description of each problem with cfg: unreadable files, a CA key that
+// doesn't decrypt with its password or doesn't match its cert, a server cert and key that don't
+// match, broken templates, and out-of-range or malformed values. It returns nil if there are none.
+func validateConfig(cfg *serverConfig) []string {
+	problems := []string{}
+	addf := func(format string, a ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, a...))
+	}
+
+	// files, checked for readability first so that later checks report only deeper problems
+	readable := func(field, file string) bool {
+		f, err := os.Open(file)
+		if err != nil {
+			addf("%s: %s", field, err)
+			return false
+		}
+		f.Close()
+		return true
+	}
+	readable("SelfSignedClientCertFile", cfg.SelfSignedClientCertFile)
+	if cfg.SQLiteReadDBFile != "" {
+		readable("SQLiteReadDBFile", cfg.SQLiteReadDBFile)
+	}
+	if readable("ServerCertFile", cfg.ServerCertFile) && readable("ServerKeyFile", cfg.ServerKeyFile) {
+		if _, err := tls.LoadX509KeyPair(cfg.ServerCertFile, cfg.ServerKeyFile); err != nil {
+			addf("ServerCertFile/ServerKeyFile: %s", err)
+		}
+	}
+	if readable("CACertFile", cfg.CACertFile) && readable("CAKeyFile", cfg.CAKeyFile) {
+		if err := checkCAFiles(cfg.CACertFile, cfg.CAKeyFile, cfg.CAKeyPassword); err != nil {
+			addf("CACertFile/CAKeyFile: %s (is %s correct?)", err, keyPasswordSource("", cfg.CAKeyPasswordFile, cfg.CAKeyPasswordCommand))
+		} else if err := verifyCAChain(cfg.CACertFile, cfg.CAChainFile); err != nil {
+			// when signing from an intermediate CA, confirm it may sign and chains to its root
+			addf("CAChainFile: %s", err)
+		}
+	}
+	if cfg.NextCACertFile != "" && readable("NextCACertFile", cfg.NextCACertFile) && readable("NextCAKeyFile", cfg.NextCAKeyFile) {
+		if err := checkCAFiles(cfg.NextCACertFile, cfg.NextCAKeyFile, cfg.NextCAKeyPassword); err != nil {
+			addf("NextCACertFile/NextCAKeyFile: %s (is %s correct?)", err, keyPasswordSource("Next", cfg.NextCAKeyPasswordFile, cfg.NextCAKeyPasswordCommand))
+		} else if err := verifyCAChain(cfg.NextCACertFile, cfg.NextCAChainFile); err != nil {
+			addf("NextCAChainFile: %s", err)
+		}
+	}
+	if readable("TLSAuthFile", cfg.TLSAuthFile) {
+		if fi, err := os.Stat(cfg.TLSAuthFile); err == nil && fi.Size() == 0 {
+			addf("TLSAuthFile: '%s' is empty", cfg.TLSAuthFile)
+		}
+	}
+	if readable("OVPNTemplateFile", cfg.OVPNTemplateFile) {
+		if err := checkTemplateFile(cfg.OVPNTemplateFile); err != nil {
+			addf("OVPNTemplateFile: %s", err)
+		}
+	}
+	profiles := []string{}
+	for profile := range cfg.OVPNTemplateProfiles {
+		profiles = append(profiles, profile)
+	}
+	sort.Strings(profiles)
+	for _, profile := range profiles {
+		field := fmt.Sprintf("OVPNTemplateProfiles[%s]", profile)
+		if file := cfg.OVPNTemplateProfiles[profile]; readable(field, file) {
+			if err := checkTemplateFile(file); err != nil {
+				addf("%s: %s", field, err)
+			}
+		}
+	}
+
+	// numeric ranges
+	if unixSocketPath() == "" && (cfg.Port < 1 || cfg.Port > 65535) {
+		addf("Port: %d is not a valid port", cfg.Port)
+	}
+	if cfg.AdminPort < 0 || cfg.AdminPort > 65535 {
+		addf("AdminPort: %d is not a valid port", cfg.AdminPort)
+	} else if cfg.AdminPort != 0 && cfg.AdminPort == cfg.Port && cfg.AdminBindAddress == cfg.BindAddress {
+		addf("AdminPort: must differ from Port")
+	}
+	if cfg.SCEPPort < 0 || cfg.SCEPPort > 65535 {
+		addf("SCEPPort: %d is not a valid port", cfg.SCEPPort)
+	} else if cfg.SCEPPort != 0 && ((cfg.SCEPPort == cfg.Port && cfg.SCEPBindAddress == cfg.BindAddress) || (cfg.SCEPPort == cfg.AdminPort && cfg.SCEPBindAddress == cfg.AdminBindAddress)) {
+		addf("SCEPPort: must differ from Port and AdminPort")
+	} else if cfg.SCEPPort != 0 && cfg.SCEPChallengePassword == "" {
+		addf("SCEPPort: SCEP is disabled unless SCEPChallengePassword is set")
+	}
+	for field, value := range map[string]int{
+		"LogMaxSizeMB":         cfg.LogMaxSizeMB,
+		"LogMaxBackups":        cfg.LogMaxBackups,
+		"LogMaxAgeDays":        cfg.LogMaxAgeDays,
+		"DBBusyTimeoutMs":      cfg.DBBusyTimeoutMs,
+		"OCSPCacheTTLSeconds":  cfg.OCSPCacheTTLSeconds,
+		"CACacheMaxAgeSeconds": cfg.CACacheMaxAgeSeconds,
+		"IssuanceWorkers":      cfg.IssuanceWorkers,
+	} {
+		if value < 0 {
+			addf("%s: must not be negative", field)
+		}
+	}
+	for field, value := range map[string]int{
+		"DBQueryTimeoutMs":    cfg.DBQueryTimeoutMs,
+		"MaxRequestBodyBytes": cfg.MaxRequestBodyBytes,
+		"MaxImportBodyBytes":  cfg.MaxImportBodyBytes,
+	} {
+		if value < 1 {
+			addf("%s: must be positive", field)
+		}
+	}
+	if cfg.MaxEventValueLength < 0 || (cfg.MaxEventValueLength > 0 && cfg.MaxEventValueLength < minEventValueLength) {
+		addf("MaxEventValueLength: must be 0 (unlimited) or at least %d", minEventValueLength)
+	}
+
+	// formats
+	// a header name that isn't an RFC 7230 token can never be sent, locking out every client
+	if !validHeaderName.MatchString(cfg.APIHeader) {
+		addf("APIHeader: '%s' is not a valid HTTP header name", cfg.APIHeader)
+	}
+	for _, k := range cfg.APIKeys {
+		if k.Key == "" || (k.Scope != "read" && k.Scope != "admin") {
+			addf("APIKeys: key '%s' must have a Key and a Scope of \"read\" or \"admin\"", k.Name)
+		}
+	}
+	for tag, name := range cfg.LogLevels {
+		if _, ok := logLevelNames[strings.ToLower(name)]; !ok {
+			addf("LogLevels: unknown level '%s' for tag '%s'", name, tag)
+		}
+	}
+	if _, _, err := tlsPolicy(); err != nil {
+		addf("MinTLSVersion/CipherSuites: %s", err)
+	}
+	if _, err := parseCertExtensions(cfg.CertExtensions); err != nil {
+		addf("CertExtensions: %s", err)
+	}
+
+	sort.Strings(problems)
+	if len(problems) == 0 {
+		return nil
+	}
+	return problems
+}
+
+// validateConfigOrExit validates cfg, and if there are any problems (including any earlier ones
+// given), logs them and exits
+func validateConfigOrExit(cfg *serverConfig, earlier ...string) {
+	TAG := "validateConfig"
+
+	problems := append(earlier, validateConfig(cfg)...)
+	if len(problems) == 0 {
+		return
+	}
+	// the log may be a file, so say so on stderr too, where whoever started the server will see it
+	fmt.Fprintln(os.Stderr, "heimdall: invalid configuration:")
+	for _, p := range problems {
+		log.Error(TAG, p)
+		fmt.Fprintln(os.Stderr, "  "+p)
+	}
+	os.Exit(1)
+}
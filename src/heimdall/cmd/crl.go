@@ -0,0 +1,171 @@
+// Copyright © 2018 Playground Global, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"playground/httputil"
+)
+
+// crlEntry is a revoked cert, as it would appear in a CRL
+type crlEntry struct {
+	Fingerprint, Email, Serial, Revoked, Reason string
+}
+
+// listCRLEntries returns the certs a CRL should list: those revoked but not yet expired, since an
+// expired cert is refused anyway. Entries are in order of revocation. This is the single definition
+// of a CRL's contents, for GET /crl/preview and anything that signs one.
+func listCRLEntries(ctx context.Context) []*crlEntry {
+	q := `select fingerprint, email, serial, revoked, revocation_reason from certs
+	      where revoked is not null and expires > datetime('now')
+	      order by revoked, rowid`
+	cxn := getDB()
+	defer cxn.Close()
+	rows, err := cxn.QueryContext(ctx, q)
+	if err != nil {
+		panic(err)
+	}
+	defer rows.Close()
+
+	entries := []*crlEntry{}
+	for rows.Next() {
+		e := &crlEntry{}
+		if err := rows.Scan(&e.Fingerprint, &e.Email, &e.Serial, &e.Revoked, &e.Reason); err != nil {
+			panic(err)
+		}
+		entries = append(entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		panic(err)
+	}
+	return entries
+}
+
+func crlPreviewHandler(writer http.ResponseWriter, req *http.Request) {
+	// GET /crl/preview -- list the certs a CRL would contain, without signing anything
+	//   I: None
+	//   O: [{Fingerprint: "", Email: "", Serial: "", Revoked: "", Reason: ""}]
+	//   200: the list above, possibly empty
+	//   Lists revoked certs that haven't yet expired, oldest revocation first. Reason is one of the
+	//   revocationReasons names, or "" if none was given; Serial is "" for certs issued before
+	//   serials were recorded, which a CRL can't list.
+	//   The list changes with every revocation, so it carries an ETag and must be revalidated;
+	//   an If-None-Match that matches gets a 304 (not modified).
+	// Non-GET: 405 (method not allowed)
+
+	body, err := json.Marshal(listCRLEntries(req.Context()))
+	if err != nil {
+		panic(err)
+	}
+	sendCacheable(writer, req, "application/json", body, time.Time{}, 0)
+}
+
+// revocationEntry is a crlEntry as listed by GET /revocations, with the cursor to pass as after to
+// list only the revocations made since it
+type revocationEntry struct {
+	crlEntry
+	Cursor int64
+}
+
+// defaultRevocationsLimit and maxRevocationsLimit bound a page of GET /revocations
+const (
+	defaultRevocationsLimit = 100
+	maxRevocationsLimit     = 1000
+)
+
+func revocationsHandler(writer http.ResponseWriter, req *http.Request) {
+	// GET /revocations -- list certs revoked since a cursor, e.g. to sync a CRL incrementally
+	//   I: None
+	//   O: [{Fingerprint: "", Email: "", Serial: "", Revoked: "", Reason: "", Cursor: 0}]
+	//   200: the list above, possibly empty; 400 (bad request): malformed after, since, or limit,
+	//   with body {Errors: {<param>: "problem"}}
+	//   Accepts query parameters "after", a Cursor from an earlier response; "since", an RFC 3339
+	//   timestamp (e.g. "2018-06-01T12:00:00Z"); and "limit", from 1 to maxRevocationsLimit
+	//   (default defaultRevocationsLimit). Lists certs revoked after both (or all, without either),
+	//   in the order they were revoked, including expired ones. Cursors strictly increase with each
+	//   revocation, unlike Revoked, which has only one-second resolution; so to fetch the next page,
+	//   or sync later, pass the last entry's Cursor as after. since is only for a first sync. A cert
+	//   revoked again (e.g. with a new reason) is listed again, with a new Cursor. Reason and Serial
+	//   are as for GET /crl/preview.
+	// Non-GET: 405 (method not allowed)
+
+	TAG := "/revocations"
+	ctx := req.Context()
+
+	params := req.URL.Query()
+	errs := fieldErrors{}
+	after := int64(0)
+	if raw := params.Get("after"); raw != "" {
+		if tmp, err := strconv.ParseInt(raw, 10, 64); err != nil || tmp < 0 {
+			errs["after"] = "must be a Cursor from an earlier response"
+		} else {
+			after = tmp
+		}
+	}
+	since := ""
+	if raw := params.Get("since"); raw != "" {
+		if t, err := time.Parse(time.RFC3339, raw); err != nil {
+			errs["since"] = "must be an RFC 3339 timestamp"
+		} else {
+			// revocation times are stored in UTC
+			since = t.UTC().Format("2006-01-02 15:04:05")
+		}
+	}
+	limit := defaultRevocationsLimit
+	if raw := params.Get("limit"); raw != "" {
+		if tmp, err := strconv.Atoi(raw); err != nil || tmp < 1 || tmp > maxRevocationsLimit {
+			errs["limit"] = fmt.Sprintf("must be from 1 to %d", maxRevocationsLimit)
+		} else {
+			limit = tmp
+		}
+	}
+	if len(errs) > 0 {
+		log.Warn(TAG, "malformed query parameters", req.URL.RawQuery, errs)
+		sendFieldErrors(writer, errs)
+		return
+	}
+
+	q := `select fingerprint, email, serial, strftime('%Y-%m-%dT%H:%M:%SZ', revoked), revocation_reason,
+	        revocation_seq from certs
+	      where revoked is not null and revocation_seq > ? and revoked > ?
+	      order by revocation_seq limit ?`
+	cxn := getReadDB()
+	defer cxn.Close()
+	rows, err := cxn.QueryContext(ctx, q, after, since, limit)
+	if err != nil {
+		panic(err)
+	}
+	defer rows.Close()
+
+	entries := []*revocationEntry{}
+	for rows.Next() {
+		e := &revocationEntry{}
+		if err := rows.Scan(&e.Fingerprint, &e.Email, &e.Serial, &e.Revoked, &e.Reason, &e.Cursor); err != nil {
+			panic(err)
+		}
+		entries = append(entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		panic(err)
+	}
+
+	httputil.SendJSON(writer, http.StatusOK, entries)
+}
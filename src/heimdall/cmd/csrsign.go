@@ -0,0 +1,119 @@
+// Copyright © 2018 Playground Global, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Issuance from a client-supplied CSR, for clients that generate their own keypair (e.g. in a
+// hardware keystore) and never hand over the private key.
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"time"
+
+	"playground/httputil"
+)
+
+// validCSRCurves lists the elliptic curves accepted for ECDSA keys in CSRs. Heimdall itself only
+// generates RSA keys, but P-256 is all many hardware keystores offer.
+var validCSRCurves = map[elliptic.Curve]bool{
+	elliptic.P256(): true,
+	elliptic.P384(): true,
+}
+
+// checkCSRKey returns "" if a CSR's public key is allowed, i.e. it's RSA of one of validKeyBits, or
+// ECDSA on one of validCSRCurves; otherwise a description of the problem
+func checkCSRKey(csr *x509.CertificateRequest) string {
+	switch pub := csr.PublicKey.(type) {
+	case *rsa.PublicKey:
+		if !isValidKeyBits(pub.N.BitLen()) {
+			return fmt.Sprintf("RSA keys must be one of %v bits", validKeyBits)
+		}
+	case *ecdsa.PublicKey:
+		if !validCSRCurves[pub.Curve] {
+			return "ECDSA keys must use curve P-256 or P-384"
+		}
+	default:
+		return "key must be RSA or ECDSA"
+	}
+	return ""
+}
+
+// signCSR handles POST /certs/<email>/sign; see certsHandler. Only the CSR's public key is used:
+// the issued cert's subject and extensions are Heimdall's own, exactly as for a cert it generates.
+func signCSR(writer http.ResponseWriter, req *http.Request, email string) {
+	TAG := "/certs/sign"
+	ctx := req.Context()
+
+	reqBody := &struct{ CSR, Description string }{}
+	if errs := decodeStrictJSON(reqBody, req); errs != nil {
+		log.Warn(TAG, "missing or malformed request JSON", req.URL.Path, errs)
+		sendFieldErrors(writer, errs)
+		return
+	}
+
+	errs := fieldErrors{}
+	s := loadSettings(ctx)
+	var problem string
+	if reqBody.Description, problem = normalizeCertDescription(s, email, reqBody.Description); problem != "" {
+		errs["Description"] = problem
+	}
+	var csr *x509.CertificateRequest
+	if block, _ := pem.Decode([]byte(reqBody.CSR)); block == nil || block.Type != "CERTIFICATE REQUEST" {
+		errs["CSR"] = "must be a PEM-encoded certificate request"
+	} else if parsed, err := x509.ParseCertificateRequest(block.Bytes); err != nil {
+		errs["CSR"] = "must be a PEM-encoded certificate request"
+	} else if err = parsed.CheckSignature(); err != nil {
+		errs["CSR"] = "signature does not verify"
+	} else if cn, err := normalizeEmail(parsed.Subject.CommonName); err != nil || cn != email {
+		errs["CSR"] = "CN must be the email in the URL"
+	} else if problem := checkCSRKey(parsed); problem != "" {
+		errs["CSR"] = problem
+	} else {
+		csr = parsed
+	}
+	if len(errs) > 0 {
+		log.Warn(TAG, "invalid CSR request", req.URL.Path, errs)
+		sendFieldErrors(writer, errs)
+		return
+	}
+
+	// a pending request can't hold a CSR, so there's nothing for an approver to act on later
+	if s.RequireApproval {
+		log.Warn(TAG, "refused CSR signing; RequireApproval is set", email)
+		httputil.SendJSON(writer, http.StatusForbidden, struct{}{})
+		return
+	}
+
+	if !checkIssuable(writer, req, s, email, reqBody.Description) {
+		return
+	}
+
+	signer := loadSigningSigner(s)
+	backdate := time.Duration(s.CertBackdateMinutes) * time.Minute
+	cert, err := signer.signClientCert(s.IssuedCertDuration, certSubject(s, email), newCertSerial(ctx, s), csr.PublicKey, backdate)
+	if err != nil {
+		panic(err)
+	}
+	recordIssuedCert(req, email, reqBody.Description, cert)
+
+	fp := certFingerprint(cert)
+	log.Status(TAG, fmt.Sprintf("signed CSR as certificate '%s' for '%s'", fp, email), requestID(req))
+	httputil.SendJSON(writer, http.StatusCreated, struct{ Fingerprint, PEM string }{fp, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))})
+}
@@ -0,0 +1,198 @@
+// Copyright © 2018 Playground Global, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Database consistency checks. The schema forbids exact duplicate users and (since migration 8)
+// certs without a user, but databases from before normalizeEmail can hold users differing only in
+// case or whitespace, and ones written with foreign keys off can hold orphaned certs.
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+
+	"playground/httputil"
+)
+
+// duplicateUser is a set of totp rows whose emails normalize to the same address. Rows are
+// newest (by last update) first, so Rows[0] is the one a repair keeps.
+type duplicateUser struct {
+	Email string
+	Rows  []*duplicateRow
+}
+
+type duplicateRow struct {
+	RowID                             int64
+	Email, Created, Updated, Archived string
+}
+
+type orphanedCert struct {
+	Email, Fingerprint string
+}
+
+// findInconsistencies returns all duplicate users and orphaned certs visible to tx
+func findInconsistencies(ctx context.Context, tx *sql.Tx) ([]*duplicateUser, []*orphanedCert) {
+	dupes := []*duplicateUser{}
+	q := `select lower(trim(email)), rowid, email, created, updated, coalesce(strftime('%Y-%m-%dT%H:%M:%SZ', archived), '') from totp
+	      where lower(trim(email)) in (select lower(trim(email)) from totp group by lower(trim(email)) having count(*) > 1)
+	      order by lower(trim(email)), updated desc, rowid desc`
+	rows, err := tx.QueryContext(ctx, q)
+	if err != nil {
+		panic(err)
+	}
+	defer rows.Close()
+	var cur *duplicateUser
+	for rows.Next() {
+		var email string
+		r := &duplicateRow{}
+		if err := rows.Scan(&email, &r.RowID, &r.Email, &r.Created, &r.Updated, &r.Archived); err != nil {
+			panic(err)
+		}
+		if cur == nil || cur.Email != email {
+			cur = &duplicateUser{Email: email}
+			dupes = append(dupes, cur)
+		}
+		cur.Rows = append(cur.Rows, r)
+	}
+	if err := rows.Err(); err != nil {
+		panic(err)
+	}
+	rows.Close()
+
+	orphans := []*orphanedCert{}
+	q = "select email, fingerprint from certs where email not in (select email from totp) order by email, rowid"
+	if rows, err = tx.QueryContext(ctx, q); err != nil {
+		panic(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		o := &orphanedCert{}
+		if err := rows.Scan(&o.Email, &o.Fingerprint); err != nil {
+			panic(err)
+		}
+		orphans = append(orphans, o)
+	}
+	if err := rows.Err(); err != nil {
+		panic(err)
+	}
+
+	return dupes, orphans
+}
+
+// warnOfDuplicateUsers logs any duplicate users at startup, since schema migration 17 leaves them
+// as they are rather than merge them unasked
+func warnOfDuplicateUsers() {
+	TAG := "warnOfDuplicateUsers"
+	ctx := context.Background()
+
+	cxn := getDB()
+	defer cxn.Close()
+	tx, err := cxn.BeginTx(ctx, nil)
+	if err != nil {
+		panic(err)
+	}
+	defer tx.Rollback()
+	dupes, _ := findInconsistencies(ctx, tx)
+	for _, d := range dupes {
+		log.Warn(TAG, fmt.Sprintf("%d users differ only in case or whitespace and can't be reached; see GET /diagnostics/duplicates", len(d.Rows)), d.Email)
+	}
+}
+
+func duplicatesHandler(writer http.ResponseWriter, req *http.Request) {
+	// GET /diagnostics/duplicates -- scan for duplicate users and orphaned certs
+	//   I: None
+	//   O: {DuplicateUsers: [{Email: "", Rows: [{RowID: 0, Email: "", Created: "", Updated: "", Archived: ""}]}], OrphanedCerts: [{Email: "", Fingerprint: ""}]}
+	//   200: the object above, with empty lists if all is well
+	//   Users are duplicates if their emails are equal once trimmed and lowercased; Email is that
+	//   form. Each one's Rows are newest first, i.e. the first is the one POST /diagnostics/repair
+	//   keeps. Orphaned certs belong to an email with no user at all.
+	// Non-GET: 405 (method not allowed)
+
+	TAG := "/diagnostics/duplicates"
+	ctx := req.Context()
+
+	cxn := getDB()
+	defer cxn.Close()
+	tx, err := cxn.BeginTx(ctx, nil)
+	if err != nil {
+		panic(err)
+	}
+	defer tx.Rollback()
+	dupes, orphans := findInconsistencies(ctx, tx)
+
+	if len(dupes) > 0 || len(orphans) > 0 {
+		log.Warn(TAG, fmt.Sprintf("found %d duplicated users and %d orphaned certs", len(dupes), len(orphans)))
+	}
+	httputil.SendJSON(writer, http.StatusOK, &struct {
+		DuplicateUsers []*duplicateUser
+		OrphanedCerts  []*orphanedCert
+	}{dupes, orphans})
+}
+
+func repairHandler(writer http.ResponseWriter, req *http.Request) {
+	// POST /diagnostics/repair -- fix what GET /diagnostics/duplicates finds
+	//   I: None
+	//   O: {MergedUsers: 0, AdoptedCerts: 0}
+	//   200: repaired (or nothing to do); 403 (forbidden): not an admin-scoped API key
+	//   For each set of duplicate users, the most recently updated row -- and so its TOTP seed --
+	//   is kept, under the normalized email; the others are deleted, and their certs moved to the
+	//   kept user. A "user deduplicated" event is recorded for each. Orphaned certs are given
+	//   archived placeholder users with no TOTP seed, as schema migration 8 does. It all happens
+	//   in one transaction, so a failure changes nothing.
+	// Non-POST: 405 (method not allowed)
+
+	TAG := "/diagnostics/repair"
+	ctx := req.Context()
+
+	cxn := getDB()
+	defer cxn.Close()
+	tx, err := cxn.BeginTx(ctx, nil)
+	if err != nil {
+		panic(err)
+	}
+	defer tx.Rollback()
+	dupes, orphans := findInconsistencies(ctx, tx)
+
+	exec := func(q string, params ...interface{}) {
+		if _, err := tx.ExecContext(ctx, q, params...); err != nil {
+			panic(err)
+		}
+	}
+	for _, d := range dupes {
+		keep := d.Rows[0]
+		for _, r := range d.Rows[1:] {
+			exec("update certs set email=? where email=?", keep.Email, r.Email)
+			exec("update pending_certs set email=? where email=?", keep.Email, r.Email)
+			exec("delete from totp where rowid=?", r.RowID)
+		}
+		if keep.Email != d.Email { // cascades to certs and pending_certs
+			exec("update totp set email=? where rowid=?", d.Email, keep.RowID)
+		}
+		value := fmt.Sprintf("kept '%s' of %d rows", keep.Email, len(d.Rows))
+		if err := recordEventTx(tx, req, "user deduplicated", d.Email, value); err != nil {
+			panic(err)
+		}
+	}
+	exec(`insert into totp (email, seed, archived)
+	        select distinct email, '', datetime('now') from certs where email not in (select email from totp)`)
+
+	if err := tx.Commit(); err != nil {
+		panic(err)
+	}
+
+	log.Status(TAG, fmt.Sprintf("merged %d duplicated users and adopted %d orphaned certs", len(dupes), len(orphans)), requestID(req))
+	httputil.SendJSON(writer, http.StatusOK, &struct{ MergedUsers, AdoptedCerts int }{len(dupes), len(orphans)})
+}
@@ -0,0 +1,85 @@
+// Copyright © 2018 Playground Global, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// envPrefix prefixes the names of environment variables that override config file values
+const envPrefix = "HEIMDALL_"
+
+// envName converts a config field name to its environment variable, e.g. CAKeyPassword becomes
+// HEIMDALL_CA_KEY_PASSWORD and SQLiteDBFile becomes HEIMDALL_SQLITE_DB_FILE
+func envName(field string) string {
+	field = strings.Replace(field, "SQLite", "Sqlite", 1)
+	runes := []rune(field)
+	var b strings.Builder
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) {
+			prevLower := unicode.IsLower(runes[i-1])
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if prevLower || (unicode.IsUpper(runes[i-1]) && nextLower) {
+				b.WriteRune('_')
+			}
+		}
+		b.WriteRune(unicode.ToUpper(r))
+	}
+	return envPrefix + b.String()
+}
+
+// applyEnvOverrides sets config fields from their environment variables, where set. Precedence is
+// thus: built-in defaults, then the config file, then the environment. Variables that are unset
+// leave the field alone; one that is set, even to "", replaces it. Strings are taken as-is, ints
+// and bools are parsed, and anything else (e.g. TrustedProxies, APIKeys) is parsed as JSON.
+func applyEnvOverrides(cfg *serverConfig) {
+	v := reflect.ValueOf(cfg).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := envName(t.Field(i).Name)
+		raw, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+
+		field := v.Field(i)
+		switch field.Kind() {
+		case reflect.String:
+			field.SetString(raw)
+		case reflect.Int:
+			n, err := strconv.Atoi(raw)
+			if err != nil {
+				panic(fmt.Sprintf("%s: %s", name, err))
+			}
+			field.SetInt(int64(n))
+		case reflect.Bool:
+			b, err := strconv.ParseBool(raw)
+			if err != nil {
+				panic(fmt.Sprintf("%s: %s", name, err))
+			}
+			field.SetBool(b)
+		default:
+			if err := json.Unmarshal([]byte(raw), field.Addr().Interface()); err != nil {
+				panic(fmt.Sprintf("%s: %s", name, err))
+			}
+		}
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright © 2018 Playground Global, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Background pruning of the event log, per the EventRetentionDays setting, so that it doesn't grow
+// without bound.
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// eventPruneInterval is how often events are checked against EventRetentionDays; see
+// runPeriodically
+const eventPruneInterval = time.Hour
+
+// pruneEvents deletes events older than EventRetentionDays (if it's nonzero), recording a summary
+// event if any were deleted
+func pruneEvents(ctx context.Context) {
+	TAG := "pruneEvents"
+
+	days := loadSettings(ctx).EventRetentionDays
+	if days <= 0 {
+		return
+	}
+
+	cxn := getDB()
+	defer cxn.Close()
+	tx, err := cxn.BeginTx(ctx, nil)
+	if err != nil {
+		panic(err)
+	}
+	defer tx.Rollback()
+	res, err := tx.ExecContext(ctx, "delete from events where ts < datetime('now', ?)", fmt.Sprintf("-%d day", days))
+	if err != nil {
+		panic(err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		panic(err)
+	}
+	if n == 0 {
+		return
+	}
+	q := "insert into events (event, email, value) values (?, ?, ?)"
+	if _, err := tx.ExecContext(ctx, q, "events pruned", "", fmt.Sprintf("%d events older than %d days deleted", n, days)); err != nil {
+		panic(err)
+	}
+	if err := tx.Commit(); err != nil {
+		panic(err)
+	}
+	log.Status(TAG, "pruned events", n, days)
+}
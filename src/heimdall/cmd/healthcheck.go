@@ -0,0 +1,105 @@
+// Copyright © 2018 Playground Global, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Support for "heimdall -healthcheck", which lets the binary act as its own container probe by
+// calling /healthz on a running instance the same way Bifröst would, i.e. over TLS with the client
+// cert and the API secret header.
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+var healthcheckFlag = flag.Bool("healthcheck", false, "probe /healthz on the configured server and exit 0 if healthy, 1 if not")
+
+// runHealthcheck calls /healthz on the server described by cfg, returning nil if it reports healthy
+func runHealthcheck() error {
+	clientCert, err := tls.LoadX509KeyPair(cfg.SelfSignedClientCertFile, cfg.SelfSignedClientKeyFile)
+	if err != nil {
+		return err
+	}
+
+	// pin the configured server cert rather than verifying a hostname, since the bind address
+	// need not match the cert's subject
+	serverCerts, _, err := readPEMCerts(cfg.ServerCertFile)
+	if err != nil {
+		return err
+	}
+	pinned := serverCerts[0].Raw
+
+	client := &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				Certificates:       []tls.Certificate{clientCert},
+				InsecureSkipVerify: true, // replaced by the pinning check below
+				VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+					if len(rawCerts) == 0 || !bytes.Equal(rawCerts[0], pinned) {
+						return errors.New("server cert does not match ServerCertFile")
+					}
+					return nil
+				},
+			},
+		},
+	}
+
+	host := cfg.BindAddress
+	if host == "" || net.ParseIP(host).IsUnspecified() {
+		host = "127.0.0.1"
+	}
+	addr := net.JoinHostPort(host, strconv.Itoa(cfg.Port))
+	if path := unixSocketPath(); path != "" {
+		addr = "localhost" // only for the URL; the transport dials the socket
+		client.Transport.(*http.Transport).DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		}
+	}
+	req, err := http.NewRequest("GET", "https://"+addr+"/healthz", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(cfg.APIHeader, cfg.APISecret)
+
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("/healthz returned status %d", res.StatusCode)
+	}
+	return nil
+}
+
+// healthcheckAndExit runs the healthcheck and exits the process with its result
+func healthcheckAndExit() {
+	if err := runHealthcheck(); err != nil {
+		fmt.Fprintln(os.Stderr, "unhealthy:", err)
+		os.Exit(1)
+	}
+	fmt.Println("healthy")
+	os.Exit(0)
+}
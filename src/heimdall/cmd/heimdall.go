@@ -16,20 +16,38 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
 	"crypto/x509/pkix"
 	"database/sql"
 	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
 	"fmt"
 	"image/png"
+	"io"
 	"io/ioutil"
+	stdlog "log"
 	"math/big"
+	"mime"
+	"net"
 	"net/http"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"runtime/debug"
 	"sort"
 	"strconv"
 	"strings"
 	"text/template"
 	"time"
+	"unicode/utf8"
 
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/pquerna/otp/totp"
@@ -37,7 +55,6 @@ import (
 	"playground/ca"
 	"playground/config"
 	"playground/httputil"
-	"playground/log"
 )
 
 /*
@@ -48,46 +65,175 @@ type serverConfig struct {
 	Debug                    bool
 	Port                     int
 	BindAddress              string
+	AdminPort                int
+	AdminBindAddress         string
 	LogFile                  string
+	LogMaxSizeMB             int
+	LogMaxBackups            int
+	LogMaxAgeDays            int
+	LogLevels                map[string]string
+	AccessLog                bool
 	SQLiteDBFile             string
+	SQLiteReadDBFile         string
 	SelfSignedClientCertFile string
+	SelfSignedClientKeyFile  string
 	ServerCertFile           string
 	ServerKeyFile            string
 	CACertFile               string
 	CAKeyFile                string
 	CAKeyPassword            string
+	CAKeyPasswordFile        string
+	CAKeyPasswordCommand     string
+	CAChainFile              string
+	NextCACertFile           string
+	NextCAKeyFile            string
+	NextCAKeyPassword        string
+	NextCAKeyPasswordFile    string
+	NextCAKeyPasswordCommand string
+	NextCAChainFile          string
 	TLSAuthFile              string
 	OVPNTemplateFile         string
+	OVPNTemplateProfiles     map[string]string
+	SeedEncryptionKey        string
 	APIHeader                string
 	APISecret                string
+	PreviousAPISecrets       []string
+	APIKeys                  []*apiKey
+	OperatorCNs              []string
+	AllowedOrigins           []string
+	DBQueryTimeoutMs         int
+	DBBusyTimeoutMs          int
+	MaxRequestBodyBytes      int
+	MaxImportBodyBytes       int
+	TrustedProxies           []string
+	OCSPCacheTTLSeconds      int
+	CACacheMaxAgeSeconds     int
+	MinTLSVersion            string
+	CipherSuites             []string
+	IssuanceWorkers          int
+	MaxEventValueLength      int
+	SCEPChallengePassword    string
+	SCEPPort                 int
+	SCEPBindAddress          string
+	CertExtensions           []*certExtension
 }
 
 var cfg = &serverConfig{
 	false,
 	9090,
 	"127.0.0.1",
+	0,
+	"127.0.0.1",
 	"./heimdall.log",
+	100,
+	5,
+	30,
+	map[string]string{},
+	false,
 	"./heimdall.sqlite3",
+	"",
 	"./client.crt",
+	"./client.key",
 	"./server.crt",
 	"./server.key",
 	"./ca.crt",
 	"./ca.key",
 	"Sekr1tPassw0rd!",
+	"",
+	"",
+	"",
+	"",
+	"",
+	"",
+	"",
+	"",
+	"",
 	"./tls-auth.pem",
 	"./template.ovpn",
+	map[string]string{},
+	"",
 	"X-Heimdall-Secret",
 	"Sekr1tPassw0rd",
+	[]string{},
+	[]*apiKey{},
+	[]string{},
+	[]string{},
+	15000,
+	5000,
+	64 * 1024,
+	32 * 1024 * 1024,
+	[]string{},
+	300,
+	3600,
+	"1.2",
+	[]string{},
+	0,
+	1024,
+	"",
+	0,
+	"127.0.0.1",
+	[]*certExtension{},
 }
 
-func initConfig(cfg *serverConfig) {
+// ovpnTemplate is the parsed contents of OVPNTemplateFile, loaded once at startup; likewise
+// ovpnProfiles for OVPNTemplateProfiles, which maps profile names (e.g. "mobile") to template files
+// that issuance requests can choose instead
+var ovpnTemplate *template.Template
+var ovpnProfiles = map[string]*template.Template{}
+
+// loadConfig reads the config file and environment overrides into cfg, and nothing else, so that
+// it's safe for -healthcheck, which must not resolve CA key passwords or touch the log file
+func loadConfig(cfg *serverConfig) {
 	config.Load(cfg)
+	applyEnvOverrides(cfg)
+}
 
+// initConfig sets up logging and validates and applies the config that loadConfig read
+func initConfig(cfg *serverConfig) {
 	if cfg.LogFile != "" {
-		log.SetLogFile(cfg.LogFile)
+		if cfg.LogMaxSizeMB > 0 {
+			rf, err := openRotatingFile(cfg.LogFile, cfg.LogMaxSizeMB, cfg.LogMaxBackups, cfg.LogMaxAgeDays)
+			if err != nil {
+				panic(err)
+			}
+			stdlog.SetOutput(rf)
+		} else {
+			log.SetLogFile(cfg.LogFile)
+		}
 	}
 	if config.Debug || cfg.Debug {
-		log.SetLogLevel(log.LEVEL_DEBUG)
+		log.SetLogLevel(logLevelNames["debug"])
+	}
+
+	// resolve CA key passwords given by file or command before validation, which confirms that they
+	// decrypt the keys
+	validateConfigOrExit(cfg, resolveKeyPasswords(cfg)...)
+	if err := log.SetTagLevels(cfg.LogLevels); err != nil {
+		panic(err)
+	}
+	var err error
+	if certExtensions, err = parseCertExtensions(cfg.CertExtensions); err != nil {
+		panic(err) // already reported by validateConfig
+	}
+
+	// parse the .ovpn templates and do a trial run (already done by validateConfig, which is why
+	// these can only panic if a file changes in between), so that a broken template fails at
+	// startup rather than on first issuance
+	if ovpnTemplate, err = template.ParseFiles(cfg.OVPNTemplateFile); err != nil {
+		panic(err)
+	}
+	if err = trialOVPNTemplate(ovpnTemplate); err != nil {
+		panic(fmt.Sprintf("template '%s' failed trial execution: %s", cfg.OVPNTemplateFile, err))
+	}
+	for profile, file := range cfg.OVPNTemplateProfiles {
+		tmpl, err := template.ParseFiles(file)
+		if err != nil {
+			panic(err)
+		}
+		if err = trialOVPNTemplate(tmpl); err != nil {
+			panic(fmt.Sprintf("template '%s' for profile '%s' failed trial execution: %s", file, profile, err))
+		}
+		ovpnProfiles[profile] = tmpl
 	}
 }
 
@@ -95,31 +241,140 @@ func initConfig(cfg *serverConfig) {
  * Main loop which starts the HTTP server & defines handlers
  */
 func main() {
+	loadConfig(cfg)
+	if !flag.Parsed() {
+		flag.Parse()
+	}
+	if *healthcheckFlag {
+		healthcheckAndExit()
+	}
+	if flag.NArg() > 0 {
+		// admin subcommands log to stderr; opening (and size-rotating) the log file too would
+		// rename it out from under a running server
+		cfg.LogFile = ""
+	}
 	initConfig(cfg)
+	migrateDatabase()
+	warnOfDuplicateUsers()
+	encryptStoredSeeds()
+	if flag.NArg() > 0 {
+		adminCommandAndExit(flag.Args())
+	}
+	go runPeriodically("pruneEvents", eventPruneInterval, pruneEvents)
+	go runPeriodically("revokeExpiredCerts", certExpiryInterval, revokeExpiredCerts)
+	startCertJobWorkers()
+	startAdminListener()
+	startSCEPListener()
+	watchMaintenanceSignal()
 
 	server, mux := httputil.NewHardenedServer(cfg.BindAddress, cfg.Port)
 	server.RequireClientRoot(cfg.SelfSignedClientCertFile)
-	w := httputil.Wrapper().WithPanicHandler().WithSecretSentry(cfg.APIHeader, cfg.APISecret)
-	mux.HandleFunc("/users", w.WithMethodSentry("GET").Wrap(usersHandler))
-	mux.HandleFunc("/user/", w.WithMethodSentry("GET", "PUT", "DELETE").Wrap(userHandler))
-	mux.HandleFunc("/certs", w.WithMethodSentry("GET").Wrap(certsHandler))
-	mux.HandleFunc("/certs/", w.WithMethodSentry("GET", "POST").Wrap(certsHandler))
-	mux.HandleFunc("/cert/", w.WithMethodSentry("GET", "DELETE").Wrap(certHandler))
-	mux.HandleFunc("/events", w.WithMethodSentry("GET", "DELETE").Wrap(eventsHandler))
-	mux.HandleFunc("/settings", w.WithMethodSentry("GET", "PUT").Wrap(settingsHandler))
-	mux.HandleFunc("/whitelist", w.WithMethodSentry("GET").Wrap(whitelistHandler))
-	mux.HandleFunc("/whitelist/", w.WithMethodSentry("DELETE", "PUT").Wrap(whitelistHandler))
-
-	mux.HandleFunc("/", w.WithMethodSentry("GET").Wrap(func(writer http.ResponseWriter, req *http.Request) {
-		// serve a 404 to all other requests; note that "/" is effectively a wildcard
-		log.Warn("server", "incoming unknown request to '"+req.URL.Path+"'")
-		httputil.SendJSON(writer, http.StatusNotFound, struct{}{})
-	}))
+	if server.TLSConfig == nil {
+		server.TLSConfig = &tls.Config{}
+	}
+	applyTLSPolicy(server.TLSConfig)
+	// api wraps a handler in the stages common to all API endpoints; limitedAPI is the same, with a
+	// request body size limit other than the default MaxRequestBodyBytes
+	limitedAPI := func(maxBody int, handler http.HandlerFunc, methods ...string) http.HandlerFunc {
+		return withAccessLog(withRequestID(withPanicRecovery(withCORS(withMethodSentry(withAPIKey(withMaintenanceMode(withMaxBodySize(maxBody, handler))), methods...)))))
+	}
+	api := func(handler http.HandlerFunc, methods ...string) http.HandlerFunc {
+		return limitedAPI(cfg.MaxRequestBodyBytes, handler, methods...)
+	}
+	// handle registers a route, noting it for the catch-all's list of known routes
+	routes := []string{}
+	handle := func(pattern string, handler http.HandlerFunc) {
+		routes = append(routes, pattern)
+		mux.HandleFunc(pattern, handler)
+	}
 
+	handle("/users", api(withCompression(withDBDeadline(usersHandler)), "GET", "POST"))
+	handle("/user/", api(withDBDeadline(userHandler), "GET", "PUT", "POST", "DELETE"))
+	handle("/certs", api(withCompression(withDBDeadline(certsHandler)), "GET"))
+	handle("/certs/", api(withCompression(withDBDeadline(certsHandler)), "GET", "POST"))
+	handle("/certs/expiring", api(withCompression(withDBDeadline(expiringCertsHandler)), "GET"))
+	handle("/cert/", api(withDBDeadline(certHandler), "GET", "POST", "PATCH", "DELETE"))
+	handle("/cert-job/", api(certJobHandler, "GET"))
+	handle("/cert-requests", api(withDBDeadline(certRequestsHandler), "GET"))
+	handle("/cert-request/", api(withDBDeadline(certRequestHandler), "POST"))
+	handle("/crl/preview", api(withDBDeadline(crlPreviewHandler), "GET"))
+	handle("/revocations", api(withCompression(withDBDeadline(revocationsHandler)), "GET"))
+	handle("/whois/", api(withDBDeadline(whoisHandler), "GET"))
+	handle("/verify-cert", api(withDBDeadline(verifyCertHandler), "POST"))
+	handle("/events", api(withCompression(withDBDeadline(eventsHandler)), "GET", "DELETE"))
+	handle("/settings", api(withDBDeadline(settingsHandler), "GET", "PUT"))
+	handle("/settings/reset", api(withDBDeadline(resetSettingsHandler), "POST"))
+	handle("/whitelist", api(withDBDeadline(whitelistHandler), "GET", "POST"))
+	handle("/whitelist/", api(withDBDeadline(whitelistHandler), "DELETE", "PUT"))
+	handle("/whitelist/domains", api(withDBDeadline(whitelistDomainsHandler), "GET"))
+	handle("/whitelist/domains/", api(withDBDeadline(whitelistDomainsHandler), "PUT", "DELETE"))
+	handle("/stats", api(withDBDeadline(statsHandler), "GET"))
+	handle("/stats/domains", api(withDBDeadline(domainStatsHandler), "GET"))
+	handle("/healthz", api(withDBDeadline(healthzHandler), "GET"))
+	handle("/selftest", api(withAdminScope(selftestHandler), "GET"))
+	handle("/export", api(withAdminScope(withCompression(withDBDeadline(exportHandler))), "GET"))
+	handle("/import", limitedAPI(cfg.MaxImportBodyBytes, withAdminScope(withDBDeadline(importHandler)), "POST"))
+	handle("/diagnostics/duplicates", api(withDBDeadline(duplicatesHandler), "GET"))
+	handle("/diagnostics/repair", api(withAdminScope(withDBDeadline(repairHandler)), "POST"))
+	handle("/ca", api(caHandler, "GET"))
+	// not subject to maintenance mode, since it's how maintenance mode is turned off
+	handle("/maintenance", withAccessLog(withRequestID(withPanicRecovery(withCORS(withMethodSentry(withAPIKey(withMaxBodySize(cfg.MaxRequestBodyBytes, maintenanceHandler)), "GET", "PUT"))))))
+
+	// OCSP clients (and whoever's asking for /version) can't be expected to send an API key; note
+	// that the TLS-level client cert requirement still applies
+	handle("/ocsp", withAccessLog(withRequestID(withPanicRecovery(withMethodSentry(withDBDeadline(ocspHandler), "POST")))))
+	handle("/ocsp/", withAccessLog(withRequestID(withPanicRecovery(withMethodSentry(withDBDeadline(ocspHandler), "GET")))))
+	handle("/version", withAccessLog(withRequestID(withPanicRecovery(withMethodSentry(versionHandler, "GET")))))
+
+	// self-service endpoints authenticate the user by TOTP code instead of an API key
+	handle("/self/revoke", withAccessLog(withRequestID(withPanicRecovery(withMethodSentry(withMaintenanceMode(withMaxBodySize(cfg.MaxRequestBodyBytes, withDBDeadline(selfRevokeHandler))), "POST")))))
+
+	// serve a 404 to all other requests; note that "/" is effectively a wildcard
+	mux.HandleFunc("/", api(notFoundHandler(routes), "GET"))
+
+	if path := unixSocketPath(); path != "" {
+		log.Status("server.http", "starting HTTP on socket "+path)
+		log.Error("server.http", "shutting down; error?", server.ServeTLS(listenUnix(path), cfg.ServerCertFile, cfg.ServerKeyFile))
+		return
+	}
 	log.Status("server.http", "starting HTTP on port "+strconv.Itoa(cfg.Port))
 	log.Error("server.http", "shutting down; error?", server.ListenAndServeTLS(cfg.ServerCertFile, cfg.ServerKeyFile))
 }
 
+// quietNotFoundPaths are unknown paths requested routinely by browsers and crawlers, whose 404s
+// are logged only at debug level so they don't drown out requests worth a warning
+var quietNotFoundPaths = map[string]bool{
+	"/favicon.ico":          true,
+	"/robots.txt":           true,
+	"/apple-touch-icon.png": true,
+}
+
+// notFoundHandler returns the catch-all handler for paths matching none of routes
+func notFoundHandler(routes []string) http.HandlerFunc {
+	// GET <any unknown path> -- 404 for paths with no handler
+	//   I: None
+	//   O: {} normally; {Error: "", Routes: [""]} in debug mode
+	//   404: always
+	//   Routes lists the registered route patterns, sorted, as a hint during integration.
+	sorted := append([]string{}, routes...)
+	sort.Strings(sorted)
+	return func(writer http.ResponseWriter, req *http.Request) {
+		if quietNotFoundPaths[req.URL.Path] {
+			log.Debug("server", "incoming unknown request to '"+req.URL.Path+"'")
+		} else {
+			log.Warn("server", "incoming unknown request to '"+req.URL.Path+"'")
+		}
+		if config.Debug || cfg.Debug {
+			httputil.SendJSON(writer, http.StatusNotFound, struct {
+				Error  string
+				Routes []string
+			}{"no such route", sorted})
+			return
+		}
+		httputil.SendJSON(writer, http.StatusNotFound, struct{}{})
+	}
+}
+
 /*
  * Package-local utilities
  */
@@ -132,74 +387,660 @@ func extractSegment(path string, n int) string {
 	return ""
 }
 
+// revocationReasons maps the revocation reasons accepted by the API to their RFC 5280 CRLReason
+// codes, which are carried into OCSP responses. Code 7 is unused by the RFC.
+var revocationReasons = map[string]int{
+	"unspecified":            0,
+	"key-compromise":         1,
+	"ca-compromise":          2,
+	"affiliation-changed":    3,
+	"superseded":             4,
+	"cessation-of-operation": 5,
+	"certificate-hold":       6,
+	"remove-from-crl":        8,
+	"privilege-withdrawn":    9,
+	"aa-compromise":          10,
+}
+
+// normalizeEmail trims and lowercases an email address so that e.g. "User@Example.com" and
+// "user@example.com" refer to the same records. Returns an error if the result is not a bare RFC
+// 5322 address (i.e. display names and angle brackets are rejected.)
+func normalizeEmail(raw string) (string, error) {
+	email := strings.ToLower(strings.TrimSpace(raw))
+	if email == "" {
+		return "", errors.New("missing email")
+	}
+	addr, err := mail.ParseAddress(email)
+	if err != nil {
+		return "", err
+	}
+	if addr.Name != "" || addr.Address != email {
+		return "", fmt.Errorf("'%s' is not a bare email address", raw)
+	}
+	return email, nil
+}
+
+// fieldErrors maps request JSON field names to what was wrong with them. It is sent as the body of
+// a 400 response, i.e. {Errors: {Field: "problem"}}, so that callers can tell what to fix; problems
+// with the body as a whole are reported under "".
+type fieldErrors map[string]string
+
+// sendFieldErrors responds with a 400 listing errs
+func sendFieldErrors(writer http.ResponseWriter, errs fieldErrors) {
+	httputil.SendJSON(writer, http.StatusBadRequest, struct{ Errors fieldErrors }{errs})
+}
+
+// decodeStrictJSON populates dst from the request's JSON body. Unlike httputil.PopulateFromBody,
+// fields that dst does not have, mistyped values, and trailing data are all rejected. Returns nil
+// on success.
+func decodeStrictJSON(dst interface{}, req *http.Request) fieldErrors {
+	if req.Body == nil {
+		return fieldErrors{"": "empty request body"}
+	}
+	dec := json.NewDecoder(req.Body)
+	dec.DisallowUnknownFields()
+	err := dec.Decode(dst)
+	if err == nil && dec.More() {
+		err = errors.New("unexpected data after JSON object")
+	}
+
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case err == nil:
+		return nil
+	case err == io.EOF:
+		return fieldErrors{"": "empty request body"}
+	case errors.As(err, &typeErr):
+		return fieldErrors{typeErr.Field: fmt.Sprintf("expected %s, got %s", typeErr.Type, typeErr.Value)}
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		field, _ := strconv.Unquote(strings.TrimPrefix(err.Error(), "json: unknown field "))
+		return fieldErrors{field: "unknown field"}
+	default:
+		return fieldErrors{"": err.Error()}
+	}
+}
+
+// requestIDKey is the request context key under which withRequestID records the request's ID
+type requestIDKey struct{}
+
+// validRequestID matches inbound X-Request-ID values we're willing to adopt (and log)
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// withRequestID wraps a handler such that each request has an ID, for correlating log lines and
+// events with one another. An inbound X-Request-ID (e.g. from Bifröst or a proxy) is honored if
+// it's sane; otherwise a random one is generated. Either way it's echoed in the response's
+// X-Request-ID header, and handlers can fetch it with requestID(req).
+func withRequestID(handler http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, req *http.Request) {
+		id := req.Header.Get("X-Request-ID")
+		if !validRequestID.MatchString(id) {
+			buf := make([]byte, 8)
+			if _, err := rand.Read(buf); err != nil {
+				panic(err)
+			}
+			id = hex.EncodeToString(buf)
+		}
+		writer.Header().Set("X-Request-ID", id)
+		handler(writer, req.WithContext(context.WithValue(req.Context(), requestIDKey{}, id)))
+	}
+}
+
+// requestID returns the ID withRequestID assigned to req, or "" if there is none
+func requestID(req *http.Request) string {
+	id, _ := req.Context().Value(requestIDKey{}).(string)
+	return id
+}
+
+// withPanicRecovery wraps a handler (itself wrapped by withRequestID) such that a panic -- which is
+// how handlers report e.g. database errors -- is logged in full, with its stack and request ID, and
+// answered with a 500 (internal server error) and body {Error: "internal"}. The panic value itself
+// can contain SQL or file paths, so it's only included in the response (as Detail) in Debug mode.
+func withPanicRecovery(handler http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, req *http.Request) {
+		defer func() {
+			r := recover()
+			if r == nil {
+				return
+			}
+			if r == http.ErrAbortHandler { // deliberate; let net/http handle it
+				panic(r)
+			}
+			log.Error("withPanicRecovery", "panic handling request", requestID(req), req.Method, req.URL.Path, r, string(debug.Stack()))
+			res := struct {
+				Error  string
+				Detail string `json:",omitempty"`
+			}{Error: "internal"}
+			if cfg.Debug {
+				res.Detail = fmt.Sprint(r)
+			}
+			httputil.SendJSON(writer, http.StatusInternalServerError, &res)
+		}()
+		handler(writer, req)
+	}
+}
+
+// validHeaderName matches the RFC 7230 tokens allowed as HTTP header names
+var validHeaderName = regexp.MustCompile("^[!#$%&'*+.^_`|~0-9A-Za-z-]+$")
+
+// apiKey is an additional credential for API clients. Scope "admin" grants full access, as does
+// APISecret; scope "read" permits only GET requests, e.g. for monitoring.
+type apiKey struct {
+	Name, Key, Scope string
+}
+
+// withAPIKey wraps a handler such that requests must carry APISecret (or, during a rotation, one of
+// PreviousAPISecrets) or one of APIKeys in the APIHeader header. Unknown keys get a 401
+// (unauthorized), and read-scoped keys get a 403 (forbidden) for anything but GET. If OperatorCNs
+// is set, the client cert must also be one of those operators', else a 403; so a leaked secret
+// alone isn't enough.
+func withAPIKey(handler http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, req *http.Request) {
+		TAG := "withAPIKey"
+
+		if op := operator(req); len(cfg.OperatorCNs) > 0 && !isOperator(op) {
+			log.Warn(TAG, "request from client cert not in OperatorCNs", op, req.Method, req.URL.Path)
+			httputil.SendJSON(writer, http.StatusForbidden, struct{}{})
+			return
+		}
+
+		presented := []byte(req.Header.Get(cfg.APIHeader))
+
+		// every secret is compared, so that timing doesn't reveal which (if any) matched; blank
+		// entries in PreviousAPISecrets are ignored
+		scope, matched := "", -1
+		for i, secret := range append([]string{cfg.APISecret}, cfg.PreviousAPISecrets...) {
+			if (i == 0 || secret != "") && subtle.ConstantTimeCompare(presented, []byte(secret)) == 1 {
+				matched = i
+			}
+		}
+		if matched > 0 {
+			// i.e. a client not yet updated; once these stop, the previous secret can be dropped
+			log.Warn(TAG, "request with previous API secret", matched, operator(req), req.Method, req.URL.Path)
+		}
+		if matched >= 0 {
+			scope = "admin"
+		} else {
+			for _, k := range cfg.APIKeys {
+				if subtle.ConstantTimeCompare(presented, []byte(k.Key)) == 1 {
+					scope = k.Scope
+					break
+				}
+			}
+		}
+
+		switch {
+		case scope == "":
+			log.Warn(TAG, "request with unknown API key", req.Method, req.URL.Path)
+			httputil.SendJSON(writer, http.StatusUnauthorized, struct{}{})
+		case scope == "read" && req.Method != "GET":
+			log.Warn(TAG, "read-only API key used for write", req.Method, req.URL.Path)
+			httputil.SendJSON(writer, http.StatusForbidden, struct{}{})
+		default:
+			handler(writer, req.WithContext(context.WithValue(req.Context(), apiScopeKey{}, scope)))
+		}
+	}
+}
+
+// operator returns the common name of the client cert req was made with, which identifies the
+// operator (or service, e.g. Bifröst) responsible for it; "" if there is none
+func operator(req *http.Request) string {
+	if req.TLS == nil || len(req.TLS.PeerCertificates) == 0 {
+		return ""
+	}
+	return req.TLS.PeerCertificates[0].Subject.CommonName
+}
+
+func isOperator(cn string) bool {
+	for _, op := range cfg.OperatorCNs {
+		if cn != "" && cn == op {
+			return true
+		}
+	}
+	return false
+}
+
+// apiScopeKey is the request context key under which withAPIKey records the caller's key scope
+type apiScopeKey struct{}
+
+// withAdminScope wraps a handler (itself wrapped by withAPIKey) such that only admin-scoped keys
+// may call it, regardless of method; for endpoints such as /export that read sensitive data
+func withAdminScope(handler http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, req *http.Request) {
+		if scope, _ := req.Context().Value(apiScopeKey{}).(string); scope != "admin" {
+			log.Warn("withAdminScope", "non-admin API key used for admin endpoint", req.Method, req.URL.Path)
+			httputil.SendJSON(writer, http.StatusForbidden, struct{}{})
+			return
+		}
+		handler(writer, req)
+	}
+}
+
+// withMaxBodySize wraps a handler such that request bodies larger than maxBytes are refused with a
+// 413 (request entity too large) before the handler sees them. Bodies within the limit are read
+// up front, which is fine since they're small JSON documents.
+func withMaxBodySize(maxBytes int, handler http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, req *http.Request) {
+		TAG := "withMaxBodySize"
+		if req.Body == nil || req.ContentLength == 0 {
+			handler(writer, req)
+			return
+		}
+		if req.ContentLength > int64(maxBytes) {
+			log.Warn(TAG, "request body too large", req.Method, req.URL.Path, req.ContentLength)
+			httputil.SendJSON(writer, http.StatusRequestEntityTooLarge, struct{}{})
+			return
+		}
+		body, err := ioutil.ReadAll(io.LimitReader(req.Body, int64(maxBytes)+1))
+		req.Body.Close()
+		if err != nil {
+			log.Warn(TAG, "error reading request body", req.Method, req.URL.Path, err)
+			httputil.SendJSON(writer, http.StatusBadRequest, struct{}{})
+			return
+		}
+		if len(body) > maxBytes { // i.e. chunked, with no Content-Length to check up front
+			log.Warn(TAG, "request body too large", req.Method, req.URL.Path, len(body))
+			httputil.SendJSON(writer, http.StatusRequestEntityTooLarge, struct{}{})
+			return
+		}
+		if cfg.Debug {
+			log.Debug(TAG, "request body", req.Method, req.URL.Path, redactedBody(body))
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		handler(writer, req)
+	}
+}
+
+// withMethodSentry wraps a handler such that only the given methods reach it. Others get a 405
+// (method not allowed), with the permitted methods in the Allow header and in the body, as
+// {Error: "method not allowed", Allow: ["GET", ...]}.
+func withMethodSentry(handler http.HandlerFunc, methods ...string) http.HandlerFunc {
+	allow := strings.Join(methods, ", ")
+	return func(writer http.ResponseWriter, req *http.Request) {
+		for _, m := range methods {
+			if req.Method == m {
+				handler(writer, req)
+				return
+			}
+		}
+		log.Warn("withMethodSentry", "disallowed method", req.Method, req.URL.Path)
+		writer.Header().Set("Allow", allow)
+		httputil.SendJSON(writer, http.StatusMethodNotAllowed, &struct {
+			Error string
+			Allow []string
+		}{"method not allowed", methods})
+	}
+}
+
+// withCORS wraps a handler such that browsers on one of AllowedOrigins may call it. Such origins
+// are echoed back in Access-Control-Allow-Origin, and OPTIONS preflight requests from them are
+// answered here, since they carry no API key and would otherwise be refused. Requests from other
+// origins get no CORS headers at all (and preflights a 403), so the browser blocks them.
+func withCORS(handler http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, req *http.Request) {
+		origin := req.Header.Get("Origin")
+		if origin == "" {
+			handler(writer, req)
+			return
+		}
+		writer.Header().Add("Vary", "Origin")
+
+		allowed := false
+		for _, o := range cfg.AllowedOrigins {
+			if o == origin {
+				allowed = true
+				break
+			}
+		}
+		preflight := req.Method == "OPTIONS" && req.Header.Get("Access-Control-Request-Method") != ""
+
+		switch {
+		case preflight && !allowed:
+			log.Warn("withCORS", "preflight from disallowed origin", origin, req.URL.Path)
+			writer.WriteHeader(http.StatusForbidden)
+		case preflight:
+			writer.Header().Set("Access-Control-Allow-Origin", origin)
+			writer.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE")
+			writer.Header().Set("Access-Control-Allow-Headers", cfg.APIHeader+", Content-Type, Idempotency-Key, X-Request-ID")
+			writer.Header().Set("Access-Control-Max-Age", "600")
+			writer.WriteHeader(http.StatusNoContent)
+		case allowed:
+			writer.Header().Set("Access-Control-Allow-Origin", origin)
+			writer.Header().Set("Access-Control-Expose-Headers", "X-Gen-Time-Ms, X-Request-ID")
+			handler(writer, req)
+		default:
+			handler(writer, req)
+		}
+	}
+}
+
+// withDBDeadline wraps a handler such that the request's context (which handlers pass to all
+// database calls) is cancelled after the configured deadline. A wedged SQLite lock thus results in
+// a 503 (service unavailable) rather than a handler that hangs forever. Note that the deadline
+// covers the whole request, including key generation on issuance, so it shouldn't be set too low;
+// writes that follow key generation are made in one transaction, so that running out then leaves
+// nothing half-recorded.
+func withDBDeadline(handler http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, req *http.Request) {
+		ctx, cancel := context.WithTimeout(req.Context(), time.Duration(cfg.DBQueryTimeoutMs)*time.Millisecond)
+		defer cancel()
+
+		defer func() {
+			if r := recover(); r != nil {
+				switch ctx.Err() {
+				case context.DeadlineExceeded:
+					log.Error("withDBDeadline", "database deadline exceeded", requestID(req), req.URL.Path, r)
+					httputil.SendJSON(writer, http.StatusServiceUnavailable, struct{}{})
+				case context.Canceled:
+					log.Warn("withDBDeadline", "request cancelled by client", requestID(req), req.URL.Path, r)
+				default:
+					panic(r)
+				}
+			}
+		}()
+
+		handler(writer, req.WithContext(ctx))
+	}
+}
+
 // Database access helpers
+// getDB opens the database. Every connection is set up (via go-sqlite3's DSN parameters, since
+// PRAGMAs only apply to the connection that runs them) with WAL journaling so that readers don't
+// block on a writer, a busy timeout so that contending writers wait rather than fail with
+// "database is locked", and foreign key enforcement.
 func getDB() *sql.DB {
-	cxn, err := sql.Open("sqlite3", cfg.SQLiteDBFile)
+	dsn := fmt.Sprintf("file:%s?_journal_mode=WAL&_busy_timeout=%d&_foreign_keys=on", cfg.SQLiteDBFile, cfg.DBBusyTimeoutMs)
+	cxn, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		panic(err)
+	}
+	return cxn
+}
+
+// getReadDB opens a read-only connection for the reporting queries behind GET endpoints (cert and
+// user listings, events, stats), so that they don't contend with issuance and revocation writes.
+// It reads SQLiteReadDBFile if set (e.g. a replica kept current by some external tool), or else
+// SQLiteDBFile. Handlers that write, or whose reads must see their own writes, use getDB.
+func getReadDB() *sql.DB {
+	file := cfg.SQLiteReadDBFile
+	if file == "" {
+		file = cfg.SQLiteDBFile
+	}
+	dsn := fmt.Sprintf("file:%s?mode=ro&_busy_timeout=%d", file, cfg.DBBusyTimeoutMs)
+	cxn, err := sql.Open("sqlite3", dsn)
 	if err != nil {
 		panic(err)
 	}
 	return cxn
 }
 
-func writeDatabaseByQuery(query string, params ...interface{}) {
+func writeDatabaseByQuery(ctx context.Context, query string, params ...interface{}) {
 	cxn := getDB()
 	defer cxn.Close()
 
-	_, err := cxn.Exec(query, params...)
+	_, err := cxn.ExecContext(ctx, query, params...)
 	if err != nil {
 		panic(err)
 	}
 }
 
-// function & type to load settings from DB (generally needed fresh for each request, so not
-// cacheable)
+// clientAddress returns the IP address of the client making a request. X-Forwarded-For is honored
+// only when the directly-connected peer is one of the configured TrustedProxies, in which case the
+// rightmost entry (i.e. the one appended by that proxy) is used.
+func clientAddress(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	for _, proxy := range cfg.TrustedProxies {
+		if proxy != host {
+			continue
+		}
+		if fwd := req.Header.Get("X-Forwarded-For"); fwd != "" {
+			chunks := strings.Split(fwd, ",")
+			return strings.TrimSpace(chunks[len(chunks)-1])
+		}
+		break
+	}
+	return host
+}
+
+const recordEventQuery = "insert into events (event, email, value, source_ip, user_agent, request_id, operator) values (?, ?, ?, ?, ?, ?, ?)"
+
+// minEventValueLength is the smallest nonzero MaxEventValueLength accepted, so that a truncated
+// value keeps at least some of its text
+const minEventValueLength = 16
+
+// eventValueEllipsis marks a truncated event value
+const eventValueEllipsis = "…"
+
+// truncateEventValue shortens value to at most max bytes (0 is unlimited), ending it with an
+// ellipsis if anything was cut. The cut is made at a rune boundary, so that a multi-byte UTF-8
+// character is dropped whole rather than split into invalid bytes.
+func truncateEventValue(value string, max int) string {
+	if max <= 0 || len(value) <= max {
+		return value
+	}
+	cut := max - len(eventValueEllipsis)
+	for cut > 0 && !utf8.RuneStart(value[cut]) {
+		cut--
+	}
+	return value[:cut] + eventValueEllipsis
+}
+
+// recordEvent writes an entry to the audit log, noting the address, user agent, and operator of
+// the client responsible for it. The value is truncated to MaxEventValueLength.
+func recordEvent(req *http.Request, event, email, value string) {
+	value = truncateEventValue(value, cfg.MaxEventValueLength)
+	writeDatabaseByQuery(req.Context(), recordEventQuery, event, email, value, clientAddress(req), req.UserAgent(), requestID(req), operator(req))
+}
+
+// recordEventTx is recordEvent, as part of the transaction tx
+func recordEventTx(tx *sql.Tx, req *http.Request, event, email, value string) error {
+	value = truncateEventValue(value, cfg.MaxEventValueLength)
+	_, err := tx.ExecContext(req.Context(), recordEventQuery, event, email, value, clientAddress(req), req.UserAgent(), requestID(req), operator(req))
+	return err
+}
+
+// function & type to load settings from DB; see loadSettings for the cached version that handlers
+// should use
 type settings struct {
 	ServiceName                     string
 	ClientLimit, IssuedCertDuration int
+	IssuedCertKeyBits               int
+	SigningCA                       string
+	ExpiringSoonDays                int
+	UniqueDescriptions              bool
+	CertBackdateMinutes             int
+	EventRetentionDays              int
+	OrgUnit, Country, Locality      string
+	RequireApproval                 bool
+	AllowSeedExport                 bool
+	SerialMode                      string
+	GlobalCertLimit                 int
+	IssuanceCooldownCerts           int
+	IssuanceCooldownMinutes         int
+	RequireDescription              bool
+	DefaultCertDescription          string
+	MinDescriptionLength            int
+	RevokeExpiredCerts              bool
+	DomainProfiles                  map[string]string
+	TemplateExtra                   map[string]string
 	WhitelistedDomains              []string
 	WhitelistedUsers                []string `json:",omitEmpty"`
 }
 
-func loadSettings() *settings {
+// defaultSettings returns the built-in settings, i.e. what's in effect for keys not in the database
+func defaultSettings() *settings {
+	return &settings{
+		ServiceName:             "Bifröst VPN",
+		ClientLimit:             2,
+		IssuedCertDuration:      90,
+		IssuedCertKeyBits:       4096,
+		SigningCA:               "current",
+		ExpiringSoonDays:        30,
+		SerialMode:              "random",
+		IssuanceCooldownMinutes: 60,
+		RequireDescription:      true,
+		DefaultCertDescription:  "{email} - {date}",
+		MinDescriptionLength:    1,
+		DomainProfiles:          map[string]string{},
+		TemplateExtra:           map[string]string{},
+		WhitelistedDomains:      []string{},
+		WhitelistedUsers:        []string{},
+	}
+}
+
+// errUnknownSetting is returned by parseSetting for keys that aren't settings, e.g. ones left by
+// older versions, which readSettings ignores
+var errUnknownSetting = errors.New("unknown setting")
+
+// parseSetting sets the field of s named by k from v, a value as stored in the settings table
+func parseSetting(s *settings, k, v string) error {
+	switch k {
+	case "ServiceName":
+		s.ServiceName = v
+	case "ClientLimit":
+		if tmp, err := strconv.ParseInt(v, 10, 32); err == nil {
+			s.ClientLimit = int(tmp)
+		} else {
+			return err
+		}
+	case "IssuedCertDuration":
+		if tmp, err := strconv.ParseInt(v, 10, 32); err == nil {
+			s.IssuedCertDuration = int(tmp)
+		} else {
+			return err
+		}
+	case "IssuedCertKeyBits":
+		if tmp, err := strconv.ParseInt(v, 10, 32); err == nil {
+			s.IssuedCertKeyBits = int(tmp)
+		} else {
+			return err
+		}
+	case "SigningCA":
+		s.SigningCA = v
+	case "ExpiringSoonDays":
+		if tmp, err := strconv.ParseInt(v, 10, 32); err == nil {
+			s.ExpiringSoonDays = int(tmp)
+		} else {
+			return err
+		}
+	case "UniqueDescriptions":
+		if tmp, err := strconv.ParseBool(v); err == nil {
+			s.UniqueDescriptions = tmp
+		} else {
+			return err
+		}
+	case "CertBackdateMinutes":
+		if tmp, err := strconv.ParseInt(v, 10, 32); err == nil {
+			s.CertBackdateMinutes = int(tmp)
+		} else {
+			return err
+		}
+	case "EventRetentionDays":
+		if tmp, err := strconv.ParseInt(v, 10, 32); err == nil {
+			s.EventRetentionDays = int(tmp)
+		} else {
+			return err
+		}
+	case "OrgUnit":
+		s.OrgUnit = v
+	case "Country":
+		s.Country = v
+	case "Locality":
+		s.Locality = v
+	case "RequireApproval":
+		if tmp, err := strconv.ParseBool(v); err == nil {
+			s.RequireApproval = tmp
+		} else {
+			return err
+		}
+	case "AllowSeedExport":
+		if tmp, err := strconv.ParseBool(v); err == nil {
+			s.AllowSeedExport = tmp
+		} else {
+			return err
+		}
+	case "SerialMode":
+		s.SerialMode = v
+	case "GlobalCertLimit":
+		if tmp, err := strconv.ParseInt(v, 10, 32); err == nil {
+			s.GlobalCertLimit = int(tmp)
+		} else {
+			return err
+		}
+	case "IssuanceCooldownCerts":
+		if tmp, err := strconv.ParseInt(v, 10, 32); err == nil {
+			s.IssuanceCooldownCerts = int(tmp)
+		} else {
+			return err
+		}
+	case "IssuanceCooldownMinutes":
+		if tmp, err := strconv.ParseInt(v, 10, 32); err == nil {
+			s.IssuanceCooldownMinutes = int(tmp)
+		} else {
+			return err
+		}
+	case "RequireDescription":
+		if tmp, err := strconv.ParseBool(v); err == nil {
+			s.RequireDescription = tmp
+		} else {
+			return err
+		}
+	case "DefaultCertDescription":
+		s.DefaultCertDescription = v
+	case "RevokeExpiredCerts":
+		if tmp, err := strconv.ParseBool(v); err == nil {
+			s.RevokeExpiredCerts = tmp
+		} else {
+			return err
+		}
+	case "MinDescriptionLength":
+		if tmp, err := strconv.ParseInt(v, 10, 32); err == nil {
+			s.MinDescriptionLength = int(tmp)
+		} else {
+			return err
+		}
+	case "DomainProfiles":
+		if err := json.Unmarshal([]byte(v), &s.DomainProfiles); err != nil {
+			return err
+		}
+	case "TemplateExtra":
+		if err := json.Unmarshal([]byte(v), &s.TemplateExtra); err != nil {
+			return err
+		}
+	case "WhitelistedDomains":
+		for _, d := range strings.Split(v, " ") {
+			if d != "" {
+				s.WhitelistedDomains = append(s.WhitelistedDomains, d)
+			}
+		}
+		sort.Strings(s.WhitelistedDomains)
+	default:
+		return errUnknownSetting
+	}
+	return nil
+}
+
+func readSettings(ctx context.Context) *settings {
 	cxn := getDB()
 	defer cxn.Close()
 
-	ret := &settings{"Bifröst VPN", 2, 90, []string{}, []string{}}
+	ret := defaultSettings()
 
-	if rows, err := cxn.Query("select key, value from settings"); err != nil {
+	if rows, err := cxn.QueryContext(ctx, "select key, value from settings"); err != nil {
 		panic(err)
 	} else {
 		defer rows.Close()
 		var k, v string
 		for rows.Next() {
 			rows.Scan(&k, &v)
-			switch k {
-			case "ServiceName":
-				ret.ServiceName = v
-			case "ClientLimit":
-				if tmp, err := strconv.ParseInt(v, 10, 32); err == nil {
-					ret.ClientLimit = int(tmp)
-				} else {
-					panic(err)
-				}
-			case "IssuedCertDuration":
-				if tmp, err := strconv.ParseInt(v, 10, 32); err == nil {
-					ret.IssuedCertDuration = int(tmp)
-				} else {
-					panic(err)
-				}
-			case "WhitelistedDomains":
-				for _, d := range strings.Split(v, " ") {
-					if d != "" {
-						ret.WhitelistedDomains = append(ret.WhitelistedDomains, d)
-					}
-				}
-				sort.Strings(ret.WhitelistedDomains)
-			default:
+			if err := parseSetting(ret, k, v); err != nil && err != errUnknownSetting {
+				panic(err)
 			}
 		}
 	}
-	if rows, err := cxn.Query("select email from whitelist order by email"); err != nil {
+	if rows, err := cxn.QueryContext(ctx, "select email from whitelist order by email"); err != nil {
 		panic(err)
 	} else {
 		defer rows.Close()
@@ -214,54 +1055,323 @@ func loadSettings() *settings {
 	return ret
 }
 
-func storeSettings(s *settings) {
-	writeDatabaseByQuery("insert or replace into settings (key, value) values (?, ?)", "ServiceName", s.ServiceName)
-	writeDatabaseByQuery("insert or replace into settings (key, value) values (?, ?)", "IssuedCertDuration", s.IssuedCertDuration)
-	writeDatabaseByQuery("insert or replace into settings (key, value) values (?, ?)", "ClientLimit", s.ClientLimit)
-	writeDatabaseByQuery("insert or replace into settings (key, value) values (?, ?)", "WhitelistedDomains", strings.Join(s.WhitelistedDomains, " "))
-}
+// minCertDuration and maxCertDuration bound the IssuedCertDuration setting, in days
+const minCertDuration = 1
+const maxCertDuration = 3650
 
-// makeCertSerial generates a random string suitable for use as the serial number string in a
-// certificate. Note that this is random so collisions can technically occur; however the
-// infrastructure uses (or is assumed to use) fingerprints for things like revocations, rather than
-// serial numbers
-func makeCertSerial() string {
-	ceiling := new(big.Int).Lsh(big.NewInt(1), 128)
-	newSerial, err := rand.Int(rand.Reader, ceiling)
+// settingRows returns s as the key/value rows stored in the settings table
+func settingRows(s *settings) [][2]string {
+	profiles, err := json.Marshal(s.DomainProfiles)
 	if err != nil {
 		panic(err)
 	}
-	return fmt.Sprintf("%x", newSerial)
+	extra, err := json.Marshal(s.TemplateExtra)
+	if err != nil {
+		panic(err)
+	}
+	return [][2]string{
+		{"ServiceName", s.ServiceName},
+		{"IssuedCertDuration", strconv.Itoa(s.IssuedCertDuration)},
+		{"ClientLimit", strconv.Itoa(s.ClientLimit)},
+		{"IssuedCertKeyBits", strconv.Itoa(s.IssuedCertKeyBits)},
+		{"SigningCA", s.SigningCA},
+		{"ExpiringSoonDays", strconv.Itoa(s.ExpiringSoonDays)},
+		{"UniqueDescriptions", strconv.FormatBool(s.UniqueDescriptions)},
+		{"CertBackdateMinutes", strconv.Itoa(s.CertBackdateMinutes)},
+		{"EventRetentionDays", strconv.Itoa(s.EventRetentionDays)},
+		{"OrgUnit", s.OrgUnit},
+		{"Country", s.Country},
+		{"Locality", s.Locality},
+		{"RequireApproval", strconv.FormatBool(s.RequireApproval)},
+		{"AllowSeedExport", strconv.FormatBool(s.AllowSeedExport)},
+		{"SerialMode", s.SerialMode},
+		{"GlobalCertLimit", strconv.Itoa(s.GlobalCertLimit)},
+		{"IssuanceCooldownCerts", strconv.Itoa(s.IssuanceCooldownCerts)},
+		{"IssuanceCooldownMinutes", strconv.Itoa(s.IssuanceCooldownMinutes)},
+		{"RequireDescription", strconv.FormatBool(s.RequireDescription)},
+		{"DefaultCertDescription", s.DefaultCertDescription},
+		{"MinDescriptionLength", strconv.Itoa(s.MinDescriptionLength)},
+		{"RevokeExpiredCerts", strconv.FormatBool(s.RevokeExpiredCerts)},
+		{"DomainProfiles", string(profiles)},
+		{"TemplateExtra", string(extra)},
+		{"WhitelistedDomains", strings.Join(s.WhitelistedDomains, " ")},
+	}
 }
 
-/*
- * API endpoint handlers
- */
+// storeSettings writes s to the database; it must already have been validated (see
+// validateSettings), and panics if some value would produce broken certs
+func storeSettings(ctx context.Context, s *settings) {
+	if s.IssuedCertDuration < minCertDuration || s.IssuedCertDuration > maxCertDuration {
+		panic(fmt.Sprintf("IssuedCertDuration %d out of range", s.IssuedCertDuration))
+	}
+	for _, row := range settingRows(s) {
+		writeDatabaseByQuery(ctx, "insert or replace into settings (key, value) values (?, ?)", row[0], row[1])
+	}
+	invalidateSettings()
+}
 
-func usersHandler(writer http.ResponseWriter, req *http.Request) {
-	// GET /users -- fetch all known users
-	//   I: None
-	//   O: {Users: [{Email: "", ActiveCerts: 0, RevokedCerts: 0}]}
-	//	 200: results
-	// Non-GET: 405 (method not allowed)
+// ovpnTemplateData is what's available to the .ovpn template. CA, Cert, Key, and TLSAuth are the
+// original fields; Extra holds arbitrary operator-defined values from the TemplateExtra setting,
+// referenced in the template as e.g. {{index .Extra "RemoteHost"}}.
+type ovpnTemplateData struct {
+	CA, Cert, Key, TLSAuth                   string
+	ServiceName, Email, Expires, Fingerprint string
+	Extra                                    map[string]string
+}
 
-	type user struct {
-		Email        string
-		ActiveCerts  int
-		RevokedCerts int
+// trialOVPNTemplate renders tmpl with placeholder keymatter, and validates the result
+func trialOVPNTemplate(tmpl *template.Template) error {
+	var buf bytes.Buffer
+	data := &ovpnTemplateData{CA: "CA", Cert: "CERT", Key: "KEY", TLSAuth: "TLSAUTH", Extra: map[string]string{}}
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return err
 	}
-	users := []user{}
+	return validateOVPN(buf.Bytes())
+}
 
-	q := "select t.email, count(distinct c.fingerprint), count(distinct c2.fingerprint) from totp as t left join certs as c on t.email=c.email and c.revoked is null left join certs as c2 on t.email=c2.email and c2.revoked is not null group by t.email"
-	cxn := getDB()
-	defer cxn.Close()
-	if rows, err := cxn.Query(q); err != nil {
-		panic(err)
+// ovpnInlineBlocks are the inline-file blocks every rendered .ovpn must carry, non-empty
+var ovpnInlineBlocks = []string{"ca", "cert", "key", "tls-auth"}
+
+// validateOVPN checks that a rendered .ovpn has each of ovpnInlineBlocks, e.g. "<ca>...</ca>", with
+// something in it; a template missing one would produce a profile that fails only at connect time
+func validateOVPN(ovpn []byte) error {
+	text := string(ovpn)
+	for _, block := range ovpnInlineBlocks {
+		openTag, closeTag := "<"+block+">", "</"+block+">"
+		start := strings.Index(text, openTag)
+		if start < 0 {
+			return fmt.Errorf("missing %s block", openTag)
+		}
+		end := strings.Index(text[start:], closeTag)
+		if end < 0 {
+			return fmt.Errorf("unterminated %s block", openTag)
+		}
+		if strings.TrimSpace(text[start+len(openTag):start+end]) == "" {
+			return fmt.Errorf("empty %s block", openTag)
+		}
+	}
+	return nil
+}
+
+// validKeyBits lists the RSA key sizes permitted for issued client certs. Larger keys take
+// noticeably longer to generate (seconds, for 4096 bits) which stalls the issuing request.
+var validKeyBits = []int{2048, 3072, 4096}
+
+func isValidKeyBits(bits int) bool {
+	for _, b := range validKeyBits {
+		if bits == b {
+			return true
+		}
+	}
+	return false
+}
+
+// validCountry matches an ISO 3166-1 alpha-2 country code, as required in X.509 subjects
+var validCountry = regexp.MustCompile(`^[A-Z]{2}$`)
+
+// validDomain matches a bare DNS hostname, e.g. "example.com": dot-separated labels of letters,
+// digits, and inner hyphens. Notably it rejects spaces, which would corrupt the space-separated
+// WhitelistedDomains setting, and schemes/paths like "http://example.com/".
+var validDomain = regexp.MustCompile(`^([a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?\.)*[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// normalizeDomains trims, lowercases, and de-duplicates domains, dropping blank entries. Entries
+// that still aren't valid hostnames are returned in bad, as given.
+func normalizeDomains(domains []string) (ret, bad []string) {
+	ret = []string{}
+	seen := make(map[string]bool)
+	for _, raw := range domains {
+		d := strings.ToLower(strings.TrimSpace(raw))
+		if d == "" || seen[d] {
+			continue
+		}
+		if len(d) > 253 || !validDomain.MatchString(d) {
+			bad = append(bad, strconv.Quote(raw))
+			continue
+		}
+		seen[d] = true
+		ret = append(ret, d)
+	}
+	sort.Strings(ret)
+	return ret, bad
+}
+
+// normalizeDomainProfiles trims and lowercases the domains in a DomainProfiles setting, returning
+// separately (quoted, for error messages) those that aren't valid domain names or whose profiles
+// aren't configured in OVPNTemplateProfiles
+func normalizeDomainProfiles(profiles map[string]string) (ret map[string]string, bad []string) {
+	ret = map[string]string{}
+	for raw, profile := range profiles {
+		d := strings.ToLower(strings.TrimSpace(raw))
+		if profile == "" { // i.e. remove the domain, since JSON objects merge into the current map
+			continue
+		}
+		if len(d) > 253 || !validDomain.MatchString(d) || ovpnProfiles[profile] == nil {
+			bad = append(bad, strconv.Quote(raw))
+			continue
+		}
+		ret[d] = profile
+	}
+	sort.Strings(bad)
+	return ret, bad
+}
+
+// loadAuthority loads the CA signing cert & key from the files indicated in the config
+func loadAuthority() *ca.Authority {
+	authority := &ca.Authority{}
+	if err := authority.LoadFromPEM(cfg.CACertFile, cfg.CAKeyFile, cfg.CAKeyPassword); err != nil {
+		panic(err)
+	}
+	return authority
+}
+
+// loadNextAuthority loads the "next" CA being rotated to, if one is configured; returns nil if not.
+// During a rotation both CAs are trusted, but only the one indicated by the SigningCA setting
+// issues new certs.
+func loadNextAuthority() *ca.Authority {
+	if cfg.NextCACertFile == "" {
+		return nil
+	}
+	authority := &ca.Authority{}
+	if err := authority.LoadFromPEM(cfg.NextCACertFile, cfg.NextCAKeyFile, cfg.NextCAKeyPassword); err != nil {
+		panic(err)
+	}
+	return authority
+}
+
+// exportCertChain returns an authority's PEM cert followed by the contents of chainFile (if any),
+// i.e. the signing CA first and the root last
+func exportCertChain(authority *ca.Authority, chainFile string) []byte {
+	chain := append([]byte{}, authority.ExportCertChain()...)
+	if chainFile != "" {
+		_, raw, err := readPEMCerts(chainFile)
+		if err != nil {
+			panic(err)
+		}
+		if len(chain) > 0 && chain[len(chain)-1] != '\n' {
+			chain = append(chain, '\n')
+		}
+		chain = append(chain, raw...)
+	}
+	return chain
+}
+
+// exportTrustedCertChains returns the PEM cert chains of all currently-trusted CAs: the current CA
+// and, during a rotation, the next CA. Certs issued by either will verify against the result.
+func exportTrustedCertChains() []byte {
+	chains := exportCertChain(loadAuthority(), cfg.CAChainFile)
+	if next := loadNextAuthority(); next != nil {
+		chains = append(chains, exportCertChain(next, cfg.NextCAChainFile)...)
+	}
+	return chains
+}
+
+// makeCertSerial generates a random string suitable for use as the serial number string in a
+// certificate. Note that this is random so collisions can technically occur; however the
+// infrastructure uses (or is assumed to use) fingerprints for things like revocations, rather than
+// serial numbers
+func makeCertSerial() string {
+	ceiling := new(big.Int).Lsh(big.NewInt(1), 128)
+	newSerial, err := rand.Int(rand.Reader, ceiling)
+	if err != nil {
+		panic(err)
+	}
+	return fmt.Sprintf("%x", newSerial)
+}
+
+// nextSequentialSerial advances the persisted serial counter and returns it in the same form as
+// makeCertSerial, for the "sequential" SerialMode. Values already used by a cert (e.g. after the
+// database is restored from a backup, which doesn't include the counter) are skipped.
+func nextSequentialSerial(ctx context.Context) string {
+	cxn := getDB()
+	defer cxn.Close()
+	tx, err := cxn.BeginTx(ctx, nil)
+	if err != nil {
+		panic(err)
+	}
+	defer tx.Rollback()
+
+	var serial string
+	for {
+		// updating first takes the write lock, so concurrent issuances can't draw the same value
+		if _, err = tx.ExecContext(ctx, "update serial_counter set value=value+1 where rowid=1"); err != nil {
+			panic(err)
+		}
+		var n int64
+		if err = tx.QueryRowContext(ctx, "select value from serial_counter where rowid=1").Scan(&n); err != nil {
+			panic(err)
+		}
+		serial = fmt.Sprintf("%x", n)
+		var used int
+		if err = tx.QueryRowContext(ctx, "select count(*) from certs where serial=?", serial).Scan(&used); err != nil {
+			panic(err)
+		}
+		if used == 0 {
+			break
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		panic(err)
+	}
+	return serial
+}
+
+/*
+ * API endpoint handlers
+ */
+
+func usersHandler(writer http.ResponseWriter, req *http.Request) {
+	// GET /users -- fetch all known users
+	//   I: None
+	//   O: {Users: [{Email: "", ActiveCerts: 0, ExpiredCerts: 0, RevokedCerts: 0, Archived: ""}]}
+	//	 200: results
+	// POST /users -- create TOTP seeds for many users at once, e.g. when onboarding a team
+	//   I: {Emails: [""], Force: false}
+	//   O: {Users: [{Email: "", URL: ""}], Skipped: [""], Failed: {<email>: "problem"}}
+	//   200: the object above, even if some emails failed; 400 (bad request): no emails, with body
+	//   {Errors: {Emails: "problem"}}
+	//   URL is each new seed's otpauth:// URL. Existing users (including archived ones) are
+	//   Skipped, unless Force is set, in which case their seeds are rotated as by PUT /user/<email>.
+	//   Emails fail if malformed or not whitelisted (by email or by domain.) Records a "user
+	//   created" or "TOTP rotated" event for each.
+	// Non-GET/POST: 405 (method not allowed)
+	// Archived (i.e. deleted) users are omitted unless the "?includeArchived=true" query parameter
+	// is present. Archived is "" for users that are not archived. The counts split certs as
+	// GET /user/<email> does, so an expired cert is in ExpiredCerts, not ActiveCerts.
+
+	if req.Method == "POST" {
+		provisionUsers(writer, req)
+		return
+	}
+
+	type user struct {
+		Email        string
+		ActiveCerts  int
+		ExpiredCerts int
+		RevokedCerts int
+		Archived     string
+	}
+	users := []user{}
+
+	if err := req.ParseForm(); err != nil {
+		panic(err)
+	}
+	where := "where t.archived is null"
+	if req.FormValue("includeArchived") == "true" {
+		where = ""
+	}
+
+	ctx := req.Context()
+	q := "select t.email, count(distinct c.fingerprint), count(distinct c3.fingerprint), count(distinct c2.fingerprint), coalesce(strftime('%Y-%m-%dT%H:%M:%SZ', t.archived), '') from totp as t left join certs as c on t.email=c.email and c.revoked is null and c.expires > datetime('now') left join certs as c3 on t.email=c3.email and c3.revoked is null and c3.expires <= datetime('now') left join certs as c2 on t.email=c2.email and c2.revoked is not null " + where + " group by t.email"
+	cxn := getReadDB()
+	defer cxn.Close()
+	if rows, err := cxn.QueryContext(ctx, q); err != nil {
+		panic(err)
 	} else {
 		defer rows.Close()
 		for rows.Next() {
 			u := user{}
-			rows.Scan(&u.Email, &u.ActiveCerts, &u.RevokedCerts)
+			rows.Scan(&u.Email, &u.ActiveCerts, &u.ExpiredCerts, &u.RevokedCerts, &u.Archived)
 			users = append(users, u)
 		}
 	}
@@ -273,21 +1383,72 @@ func usersHandler(writer http.ResponseWriter, req *http.Request) {
 func userHandler(writer http.ResponseWriter, req *http.Request) {
 	// GET /user/<email> -- fetch a list of user's certs
 	//   I: None
-	//   O: {Email: "", Created: "", ActiveCerts: [<cert>], RevokedCerts: [<cert>]}
+	//   O: {Email: "", Created: "", Archived: "", ClientLimit: 5, Issuer: "", ActiveCerts: [<cert>], ExpiredCerts: [<cert>], RevokedCerts: [<cert>]}
 	//   200: the object requested; 404: Email not known
 	//   <cert>: {Fingerprint: "", Created: "", Expires: "", Revoked: "", Description: ""}
-	// PUT /user/<email> -- (re)generate a user's TOTP seed, creating user if necessary
-	//   I: None
-	//   O: {Email: "", TOTPURL: ""}
-	//   200: exists and TOTP reset; 201 (created): new user created & TOTP set
-	// DELETE /user/<email> -- delete a user's TOTP seed and revoke all certs
+	//   ExpiredCerts are those past their expiry that haven't been revoked; they're not in ActiveCerts.
+	//   ClientLimit is the user's override of the ClientLimit setting, or null if there is none.
+	//   Issuer is the user's TOTP issuer (see below), or "" if it's the ServiceName setting.
+	//   With the query parameter "?summary=true", the cert lists are replaced by counts, i.e.
+	//   O: {Email: "", Created: "", ActiveCerts: 0, ExpiredCerts: 0, RevokedCerts: 0}
+	// PUT /user/<email> -- (re)generate a user's TOTP seed, creating user if necessary, and/or set
+	// their TOTP issuer and cert limit
+	//   I: None, or {Issuer: "", ClientLimit: 5}, either field optional
+	//   O: {Email: "", TOTPURL: ""}, or {Email: "", ClientLimit: 5} if ClientLimit was the only field
+	//   200: exists and TOTP reset, or limit set; 201 (created): new user created & TOTP set;
+	//   400 (bad request): malformed body, Issuer contains a colon or is over maxTOTPIssuerLength,
+	//   or a negative ClientLimit, with body {Errors: {<field>: "problem"}}; 404: ClientLimit was
+	//   the only field, and email not known
+	//   Issuer is the issuer that authenticator apps label the seed with. If present it's stored,
+	//   and kept by later TOTP resets without one; "" reverts to the ServiceName setting, which is
+	//   also the default. Lets multi-tenant deployments group users' entries in authenticator apps
+	//   by tenant.
+	//   ClientLimit overrides the ClientLimit setting for this user: 0 means unlimited, and null
+	//   removes the override. If absent, any override is kept.
+	//   The seed is regenerated unless ClientLimit is the only field present; a new issuer needs a
+	//   new authenticator entry anyway. If the user was archived, this reactivates it with the new
+	//   seed. Records a "user created" or "TOTP rotated" event accordingly, and a "client limit
+	//   set" event if ClientLimit was present.
+	// DELETE /user/<email> -- archive a user and revoke all certs
 	//   I: None
 	//   O: {RevokedCerts: [<cert>]}    (<cert> is as above)
 	//   200: deleted/revoked; 404: email not found
-	//   RevokedCerts can be empty if user had no certs
-	// Non-GET/PUT/DELETE -- 405 (method not allowed): can't edit whitelists
+	//   RevokedCerts can be empty if user had no certs. The user's record is retained (but can no
+	//   longer authenticate or be issued certs) until restored. Certs are revoked with reason
+	//   "affiliation-changed".
+	// POST /user/<email>/restore -- reactivate an archived user
+	//   I: None
+	//   O: {Email: "", Archived: ""}
+	//   200: restored, or was not archived; 404: email not found
+	//   Certs revoked when the user was archived stay revoked.
+	// POST /user/<email>/revoke -- revoke some of a user's certs, leaving the user active
+	//   I: {Fingerprints: [""], Reason: ""}
+	//   O: {ActiveCerts: [<cert>], ExpiredCerts: [<cert>], RevokedCerts: [<cert>]}    (<cert> is as above)
+	//   200: revoked; 404: email not found; 400 (bad request): no fingerprints, any of them not
+	//   this user's, or an unknown reason, with body {Errors: {<field>: "problem"}}
+	//   All the certs are revoked together or, if any is refused, none are. Ones already revoked
+	//   are left as they were. Reason is optional, as for DELETE /cert/<fingerprint>. The TOTP seed
+	//   is untouched, so the user can still be issued new certs. O is the user's certs afterward.
+	// POST /user/<email>/reissue -- replace all of a user's active certs, e.g. after a key policy change
+	//   I: None
+	//   O: {Certs: [{OldFingerprint: "", Fingerprint: "", Description: "", OVPNDataURL: ""}]}
+	//   200: reissued; 404: email not found or archived; 409 (conflict): the RequireApproval
+	//   setting is set; 500: the .ovpn template is broken, with body {Error: "problem"}
+	//   Each active cert is revoked (reason "superseded") and replaced with one issued under the
+	//   current settings, keeping its description, all in one transaction, with a "certificate
+	//   revoked" and a "certificate issued" event for each. The .ovpn is from the template
+	//   DomainProfiles chooses for the user, if any. Certs is empty if there were no active certs.
+	// GET /user/<email>/seed -- fetch a user's raw TOTP seed, e.g. to provision another system
+	//   I: None
+	//   O: {Email: "", Secret: "", URL: ""}
+	//   200: the object above; 403 (forbidden): the AllowSeedExport setting is off, or not an
+	//   admin-scoped API key; 404: email not found, or the user has no seed
+	//   Secret is base32, and URL the otpauth:// URL an authenticator app would scan. This exposes
+	//   the user's second factor, so every export is logged as a warning and recorded as an event.
+	// Non-GET/PUT/POST/DELETE -- 405 (method not allowed): can't edit whitelists
 
 	TAG := "userHandler"
+	ctx := req.Context()
 
 	email := extractSegment(req.URL.Path, 2)
 	if email == "" {
@@ -295,6 +1456,35 @@ func userHandler(writer http.ResponseWriter, req *http.Request) {
 		httputil.SendJSON(writer, http.StatusBadRequest, struct{}{})
 		return
 	}
+	email, err := normalizeEmail(email)
+	if err != nil {
+		log.Warn(TAG, "malformed email", req.URL.Path, err)
+		httputil.SendJSON(writer, http.StatusBadRequest, struct{}{})
+		return
+	}
+
+	switch action := extractSegment(req.URL.Path, 3); {
+	case action == "" && req.Method != "POST":
+		// fall through to the per-user methods below
+	case action == "restore" && req.Method == "POST":
+		restoreUser(writer, req, email)
+		return
+	case action == "revoke" && req.Method == "POST":
+		revokeUserCerts(writer, req, email)
+		return
+	case action == "reissue" && req.Method == "POST":
+		reissueUserCerts(writer, req, email)
+		return
+	case action == "seed" && req.Method == "GET":
+		withAdminScope(func(writer http.ResponseWriter, req *http.Request) {
+			exportSeed(writer, req, email)
+		})(writer, req)
+		return
+	default:
+		log.Warn(TAG, "unknown user action", req.Method, req.URL.Path)
+		httputil.SendJSON(writer, http.StatusNotFound, struct{}{})
+		return
+	}
 
 	type cert struct {
 		Fingerprint, Created, Expires, Revoked, Description string
@@ -302,16 +1492,23 @@ func userHandler(writer http.ResponseWriter, req *http.Request) {
 
 	switch req.Method {
 	case "GET":
+		if req.URL.Query().Get("summary") == "true" {
+			summarizeUser(writer, req, email)
+			return
+		}
+
 		type user struct {
-			Email, Created            string
-			ActiveCerts, RevokedCerts []*cert
+			Email, Created, Archived                string
+			ClientLimit                             *int
+			Issuer                                  string
+			ActiveCerts, ExpiredCerts, RevokedCerts []*cert
 		}
 
-		cxn := getDB()
+		cxn := getReadDB()
 		defer cxn.Close()
-		u := &user{Email: email, ActiveCerts: []*cert{}, RevokedCerts: []*cert{}}
-		q := "select created from totp where email=?"
-		if rows, err := cxn.Query(q, u.Email); err != nil {
+		u := &user{Email: email, ActiveCerts: []*cert{}, ExpiredCerts: []*cert{}, RevokedCerts: []*cert{}}
+		q := "select created, coalesce(strftime('%Y-%m-%dT%H:%M:%SZ', archived), ''), client_limit, issuer from totp where email=?"
+		if rows, err := cxn.QueryContext(ctx, q, u.Email); err != nil {
 			panic(err)
 		} else {
 			defer rows.Close()
@@ -320,190 +1517,856 @@ func userHandler(writer http.ResponseWriter, req *http.Request) {
 				httputil.SendJSON(writer, http.StatusNotFound, struct{}{})
 				return
 			}
-			rows.Scan(&(u.Created))
+			rows.Scan(&u.Created, &u.Archived, &u.ClientLimit, &u.Issuer)
 			if rows.Next() {
-				log.Error(TAG, "multiple database entries for user", u.Email)
+				log.Error(TAG, "multiple database entries for user; see /diagnostics/duplicates", u.Email)
 				httputil.SendJSON(writer, http.StatusInternalServerError, struct{}{})
 				return
 			}
 		}
-		q = "select fingerprint, created, expires, desc, revoked from certs where email=?"
-		if rows, err := cxn.Query(q, u.Email); err != nil {
+		q = "select fingerprint, created, expires, desc, coalesce(strftime('%Y-%m-%dT%H:%M:%SZ', revoked), ''), expires <= datetime('now') from certs where email=?"
+		if rows, err := cxn.QueryContext(ctx, q, u.Email); err != nil {
 			panic(err)
 		} else {
 			defer rows.Close()
 			for rows.Next() {
 				c := &cert{}
-				rows.Scan(&c.Fingerprint, &c.Created, &c.Expires, &c.Description, &c.Revoked)
-				if c.Revoked == "" {
-					u.ActiveCerts = append(u.ActiveCerts, c)
-				} else {
+				var expired bool
+				rows.Scan(&c.Fingerprint, &c.Created, &c.Expires, &c.Description, &c.Revoked, &expired)
+				if c.Revoked != "" {
 					u.RevokedCerts = append(u.RevokedCerts, c)
+				} else if expired {
+					u.ExpiredCerts = append(u.ExpiredCerts, c)
+				} else {
+					u.ActiveCerts = append(u.ActiveCerts, c)
 				}
 			}
 			sort.Slice(u.ActiveCerts, func(i, j int) bool { return u.ActiveCerts[i].Description < u.ActiveCerts[j].Description })
+			sort.Slice(u.ExpiredCerts, func(i, j int) bool { return u.ExpiredCerts[i].Description < u.ExpiredCerts[j].Description })
 			sort.Slice(u.RevokedCerts, func(i, j int) bool { return u.RevokedCerts[i].Description < u.RevokedCerts[j].Description })
 		}
 
 		httputil.SendJSON(writer, http.StatusOK, &u)
 
 	case "PUT":
+		// an empty body (or Bifrost's "{}") is a plain TOTP reset
+		reqBody := &struct {
+			Issuer      *string
+			ClientLimit optionalLimit
+		}{}
+		if req.ContentLength != 0 {
+			body, err := ioutil.ReadAll(req.Body)
+			if err != nil {
+				log.Warn(TAG, "unreadable request body", req.URL.Path, err)
+				httputil.SendJSON(writer, http.StatusBadRequest, struct{}{})
+				return
+			}
+			req.Body = ioutil.NopCloser(bytes.NewReader(body))
+			if len(bytes.TrimSpace(body)) > 0 {
+				if errs := decodeStrictJSON(reqBody, req); errs != nil {
+					log.Warn(TAG, "malformed request JSON", req.URL.Path, errs)
+					sendFieldErrors(writer, errs)
+					return
+				}
+			}
+		}
+		errs := fieldErrors{}
+		if reqBody.Issuer != nil {
+			*reqBody.Issuer = strings.TrimSpace(*reqBody.Issuer)
+			if strings.Contains(*reqBody.Issuer, ":") || len(*reqBody.Issuer) > maxTOTPIssuerLength {
+				// a colon would be taken as the end of the issuer in the otpauth label
+				errs["Issuer"] = fmt.Sprintf("must not contain ':' or exceed %d bytes", maxTOTPIssuerLength)
+			}
+		}
+		if reqBody.ClientLimit.Value != nil && *reqBody.ClientLimit.Value < 0 {
+			errs["ClientLimit"] = "must not be negative"
+		}
+		if len(errs) > 0 {
+			log.Warn(TAG, "invalid user settings", req.URL.Path, errs)
+			sendFieldErrors(writer, errs)
+			return
+		}
+		if reqBody.ClientLimit.Set && reqBody.Issuer == nil {
+			setUserClientLimit(writer, req, email, reqBody.ClientLimit.Value)
+			return
+		}
+		issuer := reqBody.Issuer
+
 		type res struct {
 			Email, TOTPURL string
 		}
 
-		settings := loadSettings()
+		// an existing user (even if archived) keeps any stored issuer, and gets a 200 instead of a 201
+		var stored string
+		cxn := getDB()
+		err := cxn.QueryRowContext(ctx, "select issuer from totp where email=?", email).Scan(&stored)
+		cxn.Close()
+		if err != nil && err != sql.ErrNoRows {
+			panic(err)
+		}
+		existed := err == nil
+		if issuer == nil {
+			issuer = &stored
+		}
+
+		settings := loadSettings(ctx)
+		key, err := totp.Generate(totp.GenerateOpts{
+			Issuer:      totpIssuer(settings, *issuer),
+			AccountName: email,
+		})
+		if err != nil {
+			panic(err)
+		}
+
+		// replacing the row clears archived, but a per-user limit is carried over unless replaced
+		q := "insert or replace into totp (email, seed, updated, client_limit, issuer) values (?, ?, datetime('now'), (select client_limit from totp where email=?), ?)"
+		args := []interface{}{email, encryptSeed(key.Secret()), email, *issuer}
+		if reqBody.ClientLimit.Set {
+			q = "insert or replace into totp (email, seed, updated, client_limit, issuer) values (?, ?, datetime('now'), ?, ?)"
+			args[2] = reqBody.ClientLimit.Value
+		}
+		writeDatabaseByQuery(ctx, q, args...)
+
+		// record the event
+		value := ""
+		if *issuer != "" {
+			value = "issuer " + *issuer
+		}
+		event, status := "user created", http.StatusCreated
+		if existed {
+			event, status = "TOTP rotated", http.StatusOK
+		}
+		recordEvent(req, event, email, value)
+		if reqBody.ClientLimit.Set {
+			recordEvent(req, "client limit set", email, reqBody.ClientLimit.String())
+		}
+
+		var buf bytes.Buffer
+		img, err := key.Image(200, 200)
+		if err != nil {
+			panic(err)
+		}
+		png.Encode(&buf, img)
+		imageURL := base64.StdEncoding.EncodeToString(buf.Bytes())
+		imageURL = fmt.Sprintf("data:image/png;base64,%s", imageURL)
+
+		log.Status(TAG, fmt.Sprintf("generated TOTP seed for '%s' (%s)", email, event))
+		httputil.SendJSON(writer, status, &res{email, imageURL})
+
+	case "DELETE":
+		cxn := getDB()
+		defer cxn.Close()
+
+		// an already archived user keeps its original archive time, but still counts as found
+		res, err := cxn.ExecContext(ctx, "update totp set archived=coalesce(archived, datetime('now')) where email=?", email)
+		if err != nil {
+			panic(err)
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			panic(err)
+		} else if n == 0 {
+			log.Warn(TAG, "attempt to archive nonexistent user", email)
+			httputil.SendJSON(writer, http.StatusNotFound, struct{}{})
+			return
+		}
+
+		fps := []string{}
+		q := "select fingerprint from certs where email=?"
+		if rows, err := cxn.QueryContext(ctx, q, email); err != nil {
+			panic(err)
+		} else {
+			defer rows.Close()
+			for rows.Next() {
+				var fp string
+				rows.Scan(&fp)
+				fps = append(fps, fp)
+			}
+		}
+		if len(fps) > 0 {
+			q := "update certs set revoked=datetime('now'), revocation_reason='affiliation-changed' where email=? and revoked is null"
+			writeDatabaseByQuery(ctx, q, email)
+			resetOCSPCache()
+		}
+
+		// record the event
+		recordEvent(req, "user archived", email, fmt.Sprintf("%d certs revoked", len(fps)))
+
+		log.Status(TAG, fmt.Sprintf("archived user '%s'", email))
+		httputil.SendJSON(writer, http.StatusOK, &struct{ RevokedCerts []string }{fps})
+
+	default:
+		panic("API method sentinel misconfiguration")
+	}
+}
+
+// isWhitelisted reports whether email may use the VPN per the whitelist settings, i.e. it is
+// listed in WhitelistedUsers or its domain is in WhitelistedDomains
+func isWhitelisted(s *settings, email string) bool {
+	for _, domain := range s.WhitelistedDomains {
+		if strings.HasSuffix(email, "@"+domain) {
+			return true
+		}
+	}
+	for _, u := range s.WhitelistedUsers {
+		if u == email {
+			return true
+		}
+	}
+	return false
+}
+
+// provisionUsers handles POST /users; see usersHandler
+func provisionUsers(writer http.ResponseWriter, req *http.Request) {
+	TAG := "/users"
+	ctx := req.Context()
+
+	reqBody := &struct {
+		Emails []string
+		Force  bool
+	}{}
+	if errs := decodeStrictJSON(reqBody, req); errs != nil {
+		log.Warn(TAG, "missing or malformed request JSON", errs)
+		sendFieldErrors(writer, errs)
+		return
+	}
+	if len(reqBody.Emails) == 0 {
+		log.Warn(TAG, "batch provisioning with no emails")
+		sendFieldErrors(writer, fieldErrors{"Emails": "required"})
+		return
+	}
+
+	type user struct{ Email, URL string }
+	res := struct {
+		Users   []user
+		Skipped []string
+		Failed  map[string]string
+	}{[]user{}, []string{}, map[string]string{}}
+
+	s := loadSettings(ctx)
+	emails := []string{}
+	seen := map[string]bool{}
+	for _, raw := range reqBody.Emails {
+		email, err := normalizeEmail(raw)
+		if err != nil {
+			res.Failed[raw] = err.Error()
+			continue
+		}
+		if seen[email] {
+			continue
+		}
+		seen[email] = true
+		if !isWhitelisted(s, email) {
+			res.Failed[email] = "not whitelisted"
+			continue
+		}
+		emails = append(emails, email)
+	}
+
+	cxn := getDB()
+	defer cxn.Close()
+	tx, err := cxn.BeginTx(ctx, nil)
+	if err != nil {
+		panic(err)
+	}
+	defer tx.Rollback()
+	for _, email := range emails {
+		// as with PUT /user/<email>, an existing user keeps its issuer and any per-user limit
+		var issuer string
+		err := tx.QueryRowContext(ctx, "select issuer from totp where email=?", email).Scan(&issuer)
+		if err != nil && err != sql.ErrNoRows {
+			panic(err)
+		}
+		existed := err == nil
+		if existed && !reqBody.Force {
+			res.Skipped = append(res.Skipped, email)
+			continue
+		}
+
 		key, err := totp.Generate(totp.GenerateOpts{
-			Issuer:      settings.ServiceName,
+			Issuer:      totpIssuer(s, issuer),
 			AccountName: email,
 		})
 		if err != nil {
 			panic(err)
 		}
+		q := "insert or replace into totp (email, seed, updated, client_limit, issuer) values (?, ?, datetime('now'), (select client_limit from totp where email=?), ?)"
+		if _, err := tx.ExecContext(ctx, q, email, encryptSeed(key.Secret()), email, issuer); err != nil {
+			panic(err)
+		}
+		event := "user created"
+		if existed {
+			event = "TOTP rotated"
+		}
+		if err := recordEventTx(tx, req, event, email, "batch"); err != nil {
+			panic(err)
+		}
+		res.Users = append(res.Users, user{email, key.URL()})
+	}
+	if err := tx.Commit(); err != nil {
+		panic(err)
+	}
+
+	log.Status(TAG, fmt.Sprintf("provisioned %d users, skipped %d, failed %d", len(res.Users), len(res.Skipped), len(res.Failed)), requestID(req))
+	httputil.SendJSON(writer, http.StatusOK, &res)
+}
+
+// maxTOTPIssuerLength caps per-user TOTP issuers, which authenticator apps display
+const maxTOTPIssuerLength = 100
+
+// totpIssuer returns the issuer for a TOTP seed: the user's own issuer if set, else ServiceName
+func totpIssuer(s *settings, issuer string) string {
+	if issuer != "" {
+		return issuer
+	}
+	return s.ServiceName
+}
+
+// exportSeed handles GET /user/<email>/seed; see userHandler
+func exportSeed(writer http.ResponseWriter, req *http.Request, email string) {
+	TAG := "userHandler"
+	ctx := req.Context()
+
+	s := loadSettings(ctx)
+	if !s.AllowSeedExport {
+		log.Warn(TAG, "refused TOTP seed export; AllowSeedExport is off", email, operator(req))
+		httputil.SendJSON(writer, http.StatusForbidden, struct{}{})
+		return
+	}
+
+	var stored, issuer string
+	cxn := getDB()
+	defer cxn.Close()
+	err := cxn.QueryRowContext(ctx, "select seed, issuer from totp where email=?", email).Scan(&stored, &issuer)
+	if err != nil && err != sql.ErrNoRows {
+		panic(err)
+	}
+	if err == sql.ErrNoRows || stored == "" {
+		log.Warn(TAG, "seed export for nonexistent user or one with no seed", email)
+		httputil.SendJSON(writer, http.StatusNotFound, struct{}{})
+		return
+	}
+	secret, err := decryptSeed(stored)
+	if err != nil {
+		panic(err)
+	}
+
+	// the same form totp.Generate produces, with its default parameters
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", totpIssuer(s, issuer))
+	otpURL := url.URL{Scheme: "otpauth", Host: "totp", Path: "/" + totpIssuer(s, issuer) + ":" + email, RawQuery: params.Encode()}
+
+	recordEvent(req, "TOTP seed exported", email, "")
+	log.Warn(TAG, fmt.Sprintf("exported TOTP seed for '%s' to operator '%s'", email, operator(req)), requestID(req))
+	httputil.SendJSON(writer, http.StatusOK, &struct{ Email, Secret, URL string }{email, secret, otpURL.String()})
+}
+
+// restoreUser handles POST /user/<email>/restore; see userHandler
+func restoreUser(writer http.ResponseWriter, req *http.Request, email string) {
+	TAG := "restoreUser"
+	ctx := req.Context()
+
+	var archived string
+	cxn := getDB()
+	defer cxn.Close()
+	q := "select coalesce(strftime('%Y-%m-%dT%H:%M:%SZ', archived), '') from totp where email=?"
+	if err := cxn.QueryRowContext(ctx, q, email).Scan(&archived); err == sql.ErrNoRows {
+		log.Warn(TAG, "attempt to restore nonexistent user", email)
+		httputil.SendJSON(writer, http.StatusNotFound, struct{}{})
+		return
+	} else if err != nil {
+		panic(err)
+	}
+
+	if archived != "" {
+		writeDatabaseByQuery(ctx, "update totp set archived=null where email=?", email)
+		recordEvent(req, "user restored", email, fmt.Sprintf("archived %s", archived))
+		log.Status(TAG, fmt.Sprintf("restored user '%s'", email))
+	}
+
+	httputil.SendJSON(writer, http.StatusOK, &struct{ Email, Archived string }{email, ""})
+}
+
+// revokeUserCerts handles POST /user/<email>/revoke; see userHandler
+func revokeUserCerts(writer http.ResponseWriter, req *http.Request, email string) {
+	TAG := "revokeUserCerts"
+	ctx := req.Context()
+
+	reqBody := &struct {
+		Fingerprints []string
+		Reason       string
+	}{}
+	if errs := decodeStrictJSON(reqBody, req); errs != nil {
+		log.Warn(TAG, "malformed request JSON", req.URL.Path, errs)
+		sendFieldErrors(writer, errs)
+		return
+	}
+	errs := fieldErrors{}
+	fps, seen := []string{}, map[string]bool{}
+	for _, fp := range reqBody.Fingerprints {
+		if fp = strings.ToLower(strings.TrimSpace(fp)); fp != "" && !seen[fp] {
+			fps, seen[fp] = append(fps, fp), true
+		}
+	}
+	if len(fps) == 0 {
+		errs["Fingerprints"] = "required"
+	}
+	if _, ok := revocationReasons[reqBody.Reason]; reqBody.Reason != "" && !ok {
+		errs["Reason"] = "unknown revocation reason"
+	}
+	if len(errs) > 0 {
+		log.Warn(TAG, "invalid JSON request", req.URL.Path, errs)
+		sendFieldErrors(writer, errs)
+		return
+	}
+
+	cxn := getDB()
+	defer cxn.Close()
+	tx, err := cxn.BeginTx(ctx, nil)
+	if err != nil {
+		panic(err)
+	}
+	defer tx.Rollback()
+
+	var exists int
+	if err := tx.QueryRowContext(ctx, "select count(*) from totp where email=?", email).Scan(&exists); err != nil {
+		panic(err)
+	}
+	if exists == 0 {
+		log.Warn(TAG, "attempt to revoke certs of nonexistent user", email)
+		httputil.SendJSON(writer, http.StatusNotFound, struct{}{})
+		return
+	}
+
+	// check every cert before revoking any, so that a bad fingerprint changes nothing
+	toRevoke, notOwned := []string{}, []string{}
+	for _, fp := range fps {
+		var revoked bool
+		err := tx.QueryRowContext(ctx, "select revoked is not null from certs where fingerprint=? and email=?", fp, email).Scan(&revoked)
+		if err == sql.ErrNoRows {
+			notOwned = append(notOwned, fp)
+		} else if err != nil {
+			panic(err)
+		} else if !revoked {
+			toRevoke = append(toRevoke, fp)
+		}
+	}
+	if len(notOwned) > 0 {
+		log.Warn(TAG, "attempt to revoke certs not belonging to user", email, notOwned)
+		sendFieldErrors(writer, fieldErrors{"Fingerprints": "not certs of this user: " + strings.Join(notOwned, ", ")})
+		return
+	}
+
+	for _, fp := range toRevoke {
+		q := "update certs set revoked=datetime('now'), revocation_reason=? where fingerprint=?"
+		if _, err := tx.ExecContext(ctx, q, reqBody.Reason, fp); err != nil {
+			panic(err)
+		}
+		value := fp
+		if reqBody.Reason != "" {
+			value = fmt.Sprintf("%s - %s", fp, reqBody.Reason)
+		}
+		if err := recordEventTx(tx, req, "certificate revoked", email, value); err != nil {
+			panic(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		panic(err)
+	}
+	if len(toRevoke) > 0 {
+		resetOCSPCache()
+	}
+	log.Status(TAG, fmt.Sprintf("revoked %d certificates of '%s'", len(toRevoke), email), requestID(req))
+
+	type cert struct {
+		Fingerprint, Created, Expires, Revoked, Description string
+	}
+	res := struct{ ActiveCerts, ExpiredCerts, RevokedCerts []*cert }{[]*cert{}, []*cert{}, []*cert{}}
+	q := "select fingerprint, created, expires, coalesce(desc, ''), coalesce(strftime('%Y-%m-%dT%H:%M:%SZ', revoked), ''), expires <= datetime('now') from certs where email=? order by rowid"
+	rows, err := cxn.QueryContext(ctx, q, email)
+	if err != nil {
+		panic(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		c := &cert{}
+		var expired bool
+		if err := rows.Scan(&c.Fingerprint, &c.Created, &c.Expires, &c.Description, &c.Revoked, &expired); err != nil {
+			panic(err)
+		}
+		if c.Revoked != "" {
+			res.RevokedCerts = append(res.RevokedCerts, c)
+		} else if expired {
+			res.ExpiredCerts = append(res.ExpiredCerts, c)
+		} else {
+			res.ActiveCerts = append(res.ActiveCerts, c)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		panic(err)
+	}
+	httputil.SendJSON(writer, http.StatusOK, &res)
+}
+
+// listAllCerts handles GET /certs without a search query; see certsHandler
+func listAllCerts(writer http.ResponseWriter, req *http.Request) {
+	TAG := "/certs"
+	ctx := req.Context()
+	params := req.URL.Query()
+
+	type cert struct {
+		Fingerprint, Created, Expires, Revoked, Description, LastSeen string
+	}
+	type user struct {
+		Email, Created                          string
+		ActiveCerts, ExpiredCerts, RevokedCerts []*cert
+	}
+
+	errs := fieldErrors{}
+	filter := "t.email=c.email"
+	args := []interface{}{}
+	if prefix := params.Get("email"); prefix != "" {
+		filter += ` and t.email like ? escape '\'`
+		args = append(args, strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(strings.ToLower(prefix))+"%")
+	}
+	switch params.Get("status") {
+	case "":
+	case "active":
+		filter += " and c.revoked is null and c.expires > datetime('now')"
+	case "expired":
+		filter += " and c.revoked is null and c.expires <= datetime('now')"
+	case "revoked":
+		filter += " and c.revoked is not null"
+	default:
+		errs["status"] = "must be \"active\", \"expired\", or \"revoked\""
+	}
+	limit, offset := -1, 0 // i.e. no limit, to SQLite
+	if raw := params.Get("limit"); raw != "" {
+		if tmp, err := strconv.Atoi(raw); err != nil || tmp < 1 {
+			errs["limit"] = "must be a positive whole number"
+		} else {
+			limit = tmp
+		}
+	}
+	if raw := params.Get("offset"); raw != "" {
+		if tmp, err := strconv.Atoi(raw); err != nil || tmp < 0 {
+			errs["offset"] = "must be a whole number"
+		} else {
+			offset = tmp
+		}
+	}
+	if len(errs) > 0 {
+		log.Warn(TAG, "malformed query parameters", req.URL.RawQuery, errs)
+		sendFieldErrors(writer, errs)
+		return
+	}
+
+	res := struct {
+		Certs []*user
+		Total int
+	}{[]*user{}, 0}
+
+	cxn := getReadDB()
+	defer cxn.Close()
+	q := "select count(distinct t.email) from totp as t, certs as c where " + filter
+	if err := cxn.QueryRowContext(ctx, q, args...).Scan(&res.Total); err != nil {
+		panic(err)
+	}
+
+	// the page is of users rather than certs, so that no user's certs are split across pages
+	q = `select t.email, t.created, c.fingerprint, c.created, c.expires, coalesce(strftime('%Y-%m-%dT%H:%M:%SZ', c.revoked), ''), coalesce(c.desc, ''), coalesce(strftime('%Y-%m-%dT%H:%M:%SZ', c.last_seen), ''), c.expires <= datetime('now')
+	     from totp as t, certs as c where ` + filter + ` and t.email in
+	       (select distinct t.email from totp as t, certs as c where ` + filter + ` order by t.email limit ? offset ?)
+	     order by t.email`
+	rows, err := cxn.QueryContext(ctx, q, append(append(append([]interface{}{}, args...), args...), limit, offset)...)
+	if err != nil {
+		panic(err)
+	}
+	defer rows.Close()
+	users := make(map[string]*user)
+	for rows.Next() {
+		var email, created string
+		var expired bool
+		c := &cert{}
+		if err := rows.Scan(&email, &created, &c.Fingerprint, &c.Created, &c.Expires, &c.Revoked, &c.Description, &c.LastSeen, &expired); err != nil {
+			panic(err)
+		}
+		u, ok := users[email]
+		if !ok {
+			u = &user{Email: email, Created: created, ActiveCerts: []*cert{}, ExpiredCerts: []*cert{}, RevokedCerts: []*cert{}}
+			users[email] = u
+			res.Certs = append(res.Certs, u) // rows arrive in email order
+		}
+		if c.Revoked != "" {
+			u.RevokedCerts = append(u.RevokedCerts, c)
+		} else if expired {
+			u.ExpiredCerts = append(u.ExpiredCerts, c)
+		} else {
+			u.ActiveCerts = append(u.ActiveCerts, c)
+		}
+	}
+	for _, u := range res.Certs {
+		sort.Slice(u.ActiveCerts, func(i, j int) bool { return u.ActiveCerts[i].Description < u.ActiveCerts[j].Description })
+		sort.Slice(u.ExpiredCerts, func(i, j int) bool { return u.ExpiredCerts[i].Description < u.ExpiredCerts[j].Description })
+		sort.Slice(u.RevokedCerts, func(i, j int) bool { return u.RevokedCerts[i].Description < u.RevokedCerts[j].Description })
+	}
+
+	httputil.SendJSON(writer, http.StatusOK, &res)
+}
+
+// certSearchLimit caps the number of results returned by a cert search
+const certSearchLimit = 100
+
+// searchCerts handles GET /certs?q=<text>; see certsHandler
+func searchCerts(writer http.ResponseWriter, req *http.Request, query string) {
+	ctx := req.Context()
+
+	type match struct {
+		Email, Fingerprint, Description, Created, Expires, Revoked, Status string
+	}
+	res := struct{ Certs []*match }{[]*match{}}
+
+	// escape LIKE wildcards so that e.g. "50%" matches literally
+	pattern := "%" + strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(strings.ToLower(query)) + "%"
+	q := `select email, fingerprint, coalesce(desc, ''), created, expires, coalesce(strftime('%Y-%m-%dT%H:%M:%SZ', revoked), ''), expires <= datetime('now') from certs
+	      where lower(desc) like ? escape '\' order by email, lower("desc") limit ?`
+	cxn := getReadDB()
+	defer cxn.Close()
+	rows, err := cxn.QueryContext(ctx, q, pattern, certSearchLimit)
+	if err != nil {
+		panic(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		m := &match{Status: "active"}
+		var expired bool
+		if err := rows.Scan(&m.Email, &m.Fingerprint, &m.Description, &m.Created, &m.Expires, &m.Revoked, &expired); err != nil {
+			panic(err)
+		}
+		if m.Revoked != "" {
+			m.Status = "revoked"
+		} else if expired {
+			m.Status = "expired"
+		}
+		res.Certs = append(res.Certs, m)
+	}
+
+	httputil.SendJSON(writer, http.StatusOK, &res)
+}
+
+// summarizeUser handles GET /user/<email>?summary=true; see userHandler
+func summarizeUser(writer http.ResponseWriter, req *http.Request, email string) {
+	TAG := "summarizeUser"
+
+	res := struct {
+		Email, Created                          string
+		ActiveCerts, ExpiredCerts, RevokedCerts int
+	}{Email: email}
+	q := `select created,
+	        (select count(*) from certs where email=? and revoked is null and expires > datetime('now')),
+	        (select count(*) from certs where email=? and revoked is null and expires <= datetime('now')),
+	        (select count(*) from certs where email=? and revoked is not null)
+	      from totp where email=?`
+	cxn := getReadDB()
+	defer cxn.Close()
+	err := cxn.QueryRowContext(req.Context(), q, email, email, email, email).Scan(&res.Created, &res.ActiveCerts, &res.ExpiredCerts, &res.RevokedCerts)
+	if err == sql.ErrNoRows {
+		log.Status(TAG, "request for nonexistent user", email)
+		httputil.SendJSON(writer, http.StatusNotFound, struct{}{})
+		return
+	} else if err != nil {
+		panic(err)
+	}
 
-		q := "insert or replace into totp (email, seed, updated) values (?, ?, datetime('now'))"
-		writeDatabaseByQuery(q, email, key.Secret(), email)
+	httputil.SendJSON(writer, http.StatusOK, &res)
+}
 
-		// record the event
-		q = "insert into events (event, email, value) values (?, ?, ?)"
-		writeDatabaseByQuery(q, "TOTP set", email, "")
+// optionalLimit is a request's ClientLimit, telling an absent field (Set is false) from a null
+// one (Value is nil), which PUT /user/<email> treats differently
+type optionalLimit struct {
+	Set   bool
+	Value *int
+}
 
-		var buf bytes.Buffer
-		img, err := key.Image(200, 200)
-		if err != nil {
-			panic(err)
-		}
-		png.Encode(&buf, img)
-		imageURL := base64.StdEncoding.EncodeToString(buf.Bytes())
-		imageURL = fmt.Sprintf("data:image/png;base64,%s", imageURL)
+func (o *optionalLimit) UnmarshalJSON(data []byte) error {
+	o.Set = true
+	err := json.Unmarshal(data, &o.Value)
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		typeErr.Field = "ClientLimit" // json doesn't say which field a custom unmarshaler failed on
+	}
+	return err
+}
 
-		log.Status(TAG, fmt.Sprintf("generated TOTP seed for '%s'", email))
-		httputil.SendJSON(writer, http.StatusOK, &res{email, imageURL})
+// String renders the limit for events and logs, with "default" for no override
+func (o optionalLimit) String() string {
+	if o.Value == nil {
+		return "default"
+	}
+	return strconv.Itoa(*o.Value)
+}
 
-	case "DELETE":
-		fps := []string{}
-		q := "select fingerprint from certs where email=?"
-		cxn := getDB()
-		defer cxn.Close()
-		if rows, err := cxn.Query(q, email); err != nil {
-			panic(err)
-		} else {
-			defer rows.Close()
-			for rows.Next() {
-				var fp string
-				rows.Scan(&fp)
-				fps = append(fps, fp)
-			}
-		}
-		if len(fps) > 0 {
-			writeDatabaseByQuery("update certs set revoked=datetime('now') where email=?", email)
-		}
-		writeDatabaseByQuery("delete from totp where email=?", email)
+// setUserClientLimit handles PUT /user/<email> with only a ClientLimit; see userHandler
+func setUserClientLimit(writer http.ResponseWriter, req *http.Request, email string, limit *int) {
+	TAG := "setUserClientLimit"
+	ctx := req.Context()
 
-		// record the event
-		q = "insert into events (event, email, value) values (?, ?, ?)"
-		writeDatabaseByQuery(q, "user deleted", email, fmt.Sprintf("%d certs revoked", len(fps)))
+	var exists int
+	cxn := getDB()
+	defer cxn.Close()
+	if err := cxn.QueryRowContext(ctx, "select count(*) from totp where email=?", email).Scan(&exists); err != nil {
+		panic(err)
+	}
+	if exists == 0 {
+		log.Warn(TAG, "attempt to set limit for nonexistent user", email)
+		httputil.SendJSON(writer, http.StatusNotFound, struct{}{})
+		return
+	}
 
-		log.Status(TAG, fmt.Sprintf("cleared TOTP seed (deleted user) for '%s'", email))
-		httputil.SendJSON(writer, http.StatusOK, &struct{ RevokedCerts []string }{fps})
+	writeDatabaseByQuery(ctx, "update totp set client_limit=? where email=?", limit, email)
 
-	default:
-		panic("API method sentinel misconfiguration")
-	}
+	value := optionalLimit{true, limit}.String()
+	recordEvent(req, "client limit set", email, value)
+	log.Status(TAG, fmt.Sprintf("set client limit for '%s' to %s", email, value))
+
+	httputil.SendJSON(writer, http.StatusOK, &struct {
+		Email       string
+		ClientLimit *int
+	}{email, limit})
 }
 
 func certsHandler(writer http.ResponseWriter, req *http.Request) {
 	// GET /certs -- get all certs for all users
 	//   I: None
-	//   O: {Certs: [{Email: "", Created: "", ActiveCerts: [<cert>], RevokedCerts: [<cert>]}]}
+	//   O: {Certs: [{Email: "", Created: "", ActiveCerts: [<cert>], ExpiredCerts: [<cert>], RevokedCerts: [<cert>]}], Total: 0}
+	//   <cert>: {Fingerprint: "", Created: "", Expires: "", Revoked: "", Description: "", LastSeen: ""}
+	//   200: the object above; 400 (bad request): malformed query parameters, with body
+	//   {Errors: {<param>: "problem"}}
+	//   Optional query parameters narrow the result: "email" to users whose email starts with the
+	//   given text, "status" ("active", "expired", or "revoked") to certs in that state, and
+	//   "limit" and "offset" to a page of users in email order. Total counts all matching users,
+	//   regardless of paging. Without them, this dumps every cert in the database, which is
+	//   expensive for large deployments.
+	// GET /certs?q=<text> -- search all users' certs by description
+	//   I: None
+	//   O: {Certs: [{Email: "", Fingerprint: "", Description: "", Created: "", Expires: "", Revoked: "", Status: ""}]}
 	//   200: the object above
+	//   Matches are case-insensitive substrings of the description, capped at certSearchLimit.
+	//   Status is "active", "expired", or "revoked".
 	// GET /certs/<email> -- get a list of certs for the indicated user
 	//   I: none
-	//   O: {Email: "", Created: "", ActiveCerts: [<cert>], RevokedCerts: [<cert>]}
+	//   O: {Email: "", Created: "", ActiveCerts: [<cert>], ExpiredCerts: [<cert>], RevokedCerts: [<cert>]}
 	//   200: the object requested; 404: email not found
+	//   ExpiredCerts are those past their expiry that haven't been revoked.
 	//   Note: if email has no TOTP but does have certs, Created is ""
 	// POST /certs/<email> -- create a certificate for the indicated user
-	//   I: {Email: "", Description: ""}
+	//   I: {Email: "", Description: "", KeyBits: 2048, Profile: "", KeyPassphrase: ""}
 	//   O: {OVPNDataURL: ""} // Note: represented as the base64-encoded value of a data: href
-	//   201: created; 400 (bad request): missing email or description;
-	//   401 (unauthorized): user is already at cert limit
-	// Non-GET: 409 (bad method)
+	//   With the query parameter "?download=true", O is instead the .ovpn file itself, as type
+	//   application/x-openvpn-profile and an attachment named "<email>-<fingerprint>.ovpn".
+	//   201: created; 400 (bad request): missing email, missing or malformed description (see the
+	//   RequireDescription and MinDescriptionLength settings), KeyBits not permitted, KeyPassphrase
+	//   too short or long, unknown Profile, or unknown fields, with body
+	//   {Errors: {<field>: "problem"}}; 403 (forbidden): user is already at cert limit, with body
+	//   {Errors: {ClientLimit: "problem"}}; 409 (conflict): UniqueDescriptions is set and the user
+	//   already has an active cert with this description; 503 (service unavailable): the
+	//   GlobalCertLimit setting has been reached, with body {Error: "problem"}; 429 (too many
+	//   requests): the IssuanceCooldownCerts setting has been reached, with a Retry-After header in
+	//   seconds and body {Error: "problem", RetryAfter: 0}, also in seconds
+	//   The cert limit is the user's own (see PUT /user/<email>) if set, else the ClientLimit
+	//   setting; 0 means unlimited. Only unexpired, unrevoked certs count toward it. KeyBits is
+	//   optional and defaults to the IssuedCertKeyBits setting. Profile is optional and selects one
+	//   of the OVPNTemplateProfiles for the .ovpn file instead of OVPNTemplateFile; without it, the
+	//   DomainProfiles setting's profile for the user's domain is used, if any. An explicit Profile
+	//   always wins. KeyPassphrase is optional; if set (4 to 1023 bytes), the private key in the
+	//   .ovpn is encrypted with it, and OpenVPN asks for it on connecting. It isn't stored, and
+	//   can't be combined with RequireApproval. If an Idempotency-Key header is given and the same
+	//   user's earlier request with that key succeeded in the last 15 minutes, its result is
+	//   returned again with a 200 (or a 409 if it is still in progress, or if that cert has since
+	//   been revoked or the user archived) and no new cert is issued. Time spent generating the key
+	//   is reported in the X-Gen-Time-Ms response header.
+	//   If the RequireApproval setting is set, no cert is issued yet: the request is recorded for
+	//   another operator to approve (see certRequestHandler), with a 202 (accepted) and body
+	//   {RequestID: 0}. The cert limit and UniqueDescriptions are checked now and again on approval;
+	//   Idempotency-Key is ignored.
+	// POST /certs/<email>?async=true -- as above, but queue the cert for issuance in the background
+	//   I: as above
+	//   O: {JobID: ""}
+	//   202 (accepted): queued; poll GET /cert-job/<JobID> for the .ovpn (see certJobHandler);
+	//   503 (service unavailable): too many jobs are already queued, with body {Error: "problem"};
+	//   otherwise as above
+	//   The cert limit and other checks are made before queueing. Idempotency-Key is ignored, and
+	//   RequireApproval takes precedence.
+	// POST /certs/<email>/sign -- sign a client's own CSR, so its private key never leaves it
+	//   I: {CSR: "", Description: ""}
+	//   O: {Fingerprint: "", PEM: ""}
+	//   201: created; 400 (bad request): malformed CSR, a CN other than the email, or a disallowed
+	//   key, with body {Errors: {<field>: "problem"}}; 403 (forbidden): RequireApproval is set;
+	//   otherwise as for POST /certs/<email>
+	//   See signCSR for the key policy. PEM is the issued cert alone; there's no key, and no .ovpn.
+	// POST /certs/<email>/import -- record a cert issued outside Heimdall by the same CA
+	//   I: {PEM: "", Description: ""}
+	//   O: {Fingerprint: "", Expires: ""}
+	//   201: recorded; 400 (bad request): PEM isn't a client cert signed by the current or next CA,
+	//   or has expired, or the description is malformed, with body {Errors: {<field>: "problem"}};
+	//   404: no such active user; 409 (conflict): the cert is already recorded
+	//   For migrating from manual issuance: the cert is tracked, listed, and revocable like any
+	//   other, and appears in the CRL once revoked, but isn't reissued. Created is the cert's
+	//   NotBefore. The user's cert limit isn't enforced.
+	// Non-GET/POST: 405 (method not allowed)
 
 	TAG := "/certs/"
+	ctx := req.Context()
 
 	email := extractSegment(req.URL.Path, 2)
+	if email != "" {
+		var err error
+		if email, err = normalizeEmail(email); err != nil {
+			log.Warn(TAG, "malformed email", req.URL.Path, err)
+			httputil.SendJSON(writer, http.StatusBadRequest, struct{}{})
+			return
+		}
+	}
 
 	type cert struct {
-		Fingerprint, Created, Expires, Revoked, Description string
+		Fingerprint, Created, Expires, Revoked, Description, LastSeen string
 	}
 
 	switch req.Method {
 	case "GET":
+		if query := req.URL.Query().Get("q"); email == "" && query != "" {
+			searchCerts(writer, req, query)
+			return
+		}
 		if email == "" { // i.e. /certs or /certs/ -- means fetch all users
-			type user struct {
-				Email, Created            string
-				ActiveCerts, RevokedCerts []*cert
-			}
-			users := make(map[string]*user)
-			q := "select t.email, t.created, c.fingerprint, c.created, c.expires, c.revoked, c.desc from totp as t, certs as c where t.email=c.email"
-			// note that this query skips certs that have no extant user; WAI
-			cxn := getDB()
-			defer cxn.Close()
-			if rows, err := cxn.Query(q); err != nil {
-				panic(err)
-			} else {
-				defer rows.Close()
-				for rows.Next() {
-					var email, created string
-					c := &cert{}
-					rows.Scan(&email, &created, &c.Fingerprint, &c.Created, &c.Expires, &c.Revoked, &c.Description)
-					var u *user
-					if u, ok := users[email]; !ok {
-						u = &user{Email: email}
-						users[email] = u
-						u.ActiveCerts = []*cert{}
-						u.RevokedCerts = []*cert{}
-						u.Created = created
-					}
-					if c.Revoked != "" {
-						u.ActiveCerts = append(u.ActiveCerts, c)
-					} else {
-						u.RevokedCerts = append(u.RevokedCerts, c)
-					}
-				}
-				res := struct{ Certs []*user }{[]*user{}}
-				for _, u := range users {
-					sort.Slice(u.ActiveCerts, func(i, j int) bool { return u.ActiveCerts[i].Description < u.ActiveCerts[j].Description })
-					sort.Slice(u.RevokedCerts, func(i, j int) bool { return u.RevokedCerts[i].Description < u.RevokedCerts[j].Description })
-					res.Certs = append(res.Certs, u)
-				}
-				sort.Slice(res.Certs, func(i, j int) bool { return res.Certs[i].Email < res.Certs[j].Email })
-				httputil.SendJSON(writer, http.StatusOK, &res)
-				return
-			}
+			listAllCerts(writer, req)
+			return
 		} else { // i.e. /certs/<something> -- means fetch a particular user
-			q := "select t.created, c.fingerprint, c.created, c.expires, c.desc, c.revoked from totp as t left join certs as c on t.email=c.email where t.email=?"
-			cxn := getDB()
+			q := "select t.created, c.fingerprint, c.created, c.expires, coalesce(c.desc, ''), coalesce(strftime('%Y-%m-%dT%H:%M:%SZ', c.revoked), ''), coalesce(strftime('%Y-%m-%dT%H:%M:%SZ', c.last_seen), ''), coalesce(c.expires <= datetime('now'), 0) from totp as t left join certs as c on t.email=c.email where t.email=?"
+			cxn := getReadDB()
 			defer cxn.Close()
-			if rows, err := cxn.Query(q, email); err != nil {
+			if rows, err := cxn.QueryContext(ctx, q, email); err != nil {
 				panic(err)
 			} else {
 				defer rows.Close()
 				res := struct {
-					Email, Created            string
-					ActiveCerts, RevokedCerts []cert
-				}{Email: email, ActiveCerts: []cert{}, RevokedCerts: []cert{}}
+					Email, Created                          string
+					ActiveCerts, ExpiredCerts, RevokedCerts []cert
+				}{Email: email, ActiveCerts: []cert{}, ExpiredCerts: []cert{}, RevokedCerts: []cert{}}
 				for rows.Next() {
 					c := cert{}
-					rows.Scan(&res.Created, &c.Fingerprint, &c.Created, &c.Expires, &c.Description, &c.Revoked)
+					var expired bool
+					rows.Scan(&res.Created, &c.Fingerprint, &c.Created, &c.Expires, &c.Description, &c.Revoked, &c.LastSeen, &expired)
 					if c.Fingerprint == "" {
 						// can happen if the user has TOTP and no certs, as a consequence of the left join; avoiding putting it in response
 						continue
 					}
-					if c.Revoked == "" {
-						res.ActiveCerts = append(res.ActiveCerts, c)
-					} else {
+					if c.Revoked != "" {
 						res.RevokedCerts = append(res.RevokedCerts, c)
+					} else if expired {
+						res.ExpiredCerts = append(res.ExpiredCerts, c)
+					} else {
+						res.ActiveCerts = append(res.ActiveCerts, c)
 					}
 				}
 				if res.Created == "" { // database can't not have this, so must mean no results
@@ -512,6 +2375,7 @@ func certsHandler(writer http.ResponseWriter, req *http.Request) {
 					return
 				}
 				sort.Slice(res.ActiveCerts, func(i, j int) bool { return res.ActiveCerts[i].Description < res.ActiveCerts[j].Description })
+				sort.Slice(res.ExpiredCerts, func(i, j int) bool { return res.ExpiredCerts[i].Description < res.ExpiredCerts[j].Description })
 				sort.Slice(res.RevokedCerts, func(i, j int) bool { return res.RevokedCerts[i].Description < res.RevokedCerts[j].Description })
 				httputil.SendJSON(writer, http.StatusOK, &res)
 				return
@@ -523,128 +2387,585 @@ func certsHandler(writer http.ResponseWriter, req *http.Request) {
 			httputil.SendJSON(writer, http.StatusBadRequest, struct{}{})
 			return
 		}
+		switch extractSegment(req.URL.Path, 3) {
+		case "sign":
+			signCSR(writer, req, email)
+			return
+		case "import":
+			importCert(writer, req, email)
+			return
+		}
 
-		reqBody := &struct{ Email, Description string }{}
-		if err := httputil.PopulateFromBody(reqBody, req); err != nil {
-			log.Warn(TAG, "missing or malformed request JSON", req.URL.Path)
-			httputil.SendJSON(writer, http.StatusBadRequest, struct{}{})
+		reqBody := &struct {
+			Email, Description string
+			KeyBits            int
+			Profile            string
+			KeyPassphrase      string
+		}{}
+		if errs := decodeStrictJSON(reqBody, req); errs != nil {
+			log.Warn(TAG, "missing or malformed request JSON", req.URL.Path, errs)
+			sendFieldErrors(writer, errs)
 			return
 		}
 
-		if email != reqBody.Email {
+		errs := fieldErrors{}
+		if reqBody.Email == "" {
+			errs["Email"] = "required"
+		} else if reqBody.Email, _ = normalizeEmail(reqBody.Email); email != reqBody.Email {
 			log.Warn(TAG, "mismatched URL/JSON request", req.URL.Path, email, reqBody.Email)
-			httputil.SendJSON(writer, http.StatusBadRequest, struct{}{})
-			return
+			errs["Email"] = "does not match the email in the URL"
 		}
-		if reqBody.Description == "" {
-			log.Warn(TAG, "JSON request missing description", req.URL.Path)
-			httputil.SendJSON(writer, http.StatusBadRequest, struct{}{})
+		s := loadSettings(ctx)
+		var problem string
+		if reqBody.Description, problem = normalizeCertDescription(s, email, reqBody.Description); problem != "" {
+			errs["Description"] = problem
+		}
+		if reqBody.KeyBits != 0 && !isValidKeyBits(reqBody.KeyBits) {
+			errs["KeyBits"] = fmt.Sprintf("must be one of %v", validKeyBits)
+		}
+		if n := len(reqBody.KeyPassphrase); n > 0 && (n < minKeyPassphraseLength || n > maxKeyPassphraseLength) {
+			errs["KeyPassphrase"] = fmt.Sprintf("must be from %d to %d bytes", minKeyPassphraseLength, maxKeyPassphraseLength)
+		} else if n > 0 && s.RequireApproval {
+			// it would have to be stored until the request is approved
+			errs["KeyPassphrase"] = "not supported when RequireApproval is set"
+		}
+		if reqBody.Profile != "" && ovpnProfiles[reqBody.Profile] == nil {
+			errs["Profile"] = "unknown profile"
+		}
+		if len(errs) > 0 {
+			log.Warn(TAG, "invalid JSON request", req.URL.Path, errs)
+			sendFieldErrors(writer, errs)
 			return
 		}
 
-		var err error
-		var key, crt, cacrt, tlsauth []byte // various keymatter to be embedded in the .ovpn file
-		var fp string
-		var t *template.Template // .ovpn template
-		var ovpn bytes.Buffer
-		var rows *sql.Rows
-
-		// check that user exists
-		q := "select email from totp where email=?"
-		cxn := getDB()
-		defer cxn.Close()
-		if rows, err = cxn.Query(q, email); err != nil {
-			panic(err)
+		profile := profileForEmail(s, email, reqBody.Profile)
+		tmpl := ovpnTemplate
+		if profile != "" {
+			tmpl = ovpnProfiles[profile]
 		}
-		defer rows.Close()
-		if !rows.Next() {
-			// can't issue a cert for an unrecorded user
-			log.Warn(TAG, "attempt to issue cert for nonexistent user", email, q)
-			httputil.SendJSON(writer, http.StatusNotFound, struct{}{})
+
+		if s.RequireApproval {
+			requestCert(writer, req, s, email, reqBody.Description, reqBody.KeyBits, profile)
+			return
+		}
+
+		if req.URL.Query().Get("async") == "true" {
+			if !checkIssuable(writer, req, s, email, reqBody.Description) {
+				return
+			}
+			id := enqueueCertJob(req, s, email, reqBody.Description, reqBody.KeyBits, reqBody.KeyPassphrase, profile, tmpl)
+			if id == "" {
+				log.Error(TAG, "refused cert issuance; job queue is full", email)
+				httputil.SendJSON(writer, http.StatusServiceUnavailable, struct{ Error string }{"too many certificates are being issued; try again later"})
+				return
+			}
+			log.Status(TAG, fmt.Sprintf("queued cert job %s for '%s'", id, email), requestID(req))
+			httputil.SendJSON(writer, http.StatusAccepted, struct{ JobID string }{id})
 			return
 		}
-		if rows.Next() {
-			// shouldn't be possible, if database constraints are correct
-			panic("multiple users returned by database")
+
+		// a retried request with the same Idempotency-Key gets the cert its first attempt issued
+		idemKey := req.Header.Get("Idempotency-Key")
+		if idemKey != "" {
+			fp, ovpn, claimed := claimIdempotencyKey(email, idemKey)
+			if !claimed {
+				if ovpn == nil {
+					log.Warn(TAG, "idempotency key in use by a request in progress", email, idemKey)
+					httputil.SendJSON(writer, http.StatusConflict, struct{}{})
+				} else if !replayable(req.Context(), fp) {
+					forgetIdempotencyKey(email, idemKey)
+					log.Warn(TAG, "refused replay of a revoked certificate, or one of an archived user", email, fp)
+					httputil.SendJSON(writer, http.StatusConflict, struct{ Error string }{"the certificate issued for this key has since been revoked"})
+				} else {
+					log.Status(TAG, fmt.Sprintf("replayed certificate '%s' for '%s'", fp, email))
+					sendOVPN(writer, req, http.StatusOK, email, fp, ovpn)
+				}
+				return
+			}
+			defer releaseIdempotencyKey(email, idemKey) // no-op if issuance completes
 		}
 
-		// generate a serial number for the new cert
-		serial := &big.Int{}
-		if _, ok := serial.SetString(makeCertSerial(), 16); !ok {
-			panic("unable to create serial number for new cert")
+		if !checkIssuable(writer, req, s, email, reqBody.Description) {
+			return
 		}
 
-		// load up the CA signing cert & keys
-		authority := &ca.Authority{}
-		if err = authority.LoadFromPEM(cfg.CACertFile, cfg.CAKeyFile, cfg.CAKeyPassword); err != nil {
-			panic(err)
+		fp, ovpn, genTime, err := issueCert(req, s, email, reqBody.Description, reqBody.KeyBits, reqBody.KeyPassphrase, tmpl)
+		if err != nil {
+			// i.e. the template is broken; better to fail now than hand the user a useless profile
+			log.Error(TAG, "rendered .ovpn is malformed; check the template", profile, err)
+			httputil.SendJSON(writer, http.StatusInternalServerError, struct{ Error string }{"internal"})
+			return
 		}
 
-		s := loadSettings()
+		// transmit to client
+		log.Status(TAG, fmt.Sprintf("issued new certificate '%s' for '%s'", fp, email), requestID(req))
 
-		// generate a signed cert & private key (never written to disk)
-		subject := &pkix.Name{
-			Organization: []string{s.ServiceName},
-			CommonName:   email,
+		writer.Header().Set("X-Gen-Time-Ms", strconv.FormatInt(int64(genTime/time.Millisecond), 10))
+		if idemKey != "" {
+			completeIdempotencyKey(email, idemKey, fp, ovpn)
 		}
-		var kp *ca.Keypair
-		if kp, err = authority.CreateClientKeypair(s.IssuedCertDuration, subject, serial, 4096); err != nil {
+		sendOVPN(writer, req, http.StatusCreated, email, fp, ovpn)
+	default:
+		panic("API method sentinel misconfiguration")
+	}
+}
+
+// discardResponse is an http.ResponseWriter that keeps only the status, for calling helpers such as
+// checkIssuable that report refusals as HTTP responses from code that reports them differently,
+// e.g. SCEP enrollment or queued cert jobs
+type discardResponse struct {
+	header http.Header
+	status int
+}
+
+func (d *discardResponse) Header() http.Header {
+	if d.header == nil {
+		d.header = http.Header{}
+	}
+	return d.header
+}
+
+func (d *discardResponse) Write(b []byte) (int, error) { return len(b), nil }
+
+func (d *discardResponse) WriteHeader(status int) { d.status = status }
+
+// checkIssuable indicates whether email may be issued a new cert described as desc: the user must
+// exist and not be archived, be under their cert limit (their own if set, else the ClientLimit
+// setting; 0 is unlimited), and, if UniqueDescriptions is set, have no active cert with the same
+// description, and have been issued fewer than IssuanceCooldownCerts certs in the last
+// IssuanceCooldownMinutes, if nonzero; and there must be fewer active certs overall than the
+// GlobalCertLimit setting, if nonzero. If not, it responds to the request accordingly and returns
+// false.
+func checkIssuable(writer http.ResponseWriter, req *http.Request, s *settings, email, desc string) bool {
+	TAG := "checkIssuable"
+	ctx := req.Context()
+
+	// check that user exists, and fetch any per-user cert limit
+	var userLimit sql.NullInt64
+	q := "select client_limit from totp where email=? and archived is null"
+	cxn := getDB()
+	defer cxn.Close()
+	rows, err := cxn.QueryContext(ctx, q, email)
+	if err != nil {
+		panic(err)
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		// can't issue a cert for an unrecorded user
+		log.Warn(TAG, "attempt to issue cert for nonexistent user", email, q)
+		httputil.SendJSON(writer, http.StatusNotFound, struct{}{})
+		return false
+	}
+	rows.Scan(&userLimit)
+	if rows.Next() {
+		// shouldn't be possible, if database constraints are correct
+		panic("multiple users returned by database")
+	}
+	rows.Close()
 
+	limit := int64(s.ClientLimit)
+	if userLimit.Valid {
+		limit = userLimit.Int64
+	}
+	if limit > 0 {
+		var active int64
+		q = "select count(*) from certs where email=? and revoked is null and expires > datetime('now')"
+		if err = cxn.QueryRowContext(ctx, q, email).Scan(&active); err != nil {
 			panic(err)
 		}
+		if active >= limit {
+			// not a 401, which would be indistinguishable from a bad API key
+			log.Warn(TAG, "attempt to issue cert beyond limit", email, active, limit)
+			errs := fieldErrors{"ClientLimit": fmt.Sprintf("the user already has %d active certificates, their limit", active)}
+			httputil.SendJSON(writer, http.StatusForbidden, struct{ Errors fieldErrors }{errs})
+			return false
+		}
+	}
 
-		if fp, err = kp.CertFingerprint(); err != nil {
+	// descriptions are how admins tell devices apart, so optionally disallow active duplicates
+	if s.UniqueDescriptions {
+		var dupes int
+		q = "select count(*) from certs where email=? and desc=? and revoked is null"
+		if err = cxn.QueryRowContext(ctx, q, email, desc).Scan(&dupes); err != nil {
 			panic(err)
 		}
+		if dupes > 0 {
+			log.Warn(TAG, "attempt to issue cert with duplicate description", email, desc)
+			httputil.SendJSON(writer, http.StatusConflict, struct{}{})
+			return false
+		}
+	}
 
-		// gather all the keymatter in PEM
-		if crt, key, err = kp.ToPEM("", false); err != nil { // client cert & key
+	// a stolen API secret could otherwise mint certs for one user as fast as keys can be generated
+	if s.IssuanceCooldownCerts > 0 {
+		var recent, retryAfter int
+		window := fmt.Sprintf("-%d minutes", s.IssuanceCooldownMinutes)
+		q = `select count(*), coalesce(max(0, strftime('%s', min(ts)) - strftime('%s', 'now', ?)), 0)
+		     from events where event='certificate issued' and email=? and ts > datetime('now', ?)`
+		if err = cxn.QueryRowContext(ctx, q, window, email, window).Scan(&recent, &retryAfter); err != nil {
 			panic(err)
 		}
-		if tlsauth, err = ioutil.ReadFile(cfg.TLSAuthFile); err != nil { // tls-auth shared secret
-			panic(err)
+		if recent >= s.IssuanceCooldownCerts {
+			log.Warn(TAG, "refused cert issuance; cooldown in effect", email, recent, s.IssuanceCooldownMinutes)
+			// in the body too, for clients (like Bifröst's) that don't expose response headers
+			writer.Header().Set("Retry-After", strconv.Itoa(retryAfter+1))
+			httputil.SendJSON(writer, http.StatusTooManyRequests, struct {
+				Error      string
+				RetryAfter int
+			}{"too many certificates issued recently; try again later", retryAfter + 1})
+			return false
 		}
-		cacrt = authority.ExportCertChain() // CA cert
+	}
 
-		// construct the .ovpn from template
-		if t, err = template.ParseFiles(cfg.OVPNTemplateFile); err != nil {
+	// the global ceiling bounds CA load and CRL size, so it's a capacity problem, not the user's
+	if s.GlobalCertLimit > 0 {
+		var active int
+		q = "select count(*) from certs where revoked is null and expires > datetime('now')"
+		if err = cxn.QueryRowContext(ctx, q).Scan(&active); err != nil {
 			panic(err)
 		}
-		if err = t.Execute(&ovpn, struct{ CA, Cert, Key, TLSAuth string }{string(cacrt), string(crt), string(key), string(tlsauth)}); err != nil {
-			panic(err)
+		if active >= s.GlobalCertLimit {
+			// Bifröst tells this apart from other 503s (e.g. maintenance mode) by Error, so keep it in
+			// step with heimdallCapacityMessage there
+			log.Error(TAG, "refused cert issuance; GlobalCertLimit reached", email, active, s.GlobalCertLimit)
+			httputil.SendJSON(writer, http.StatusServiceUnavailable, struct{ Error string }{"the system is at its limit of active certificates"})
+			return false
 		}
+	}
 
-		// save a record of the cert to the database
-		q = fmt.Sprintf("insert into certs (email, fingerprint, desc, expires) values (?, ?, ?, date('now','+%d day'))", s.IssuedCertDuration)
-		writeDatabaseByQuery(q, email, fp, reqBody.Description)
+	return true
+}
 
-		// record the event
-		q = "insert into events (event, email, value) values (?, ?, ?)"
-		writeDatabaseByQuery(q, "certificate issued", email, fmt.Sprintf("%s - %s", fp, reqBody.Description))
+// profileForEmail returns the OVPNTemplateProfiles profile for email's .ovpn: explicit if set, else
+// the DomainProfiles entry for email's domain, else "" (i.e. OVPNTemplateFile). A domain's profile
+// that's no longer configured is ignored, with a warning.
+func profileForEmail(s *settings, email, explicit string) string {
+	if explicit != "" {
+		return explicit
+	}
+	domain := strings.ToLower(email[strings.LastIndex(email, "@")+1:])
+	profile, ok := s.DomainProfiles[domain]
+	if !ok {
+		return ""
+	}
+	if ovpnProfiles[profile] == nil {
+		log.Warn("profileForEmail", "DomainProfiles names a profile no longer configured", domain, profile)
+		return ""
+	}
+	return profile
+}
 
-		// transmit to client
-		log.Status(TAG, fmt.Sprintf("issued new certificate '%s' for '%s'", fp, email))
+// issueCert generates and signs a new cert and key for email, renders them into a .ovpn file from
+// tmpl, and records the cert and a "certificate issued" event. keyBits of 0 means the
+// IssuedCertKeyBits setting. If keyPassphrase is set, the key in the .ovpn is encrypted with it.
+// Returns an error, having recorded nothing, only if the rendered .ovpn is malformed. The key
+// itself is never written anywhere but the returned .ovpn.
+func issueCert(req *http.Request, s *settings, email, desc string, keyBits int, keyPassphrase string, tmpl *template.Template) (fp string, ovpn []byte, genTime time.Duration, err error) {
+	cert, ovpn, genTime, err := renderCert(req, s, email, keyBits, keyPassphrase, tmpl)
+	if err != nil {
+		return "", nil, 0, err
+	}
+	recordIssuedCert(req, email, desc, cert)
+	return certFingerprint(cert), ovpn, genTime, nil
+}
 
-		dataURL := base64.StdEncoding.EncodeToString(ovpn.Bytes())
-		dataURL = fmt.Sprintf("data:image/ovpn;base64,%s", dataURL)
-		httputil.SendJSON(writer, http.StatusCreated, struct{ OVPNDataURL string }{dataURL})
-	default:
-		panic("API method sentinel misconfiguration")
+// renderCert generates and signs a new cert and key for email and renders them into a .ovpn file
+// from tmpl, as for issueCert, but records nothing; the caller must record the cert before handing
+// out the .ovpn.
+func renderCert(req *http.Request, s *settings, email string, keyBits int, keyPassphrase string, tmpl *template.Template) (cert *x509.Certificate, ovpn []byte, genTime time.Duration, err error) {
+	var key, crt, cacrt, tlsauth []byte // various keymatter to be embedded in the .ovpn file
+
+	serial := newCertSerial(req.Context(), s)
+
+	// load up the CA signing cert & keys
+	signer := loadSigningSigner(s)
+
+	// generate a signed cert & private key (never written to disk)
+	if keyBits == 0 {
+		keyBits = s.IssuedCertKeyBits
+	}
+	var kp *clientKeypair
+	backdate := time.Duration(s.CertBackdateMinutes) * time.Minute
+	genStart := time.Now()
+	if kp, err = signer.createClientKeypair(s.IssuedCertDuration, certSubject(s, email), serial, keyBits, backdate); err != nil {
+		panic(err)
+	}
+	genTime = time.Since(genStart)
+	fp := kp.fingerprint()
+
+	// gather all the keymatter in PEM
+	if crt, key, err = kp.toPEM(keyPassphrase); err != nil { // client cert & key
+		panic(err)
+	}
+	if tlsauth, err = ioutil.ReadFile(cfg.TLSAuthFile); err != nil { // tls-auth shared secret
+		panic(err)
+	}
+	cacrt = exportTrustedCertChains() // CA cert(s)
+
+	// construct the .ovpn from template
+	data := &ovpnTemplateData{
+		CA:          string(cacrt),
+		Cert:        string(crt),
+		Key:         string(key),
+		TLSAuth:     string(tlsauth),
+		ServiceName: s.ServiceName,
+		Email:       email,
+		Expires:     kp.Cert.NotAfter.Format("2006-01-02"),
+		Fingerprint: fp,
+		Extra:       s.TemplateExtra,
+	}
+	var buf bytes.Buffer
+	if err = tmpl.Execute(&buf, data); err != nil {
+		panic(err)
+	}
+	if err = validateOVPN(buf.Bytes()); err != nil {
+		return nil, nil, 0, err
+	}
+
+	return kp.Cert, buf.Bytes(), genTime, nil
+}
+
+// newCertSerial returns a serial number for a new cert, as the SerialMode setting directs
+func newCertSerial(ctx context.Context, s *settings) *big.Int {
+	serialHex := makeCertSerial()
+	if s.SerialMode == "sequential" {
+		serialHex = nextSequentialSerial(ctx)
+	}
+	serial := &big.Int{}
+	if _, ok := serial.SetString(serialHex, 16); !ok {
+		panic("unable to create serial number for new cert")
+	}
+	return serial
+}
+
+// certSubject returns the subject of a new cert for email: the ServiceName as organization, plus
+// the OrgUnit, Country, and Locality settings if set
+func certSubject(s *settings, email string) *pkix.Name {
+	subject := &pkix.Name{
+		Organization: []string{s.ServiceName},
+		CommonName:   email,
+	}
+	if s.OrgUnit != "" {
+		subject.OrganizationalUnit = []string{s.OrgUnit}
+	}
+	if s.Country != "" {
+		subject.Country = []string{s.Country}
+	}
+	if s.Locality != "" {
+		subject.Locality = []string{s.Locality}
+	}
+	return subject
+}
+
+// recordIssuedCert saves a record of a newly issued cert and records a "certificate issued" event,
+// in one transaction, so that a deadline that runs out (e.g. after slow key generation) can't leave
+// one without the other; see recordIssuedCertTx.
+func recordIssuedCert(req *http.Request, email, desc string, cert *x509.Certificate) {
+	cxn := getDB()
+	defer cxn.Close()
+	tx, err := cxn.BeginTx(req.Context(), nil)
+	if err != nil {
+		panic(err)
+	}
+	defer tx.Rollback()
+	if err := recordIssuedCertTx(tx, req, email, desc, cert); err != nil {
+		panic(err)
+	}
+	if err := tx.Commit(); err != nil {
+		panic(err)
+	}
+}
+
+// recordIssuedCertTx is recordIssuedCert within a caller's transaction, for callers with other
+// writes that must go with it. The event's value is "<fingerprint> - serial <hex serial> -
+// <description>" so that it can be matched with CRL entries. Expiry is taken from the cert so the
+// two agree.
+func recordIssuedCertTx(tx *sql.Tx, req *http.Request, email, desc string, cert *x509.Certificate) error {
+	fp := certFingerprint(cert)
+	serial := fmt.Sprintf("%x", cert.SerialNumber)
+	crt := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	q := "insert into certs (email, fingerprint, desc, serial, expires, pem) values (?, ?, ?, ?, ?, ?)"
+	expires := cert.NotAfter.Format("2006-01-02 15:04:05")
+	if _, err := tx.ExecContext(req.Context(), q, email, fp, desc, serial, expires, string(crt)); err != nil {
+		return err
 	}
+	return recordEventTx(tx, req, "certificate issued", email, fmt.Sprintf("%s - serial %s - %s", fp, serial, desc))
+}
+
+// minKeyPassphraseLength and maxKeyPassphraseLength bound a KeyPassphrase for an issued key, as
+// OpenSSL does: it refuses shorter passphrases, and truncates longer ones at its prompt.
+const (
+	minKeyPassphraseLength = 4
+	maxKeyPassphraseLength = 1023
+)
+
+// maxDescriptionLength is the most characters a cert description may have, after normalization
+const maxDescriptionLength = 200
+
+// validDescription matches the characters permitted in a cert description: letters, digits, spaces,
+// and common punctuation, including everything in an email address or a date. Descriptions appear
+// in logs, events, and the UI, so control characters, quotes, and markup are excluded.
+var validDescription = regexp.MustCompile(`^[\p{L}\p{N} .,:;_@#&+()/'’-]+$`)
+
+// normalizeCertDescription trims raw and collapses runs of whitespace within it, substituting the
+// expanded DefaultCertDescription if it's then blank and RequireDescription is off. It returns the
+// description to store, and "" or the rule the description breaks.
+func normalizeCertDescription(s *settings, email, raw string) (desc, problem string) {
+	desc = strings.Join(strings.Fields(raw), " ")
+	if desc == "" {
+		if s.RequireDescription {
+			return "", "required"
+		}
+		desc = strings.Join(strings.Fields(expandCertDescription(s.DefaultCertDescription, email)), " ")
+	}
+	if n := utf8.RuneCountInString(desc); n < s.MinDescriptionLength {
+		return desc, fmt.Sprintf("must be at least %d characters", s.MinDescriptionLength)
+	} else if n > maxDescriptionLength {
+		return desc, fmt.Sprintf("must be at most %d characters", maxDescriptionLength)
+	}
+	if !validDescription.MatchString(desc) {
+		return desc, "may contain only letters, digits, spaces, and . , : ; _ @ # & + ( ) / ' -"
+	}
+	return desc, ""
+}
+
+// expandCertDescription fills in the DefaultCertDescription template tmpl for a cert for email.
+// "{email}" is replaced with the email, and "{date}" with today's date, as YYYY-MM-DD.
+func expandCertDescription(tmpl, email string) string {
+	return strings.NewReplacer("{email}", email, "{date}", time.Now().Format("2006-01-02")).Replace(tmpl)
+}
+
+// ovpnMIMEType is the media type of .ovpn files, as OpenVPN clients register it
+const ovpnMIMEType = "application/x-openvpn-profile"
+
+// ovpnDataURL encodes a .ovpn file as the data: URL the API returns it as
+func ovpnDataURL(ovpn []byte) string {
+	return fmt.Sprintf("data:%s;base64,%s", ovpnMIMEType, base64.StdEncoding.EncodeToString(ovpn))
+}
+
+// sendOVPN responds with a newly issued .ovpn for email: as {OVPNDataURL: ""}, or if the request
+// has the query parameter "?download=true", as the file itself, named for the email and fp
+func sendOVPN(writer http.ResponseWriter, req *http.Request, status int, email, fp string, ovpn []byte) {
+	if req.URL.Query().Get("download") != "true" {
+		httputil.SendJSON(writer, status, struct{ OVPNDataURL string }{ovpnDataURL(ovpn)})
+		return
+	}
+	filename := fmt.Sprintf("%s-%s.ovpn", email, fp)
+	writer.Header().Set("Content-Type", ovpnMIMEType)
+	writer.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	writer.Header().Set("Cache-Control", "no-store") // it holds the private key
+	writer.WriteHeader(status)
+	writer.Write(ovpn)
+}
+
+// maxExpiringDays caps the window accepted by GET /certs/expiring
+const maxExpiringDays = 3650
+
+func expiringCertsHandler(writer http.ResponseWriter, req *http.Request) {
+	// GET /certs/expiring?days=30 -- list active certs expiring within the next `days` days
+	//   I: None
+	//   O: {Days: 30, Users: [{Email: "", Certs: [{Fingerprint: "", Description: "", Expires: "", DaysRemaining: 0}]}]}
+	//   200: the object above; 400 (bad request): days is not a whole number from 0 to maxExpiringDays
+	//   days defaults to the ExpiringSoonDays setting. Users are ordered by their soonest-expiring
+	//   cert, and each user's certs by expiry. DaysRemaining counts calendar days from today, so a
+	//   cert expiring today has 0.
+	// Non-GET: 405 (method not allowed)
+
+	TAG := "/certs/expiring"
+	ctx := req.Context()
+
+	days := loadSettings(ctx).ExpiringSoonDays
+	if raw := req.URL.Query().Get("days"); raw != "" {
+		tmp, err := strconv.Atoi(raw)
+		if err != nil || tmp < 0 || tmp > maxExpiringDays {
+			log.Warn(TAG, "malformed days", raw)
+			sendFieldErrors(writer, fieldErrors{"days": fmt.Sprintf("must be a whole number from 0 to %d", maxExpiringDays)})
+			return
+		}
+		days = tmp
+	}
+
+	type cert struct {
+		Fingerprint, Description, Expires string
+		DaysRemaining                     int
+	}
+	type user struct {
+		Email string
+		Certs []*cert
+	}
+	res := struct {
+		Days  int
+		Users []*user
+	}{days, []*user{}}
+
+	q := `select email, fingerprint, coalesce(desc, ''), expires,
+	        cast(julianday(date(expires)) - julianday(date('now')) as integer)
+	      from certs
+	      where revoked is null and date(expires) >= date('now') and date(expires) <= date('now', ?)
+	      order by expires, email`
+	cxn := getReadDB()
+	defer cxn.Close()
+	rows, err := cxn.QueryContext(ctx, q, fmt.Sprintf("+%d day", days))
+	if err != nil {
+		panic(err)
+	}
+	defer rows.Close()
+	users := make(map[string]*user)
+	for rows.Next() {
+		var email string
+		c := &cert{}
+		if err := rows.Scan(&email, &c.Fingerprint, &c.Description, &c.Expires, &c.DaysRemaining); err != nil {
+			panic(err)
+		}
+		// rows arrive soonest first, so users are appended in order of their soonest cert
+		u, ok := users[email]
+		if !ok {
+			u = &user{Email: email, Certs: []*cert{}}
+			users[email] = u
+			res.Users = append(res.Users, u)
+		}
+		u.Certs = append(u.Certs, c)
+	}
+
+	httputil.SendJSON(writer, http.StatusOK, &res)
 }
 
 func certHandler(writer http.ResponseWriter, req *http.Request) {
 	// GET /cert/<fingerprint> -- fetch details for the indicated cert
 	//   I: None
-	//   O: {Email: "", Fingerprint: "", Created: "", Expires: "", Revoked: "", Description: ""}
+	//   O: {Email: "", Fingerprint: "", Created: "", Expires: "", Revoked: "", RevocationReason: "", Description: "", LastSeen: "", Imported: false}
 	//   200: the object above; 404: no such fingerprint
-	// DELETE /cert/<fingerprint> -- revoke the indicated cert
+	//   LastSeen is "" if the cert has never been reported connected (see below.) Imported is true
+	//   for certs recorded by POST /certs/<email>/import rather than issued by Heimdall.
+	// GET /cert/<fingerprint>/pem, GET /cert/<fingerprint>/der -- fetch the issued cert itself
+	//   I: None
+	//   O: the certificate (but never its key), as application/x-pem-file or application/pkix-cert
+	//   200: the cert; 404: no such fingerprint, or the cert was issued before certs were stored
+	// POST /cert/<fingerprint>/seen -- note that the cert is connected to the VPN now
 	//   I: None
-	//   O: {Email: "", Fingerprint: "", Created: "", Expires: "", Revoked: "", Description: ""}
-	//   200: the cert was revoked; 404: no such fingerprint; 400: malformed fingerprint
-	// Non-GET/DELETE: 409 (bad method)
+	//   O: {}
+	//   200: LastSeen updated; 404: no such fingerprint
+	//   For a script polling the OpenVPN status log; no event is recorded, as it'd flood the log.
+	// PATCH /cert/<fingerprint> -- rename a cert, e.g. to fix a typo, without reissuing it
+	//   I: {Description: ""}
+	//   O: {Fingerprint: "", Description: ""}
+	//   200: renamed; 400 (bad request): missing or malformed description, with body
+	//   {Errors: {Description: "problem"}}; 404: no such fingerprint; 409 (conflict): the cert is
+	//   revoked, or UniqueDescriptions is set and the user has another active cert with this
+	//   description, with body {Error: "problem"}
+	//   The description is normalized and checked as for POST /certs/<email>, and a "cert renamed"
+	//   event records the old and new descriptions.
+	// DELETE /cert/<fingerprint> -- revoke the indicated cert
+	//   I: {Reason: "key-compromise"} (optional)
+	//   O: {}
+	//   200: the cert was revoked; 404: no such fingerprint; 400: malformed fingerprint, or
+	//   unknown reason, with body {Errors: {Reason: "problem"}}
+	//   Reason is one of the RFC 5280 CRLReason names in revocationReasons, e.g. "key-compromise",
+	//   "superseded", or "cessation-of-operation"; if omitted, no reason is recorded.
+	// Non-GET/POST/PATCH/DELETE: 405 (method not allowed)
 
 	TAG := "/cert/"
+	ctx := req.Context()
 
 	fp := extractSegment(req.URL.Path, 2)
 	if fp == "" {
@@ -655,10 +2976,14 @@ func certHandler(writer http.ResponseWriter, req *http.Request) {
 
 	switch req.Method {
 	case "GET":
-		q := "select email, fingerprint, created, expires, revoked, desc from certs where fingerprint=?"
-		cxn := getDB()
+		if format := extractSegment(req.URL.Path, 3); format != "" {
+			sendCertBody(writer, req, fp, format)
+			return
+		}
+		q := "select email, fingerprint, created, expires, coalesce(strftime('%Y-%m-%dT%H:%M:%SZ', revoked), ''), revocation_reason, coalesce(desc, ''), coalesce(strftime('%Y-%m-%dT%H:%M:%SZ', last_seen), ''), imported from certs where fingerprint=?"
+		cxn := getReadDB()
 		defer cxn.Close()
-		if rows, err := cxn.Query(q, fp); err != nil {
+		if rows, err := cxn.QueryContext(ctx, q, fp); err != nil {
 			panic(err)
 		} else {
 			defer rows.Close()
@@ -667,22 +2992,64 @@ func certHandler(writer http.ResponseWriter, req *http.Request) {
 				httputil.SendJSON(writer, http.StatusNotFound, struct{}{})
 				return
 			}
-			res := struct{ Email, Fingerprint, Created, Expires, Revoked, Description string }{}
-			rows.Scan(&res.Email, &res.Fingerprint, &res.Created, &res.Expires, &res.Revoked, &res.Description)
+			res := struct {
+				Email, Fingerprint, Created, Expires, Revoked, RevocationReason, Description, LastSeen string
+				Imported                                                                               bool
+			}{}
+			rows.Scan(&res.Email, &res.Fingerprint, &res.Created, &res.Expires, &res.Revoked, &res.RevocationReason, &res.Description, &res.LastSeen, &res.Imported)
 			if rows.Next() {
 				log.Error(TAG, "multiple results for fingerprint", fp)
 				httputil.SendJSON(writer, http.StatusInternalServerError, struct{}{})
 				return
 			}
-			httputil.SendJSON(writer, http.StatusOK, &res)
+			httputil.SendJSON(writer, http.StatusOK, &res)
+		}
+
+	case "POST":
+		if extractSegment(req.URL.Path, 3) != "seen" {
+			log.Warn(TAG, "unknown cert action", req.URL.Path)
+			httputil.SendJSON(writer, http.StatusNotFound, struct{}{})
+			return
+		}
+		cxn := getDB()
+		defer cxn.Close()
+		res, err := cxn.ExecContext(ctx, "update certs set last_seen=datetime('now') where fingerprint=?", fp)
+		if err != nil {
+			panic(err)
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			panic(err)
+		} else if n == 0 {
+			log.Warn(TAG, "seen report for nonexistent cert", fp)
+			httputil.SendJSON(writer, http.StatusNotFound, struct{}{})
+			return
+		}
+		log.Debug(TAG, "cert seen", fp)
+		httputil.SendJSON(writer, http.StatusOK, struct{}{})
+
+	case "PATCH":
+		renameCert(writer, req, fp)
+
+	case "DELETE":
+		reqBody := &struct{ Reason string }{}
+		if req.ContentLength != 0 {
+			if errs := decodeStrictJSON(reqBody, req); errs != nil {
+				log.Warn(TAG, "malformed request JSON", req.URL.Path, errs)
+				sendFieldErrors(writer, errs)
+				return
+			}
+		}
+		if _, ok := revocationReasons[reqBody.Reason]; reqBody.Reason != "" && !ok {
+			log.Warn(TAG, "unknown revocation reason", req.URL.Path, reqBody.Reason)
+			sendFieldErrors(writer, fieldErrors{"Reason": "unknown revocation reason"})
+			return
 		}
 
-	case "DELETE":
 		var email string
 		q := "select email from certs where fingerprint=?"
 		cxn := getDB()
 		defer cxn.Close()
-		if rows, err := cxn.Query(q, fp); err != nil {
+		if rows, err := cxn.QueryContext(ctx, q, fp); err != nil {
 			panic(err)
 		} else {
 			if !rows.Next() {
@@ -694,12 +3061,16 @@ func certHandler(writer http.ResponseWriter, req *http.Request) {
 			rows.Close() // must manually close so that writes below work
 		}
 		//cxn.Close()
-		q = "update certs set revoked=datetime('now') where fingerprint=?"
-		writeDatabaseByQuery(q, fp)
+		q = "update certs set revoked=datetime('now'), revocation_reason=? where fingerprint=?"
+		writeDatabaseByQuery(ctx, q, reqBody.Reason, fp)
+		resetOCSPCache()
 
 		// record the event
-		q = "insert into events (event, email, value) values (?, ?, ?)"
-		writeDatabaseByQuery(q, "certificate revoked", email, fp)
+		value := fp
+		if reqBody.Reason != "" {
+			value = fmt.Sprintf("%s - %s", fp, reqBody.Reason)
+		}
+		recordEvent(req, "certificate revoked", email, value)
 
 		log.Status(TAG, fmt.Sprintf("revoked certificate '%s'", fp))
 		httputil.SendJSON(writer, http.StatusOK, struct{}{})
@@ -709,49 +3080,159 @@ func certHandler(writer http.ResponseWriter, req *http.Request) {
 	}
 }
 
+// renameCert handles PATCH /cert/<fingerprint>; see certHandler
+func renameCert(writer http.ResponseWriter, req *http.Request, fp string) {
+	TAG := "/cert/"
+	ctx := req.Context()
+
+	reqBody := &struct{ Description string }{}
+	if errs := decodeStrictJSON(reqBody, req); errs != nil {
+		log.Warn(TAG, "malformed request JSON", req.URL.Path, errs)
+		sendFieldErrors(writer, errs)
+		return
+	}
+	// unlike at issuance, a blank description is never replaced with the default
+	s := loadSettings(ctx)
+	desc, problem := "", "required"
+	if strings.TrimSpace(reqBody.Description) != "" {
+		desc, problem = normalizeCertDescription(s, "", reqBody.Description)
+	}
+	if problem != "" {
+		log.Warn(TAG, "invalid description for rename", fp, problem)
+		sendFieldErrors(writer, fieldErrors{"Description": problem})
+		return
+	}
+
+	var email, oldDesc string
+	var revoked bool
+	q := "select email, coalesce(desc, ''), revoked is not null from certs where fingerprint=?"
+	cxn := getDB()
+	defer cxn.Close()
+	err := cxn.QueryRowContext(ctx, q, fp).Scan(&email, &oldDesc, &revoked)
+	if err == sql.ErrNoRows {
+		log.Warn(TAG, "attempt to rename nonexistent cert", fp)
+		httputil.SendJSON(writer, http.StatusNotFound, struct{}{})
+		return
+	} else if err != nil {
+		panic(err)
+	}
+	if revoked {
+		log.Warn(TAG, "attempt to rename revoked cert", fp)
+		httputil.SendJSON(writer, http.StatusConflict, struct{ Error string }{"certificate is revoked"})
+		return
+	}
+	if s.UniqueDescriptions {
+		var dupes int
+		q = "select count(*) from certs where email=? and desc=? and revoked is null and fingerprint<>?"
+		if err = cxn.QueryRowContext(ctx, q, email, desc, fp).Scan(&dupes); err != nil {
+			panic(err)
+		}
+		if dupes > 0 {
+			log.Warn(TAG, "attempt to rename cert to duplicate description", fp, desc)
+			httputil.SendJSON(writer, http.StatusConflict, struct{ Error string }{"another active certificate has this description"})
+			return
+		}
+	}
+	cxn.Close()
+
+	writeDatabaseByQuery(ctx, "update certs set desc=? where fingerprint=? and revoked is null", desc, fp)
+	recordEvent(req, "cert renamed", email, fmt.Sprintf("%s - %s -> %s", fp, oldDesc, desc))
+
+	log.Status(TAG, fmt.Sprintf("renamed certificate '%s'", fp))
+	httputil.SendJSON(writer, http.StatusOK, struct{ Fingerprint, Description string }{fp, desc})
+}
+
+// sendCertBody handles GET /cert/<fingerprint>/<format>; see certHandler
+func sendCertBody(writer http.ResponseWriter, req *http.Request, fp, format string) {
+	TAG := "/cert/"
+
+	if format != "pem" && format != "der" {
+		log.Warn(TAG, "unknown cert format", req.URL.Path)
+		httputil.SendJSON(writer, http.StatusNotFound, struct{}{})
+		return
+	}
+
+	var certPEM string
+	cxn := getReadDB()
+	defer cxn.Close()
+	err := cxn.QueryRowContext(req.Context(), "select pem from certs where fingerprint=?", fp).Scan(&certPEM)
+	if err != nil && err != sql.ErrNoRows {
+		panic(err)
+	}
+	if err == sql.ErrNoRows || certPEM == "" {
+		log.Warn(TAG, "request for nonexistent or unstored cert", fp)
+		httputil.SendJSON(writer, http.StatusNotFound, struct{}{})
+		return
+	}
+
+	if format == "pem" {
+		writer.Header().Set("Content-Type", "application/x-pem-file")
+		writer.Write([]byte(certPEM))
+		return
+	}
+	block, _ := pem.Decode([]byte(certPEM))
+	if block == nil {
+		panic(fmt.Sprintf("stored PEM for '%s' is malformed", fp))
+	}
+	writer.Header().Set("Content-Type", "application/pkix-cert")
+	writer.Write(block.Bytes)
+}
+
 func eventsHandler(writer http.ResponseWriter, req *http.Request) {
 	// GET /events -- fetch events log
 	//   I: None
-	//   O: {Events: [{Event: "", Email: "", Value: "", Timestamp: ""}]}
+	//   O: {Events: [{Event: "", Email: "", Value: "", Timestamp: "", SourceIP: "", UserAgent: "", RequestID: "", Operator: ""}]}
 	//   200: the object above
 	// DELETE /events -- clear the log (e.g. as part of log extraction/rotation)
 	//   I: None
-	//   O: {Events: [{Event: "", Email: "", Value: "", Timestamp: ""}]}
-	//   200: the object above + the log was cleared
-	// Non-GET/DELETE: 409 (bad method)
+	//   O: {Events: [{Event: "", Email: "", Value: "", Timestamp: "", SourceIP: "", UserAgent: "", RequestID: "", Operator: ""}]}
+	//   200: the object above, which is every event that was cleared
+	//   The log is cleared and an "events log reset" event recorded in a single transaction, before
+	//   the response is sent.
+	// Non-GET/DELETE: 405 (method not allowed)
 	// Accepts a GET query parameter of "?before=" for pagination. Unless the value of this parameter
-	// is "all", it returns at most 25 results
+	// is "all", it returns at most 25 results. Otherwise before is an RFC 3339 timestamp, in UTC
+	// (e.g. "2018-06-01T12:00:00Z") or with an offset (e.g. "2018-06-01T08:00:00-04:00"); anything
+	// else is a 400 (bad request). The last event's Timestamp can be passed as is to fetch the next
+	// page.
 
-	TAG := "/events"
+	ctx := req.Context()
 
-	type event struct{ Event, Email, Value, Timestamp string }
 	events := []*event{}
 
+	if req.Method == "DELETE" {
+		clearEvents(writer, req)
+		return
+	}
+
 	if err := req.ParseForm(); err != nil {
 		panic(err)
 	}
 	before := req.FormValue("before")
 
-	cxn := getDB()
+	cxn := getReadDB()
 	defer cxn.Close()
 	var rows *sql.Rows
 	var err error
 	if before == "" {
-		q := "select event, email, value, ts from events order by ts desc limit 25"
-		rows, err = cxn.Query(q)
+		q := "select event, email, value, ts, source_ip, user_agent, request_id, operator from events order by ts desc limit 25"
+		rows, err = cxn.QueryContext(ctx, q)
 	} else {
 		if before == "all" {
-			q := "select event, email, value, ts from events order by ts desc"
-			rows, err = cxn.Query(q)
+			q := "select event, email, value, ts, source_ip, user_agent, request_id, operator from events order by ts desc"
+			rows, err = cxn.QueryContext(ctx, q)
 		} else {
-			t, err := time.Parse("2006-01-02T15:04:05Z", before)
-			if err != nil {
+			// assign to the outer err, so that a failure of the query below isn't lost
+			var t time.Time
+			if t, err = time.Parse(time.RFC3339, before); err != nil {
+				log.Warn("/events", "malformed before parameter", before)
 				httputil.SendJSON(writer, http.StatusBadRequest, struct{}{})
 				return
 			}
-			before = t.Format("2006-01-02 15:04:05")
-			q := "select event, email, value, ts from events where ts < ? order by ts desc limit 25"
-			rows, err = cxn.Query(q, before)
+			// event timestamps are stored in UTC
+			before = t.UTC().Format("2006-01-02 15:04:05")
+			q := "select event, email, value, ts, source_ip, user_agent, request_id, operator from events where ts < ? order by ts desc limit 25"
+			rows, err = cxn.QueryContext(ctx, q, before)
 		}
 	}
 	if err != nil {
@@ -760,55 +3241,221 @@ func eventsHandler(writer http.ResponseWriter, req *http.Request) {
 		defer rows.Close()
 		for rows.Next() {
 			ev := &event{}
-			rows.Scan(&ev.Event, &ev.Email, &ev.Value, &ev.Timestamp)
+			rows.Scan(&ev.Event, &ev.Email, &ev.Value, &ev.Timestamp, &ev.SourceIP, &ev.UserAgent, &ev.RequestID, &ev.Operator)
 			events = append(events, ev)
 		}
 	}
 	sort.Slice(events, func(i, j int) bool { return events[j].Timestamp < events[i].Timestamp })
 
 	httputil.SendJSON(writer, http.StatusOK, struct{ Events []*event }{events})
+}
 
-	if req.Method == "DELETE" {
-		log.Status(TAG, "clearing event log")
-		writeDatabaseByQuery("delete from events")
-		writeDatabaseByQuery("insert into events (event, email, value) values (?, ?, ?)", "events log reset", "", fmt.Sprintf("%d events cleared", len(events)))
-		log.Status(TAG, "cleared event log")
+// event is an entry in the audit log, as returned by /events
+type event struct{ Event, Email, Value, Timestamp, SourceIP, UserAgent, RequestID, Operator string }
+
+// clearEvents handles DELETE /events; see eventsHandler
+func clearEvents(writer http.ResponseWriter, req *http.Request) {
+	TAG := "/events"
+	ctx := req.Context()
+
+	events := []*event{}
+
+	cxn := getDB()
+	defer cxn.Close()
+	tx, err := cxn.BeginTx(ctx, nil)
+	if err != nil {
+		panic(err)
+	}
+	defer tx.Rollback()
+
+	q := "select event, email, value, ts, source_ip, user_agent, request_id, operator from events order by ts desc"
+	rows, err := tx.QueryContext(ctx, q)
+	if err != nil {
+		panic(err)
+	}
+	for rows.Next() {
+		ev := &event{}
+		if err := rows.Scan(&ev.Event, &ev.Email, &ev.Value, &ev.Timestamp, &ev.SourceIP, &ev.UserAgent, &ev.RequestID, &ev.Operator); err != nil {
+			panic(err)
+		}
+		events = append(events, ev)
+	}
+	rows.Close()
+
+	log.Status(TAG, "clearing event log")
+	if _, err := tx.ExecContext(ctx, "delete from events"); err != nil {
+		panic(err)
+	}
+	if err := recordEventTx(tx, req, "events log reset", "", fmt.Sprintf("%d events cleared", len(events))); err != nil {
+		panic(err)
 	}
+	if err := tx.Commit(); err != nil {
+		panic(err)
+	}
+	log.Status(TAG, "cleared event log")
+
+	httputil.SendJSON(writer, http.StatusOK, struct{ Events []*event }{events})
 }
 
 func settingsHandler(writer http.ResponseWriter, req *http.Request) {
 	// GET /settings -- fetch service metadata
 	//   I: None
-	//   O: {ServiceName: "", ClientLimit: 2, IssuedCertDuration: 90, WhitelistedDomains:[""]}
+	//   O: {ServiceName: "", ClientLimit: 2, IssuedCertDuration: 90, IssuedCertKeyBits: 4096, SigningCA: "current", ExpiringSoonDays: 30, UniqueDescriptions: false, CertBackdateMinutes: 0, EventRetentionDays: 0, OrgUnit: "", Country: "", Locality: "", RequireApproval: false, AllowSeedExport: false, SerialMode: "random", GlobalCertLimit: 0, IssuanceCooldownCerts: 0, IssuanceCooldownMinutes: 60, RequireDescription: true, DefaultCertDescription: "{email} - {date}", MinDescriptionLength: 1, RevokeExpiredCerts: false, DomainProfiles: {}, TemplateExtra: {}, WhitelistedDomains:[""]}
 	//   200: the object above
 	// PUT /settings -- update service metadata
-	//   I: {ServiceName: "", ClientLimit: 2, IssuedCertDuration: 90, WhitelistedDomains:[""]}
-	//   O: {ServiceName: "", ClientLimit: 2, IssuedCertDuration: 90, WhitelistedDomains:[""]}
-	//   200: the object above + values stored; 400 (bad request): missing or malformed values, or empty body
-	// Non-GET/DELETE: 409 (bad method)
+	//   I: {ServiceName: "", ClientLimit: 2, IssuedCertDuration: 90, IssuedCertKeyBits: 4096, SigningCA: "current", ExpiringSoonDays: 30, UniqueDescriptions: false, CertBackdateMinutes: 0, EventRetentionDays: 0, OrgUnit: "", Country: "", Locality: "", RequireApproval: false, AllowSeedExport: false, SerialMode: "random", GlobalCertLimit: 0, IssuanceCooldownCerts: 0, IssuanceCooldownMinutes: 60, RequireDescription: true, DefaultCertDescription: "{email} - {date}", MinDescriptionLength: 1, RevokeExpiredCerts: false, DomainProfiles: {}, TemplateExtra: {}, WhitelistedDomains:[""]}
+	//   O: {ServiceName: "", ClientLimit: 2, IssuedCertDuration: 90, IssuedCertKeyBits: 4096, SigningCA: "current", ExpiringSoonDays: 30, UniqueDescriptions: false, CertBackdateMinutes: 0, EventRetentionDays: 0, OrgUnit: "", Country: "", Locality: "", RequireApproval: false, AllowSeedExport: false, SerialMode: "random", GlobalCertLimit: 0, IssuanceCooldownCerts: 0, IssuanceCooldownMinutes: 60, RequireDescription: true, DefaultCertDescription: "{email} - {date}", MinDescriptionLength: 1, RevokeExpiredCerts: false, DomainProfiles: {}, TemplateExtra: {}, WhitelistedDomains:[""]}
+	//   200: the object above + values stored; 400 (bad request): missing or malformed values,
+	//   unknown fields, or empty body, with body {Errors: {<field>: "problem"}}
+	//   Fields omitted from the input retain their current values. SigningCA is "current" or "next",
+	//   the latter only if a next CA is configured (i.e. during a CA key rotation.)
+	//   IssuedCertDuration is in days, from minCertDuration to maxCertDuration. If
+	//   UniqueDescriptions is set, a user can't have two active certs with the same description.
+	//   CertBackdateMinutes (0 to 1440) starts new certs' validity that far in the past, for
+	//   clients with skewed clocks; expiry still counts from issuance. If EventRetentionDays is
+	//   nonzero, events older than that many days are pruned hourly. OrgUnit, Country (a two-letter
+	//   ISO 3166 code), and Locality are optional, and added to new certs' subjects if set. If
+	//   RequireApproval is set, POST /certs/<email> only requests a cert; see certRequestHandler.
+	//   AllowSeedExport enables GET /user/<email>/seed. SerialMode is "random" (128-bit serials) or
+	//   "sequential" (1, 2, 3, ..., skipping any already used). GlobalCertLimit caps active
+	//   (unexpired, unrevoked) certs across all users; 0 means unlimited. IssuanceCooldownCerts
+	//   caps how many certs one user may be issued in IssuanceCooldownMinutes (1 to 10080); 0 means
+	//   no cap. If RequireDescription is off, certs requested without a description get
+	//   DefaultCertDescription, with "{email}" and "{date}" filled in.
+	//   MinDescriptionLength (1 to 200) is the fewest characters a cert description may have, after
+	//   trimming and collapsing whitespace. If RevokeExpiredCerts is set, certs past their expiry
+	//   are revoked hourly, so that they drop out of ActiveCerts counts and cert limits.
+	//   DomainProfiles maps email domains (e.g. "example.com") to OVPNTemplateProfiles profile
+	//   names, choosing the .ovpn template for users in that domain who don't ask for a Profile.
+	//   Given domains are merged into the current ones; map a domain to "" to remove it.
+	//   WhitelistedDomains entries must be bare hostnames (e.g. "example.com"); they're trimmed,
+	//   lowercased, and de-duplicated.
+	// Non-GET/PUT: 405 (method not allowed)
 
 	TAG := "/settings"
+	ctx := req.Context()
 	switch req.Method {
 	case "GET":
-		httputil.SendJSON(writer, http.StatusOK, loadSettings())
+		httputil.SendJSON(writer, http.StatusOK, loadSettings(ctx))
 	case "PUT":
-		s := settings{}
-		if err := httputil.PopulateFromBody(&s, req); err != nil {
-			log.Error(TAG, "error parsing request body", req.Method)
-			httputil.SendJSON(writer, http.StatusBadRequest, struct{}{})
+		s := loadSettings(ctx) // start from current values, so that omitted fields are left as-is
+		if errs := decodeStrictJSON(s, req); errs != nil {
+			log.Warn(TAG, "error parsing request body", req.Method, errs)
+			sendFieldErrors(writer, errs)
+			return
+		}
+
+		if errs := validateSettings(s); len(errs) > 0 {
+			log.Warn(TAG, "invalid settings", errs)
+			sendFieldErrors(writer, errs)
+			return
 		}
-		storeSettings(&s)
-		httputil.SendJSON(writer, http.StatusOK, loadSettings())
+		storeSettings(ctx, s)
+		httputil.SendJSON(writer, http.StatusOK, loadSettings(ctx))
 	default:
 		panic("API method sentinel misconfiguration")
 	}
 }
 
+// validateSettings checks s as PUT /settings does, normalizing some values in place; see
+// settingsHandler
+func validateSettings(s *settings) fieldErrors {
+	errs := fieldErrors{}
+	if strings.TrimSpace(s.ServiceName) == "" {
+		errs["ServiceName"] = "required"
+	}
+	if s.ClientLimit < 0 {
+		errs["ClientLimit"] = "must not be negative"
+	}
+	if s.IssuedCertDuration < minCertDuration || s.IssuedCertDuration > maxCertDuration {
+		errs["IssuedCertDuration"] = fmt.Sprintf("must be from %d to %d", minCertDuration, maxCertDuration)
+	}
+	if !isValidKeyBits(s.IssuedCertKeyBits) {
+		errs["IssuedCertKeyBits"] = fmt.Sprintf("must be one of %v", validKeyBits)
+	}
+	if s.SigningCA != "current" && (s.SigningCA != "next" || cfg.NextCACertFile == "") {
+		errs["SigningCA"] = "must be \"current\", or \"next\" if a next CA is configured"
+	}
+	if s.ExpiringSoonDays < 1 {
+		errs["ExpiringSoonDays"] = "must be at least 1"
+	}
+	if s.CertBackdateMinutes < 0 || s.CertBackdateMinutes > 1440 {
+		errs["CertBackdateMinutes"] = "must be from 0 to 1440"
+	}
+	if s.EventRetentionDays < 0 {
+		errs["EventRetentionDays"] = "must not be negative"
+	}
+	if s.DefaultCertDescription = strings.TrimSpace(s.DefaultCertDescription); s.DefaultCertDescription == "" && !s.RequireDescription {
+		errs["DefaultCertDescription"] = "required unless RequireDescription is set"
+	}
+	if s.MinDescriptionLength < 1 || s.MinDescriptionLength > maxDescriptionLength {
+		errs["MinDescriptionLength"] = fmt.Sprintf("must be from 1 to %d", maxDescriptionLength)
+	}
+	if s.GlobalCertLimit < 0 {
+		errs["GlobalCertLimit"] = "must not be negative"
+	}
+	if s.IssuanceCooldownCerts < 0 {
+		errs["IssuanceCooldownCerts"] = "must not be negative"
+	}
+	if s.IssuanceCooldownMinutes < 1 || s.IssuanceCooldownMinutes > 10080 {
+		errs["IssuanceCooldownMinutes"] = "must be from 1 to 10080"
+	}
+	if s.SerialMode != "random" && s.SerialMode != "sequential" {
+		errs["SerialMode"] = "must be \"random\" or \"sequential\""
+	}
+	s.OrgUnit, s.Locality = strings.TrimSpace(s.OrgUnit), strings.TrimSpace(s.Locality)
+	if s.Country = strings.ToUpper(strings.TrimSpace(s.Country)); s.Country != "" && !validCountry.MatchString(s.Country) {
+		errs["Country"] = "must be a two-letter country code"
+	}
+	var bad []string
+	if s.DomainProfiles, bad = normalizeDomainProfiles(s.DomainProfiles); len(bad) > 0 {
+		errs["DomainProfiles"] = "not valid domain names or unknown profiles: " + strings.Join(bad, ", ")
+	}
+	if s.WhitelistedDomains, bad = normalizeDomains(s.WhitelistedDomains); len(bad) > 0 {
+		errs["WhitelistedDomains"] = "not valid domain names: " + strings.Join(bad, ", ")
+	}
+	return errs
+}
+
+func resetSettingsHandler(writer http.ResponseWriter, req *http.Request) {
+	// POST /settings/reset -- restore the built-in default settings
+	//   I: None
+	//   O: {ServiceName: "", ClientLimit: 2, ...} (as for GET /settings)
+	//   200: the object above, i.e. the defaults, now stored
+	//   WhitelistedDomains and the user whitelist are left as-is, unless the query parameter
+	//   "?whitelists=true" is given, in which case both are cleared too.
+	// Non-POST: 405 (method not allowed)
+
+	TAG := "/settings/reset"
+	ctx := req.Context()
+	clearWhitelists := req.URL.Query().Get("whitelists") == "true"
+
+	s := defaultSettings()
+	if !clearWhitelists {
+		s.WhitelistedDomains = loadSettings(ctx).WhitelistedDomains
+	}
+	writeDatabaseByQuery(ctx, "delete from settings")
+	if clearWhitelists {
+		writeDatabaseByQuery(ctx, "delete from whitelist")
+	}
+	storeSettings(ctx, s)
+	recordEvent(req, "settings reset", "", fmt.Sprintf("whitelists cleared: %t", clearWhitelists))
+
+	log.Status(TAG, "reset settings to defaults; whitelists cleared:", clearWhitelists)
+	httputil.SendJSON(writer, http.StatusOK, loadSettings(ctx))
+}
+
 func whitelistHandler(writer http.ResponseWriter, req *http.Request) {
 	// GET /whitelist -- fetch list of whitelisted users
 	//   I: None
 	//   O: {Users: [""]}
 	//   200: the object above
+	// POST /whitelist -- add many users to the whitelist at once
+	//   I: {Emails: [""]}
+	//   O: {Users: [""], Rejected: {<entry>: "problem"}}
+	//   200: new complete list of users, plus any entries that weren't added and why; 400: missing
+	//   or malformed request JSON, with body {Errors: {<field>: "problem"}}
+	//   Valid entries are added in a single transaction, even if others are rejected.
 	// PUT /whitelist/<email> -- add a user to the whitelist
 	//   I: None
 	//   O: {Users: [""]}
@@ -818,12 +3465,23 @@ func whitelistHandler(writer http.ResponseWriter, req *http.Request) {
 	//   I: None
 	//   O: {Users: [""]}
 	//   200: new complete list of users; 404: user not whitelisted; 400: malformed or missing email
-	// Non-GET/DELETE: 409 (bad method)
-	// Returned list of users is sorted.
+	// Non-GET/POST/PUT/DELETE: 405 (method not allowed)
+	// Whitelisted domains are managed separately; see whitelistDomainsHandler.
+	// Returned list of users is sorted. Each addition (including by POST) and removal is recorded
+	// as a "whitelist added" or "whitelist removed" event.
 
 	TAG := "whitelistHandler"
+	ctx := req.Context()
 
 	email := extractSegment(req.URL.Path, 2)
+	if email != "" {
+		var err error
+		if email, err = normalizeEmail(email); err != nil {
+			log.Warn(TAG, "malformed email", req.URL.Path, err)
+			httputil.SendJSON(writer, http.StatusBadRequest, struct{}{})
+			return
+		}
+	}
 
 	switch req.Method {
 	case "GET":
@@ -835,7 +3493,7 @@ func whitelistHandler(writer http.ResponseWriter, req *http.Request) {
 		cxn := getDB()
 		defer cxn.Close()
 		emails := []string{}
-		if rows, err := cxn.Query(q); err != nil {
+		if rows, err := cxn.QueryContext(ctx, q); err != nil {
 			panic(err)
 		} else {
 			defer rows.Close()
@@ -845,23 +3503,331 @@ func whitelistHandler(writer http.ResponseWriter, req *http.Request) {
 			}
 		}
 		httputil.SendJSON(writer, http.StatusOK, struct{ Users []string }{emails})
+	case "POST":
+		if email != "" {
+			httputil.SendJSON(writer, http.StatusBadRequest, struct{}{})
+			return
+		}
+		bulkWhitelist(writer, req)
 	case "PUT":
 		if email == "" {
 			httputil.SendJSON(writer, http.StatusBadRequest, struct{}{})
 			return
 		}
-		writeDatabaseByQuery("insert or replace into whitelist (email) values (?)", email)
+		writeDatabaseByQuery(ctx, "insert or replace into whitelist (email) values (?)", email)
+		invalidateSettings()
+		recordEvent(req, "whitelist added", email, "")
 		log.Status(TAG, fmt.Sprintf("added '%s' to user whitelist", email))
-		httputil.SendJSON(writer, http.StatusOK, struct{ Users []string }{loadSettings().WhitelistedUsers})
+		httputil.SendJSON(writer, http.StatusOK, struct{ Users []string }{loadSettings(ctx).WhitelistedUsers})
 	case "DELETE":
 		if email == "" {
 			httputil.SendJSON(writer, http.StatusBadRequest, struct{}{})
 			return
 		}
-		writeDatabaseByQuery("delete from whitelist where email=?", email)
+		cxn := getDB()
+		defer cxn.Close()
+		res, err := cxn.ExecContext(ctx, "delete from whitelist where email=?", email)
+		if err != nil {
+			panic(err)
+		}
+		invalidateSettings()
+		if n, err := res.RowsAffected(); err != nil {
+			panic(err)
+		} else if n > 0 { // deleting a user who wasn't whitelisted isn't worth auditing
+			recordEvent(req, "whitelist removed", email, "")
+		}
 		log.Status(TAG, fmt.Sprintf("deleted '%s' from user whitelist", email))
-		httputil.SendJSON(writer, http.StatusOK, struct{ Users []string }{loadSettings().WhitelistedUsers})
+		httputil.SendJSON(writer, http.StatusOK, struct{ Users []string }{loadSettings(ctx).WhitelistedUsers})
+	default:
+		panic("API method sentinel misconfiguration")
+	}
+}
+
+// bulkWhitelist handles POST /whitelist; see whitelistHandler
+func bulkWhitelist(writer http.ResponseWriter, req *http.Request) {
+	TAG := "bulkWhitelist"
+	ctx := req.Context()
+
+	reqBody := &struct{ Emails []string }{}
+	if errs := decodeStrictJSON(reqBody, req); errs != nil {
+		log.Warn(TAG, "missing or malformed request JSON", errs)
+		sendFieldErrors(writer, errs)
+		return
+	}
+
+	rejected := make(map[string]string)
+	emails := []string{}
+	for _, raw := range reqBody.Emails {
+		if email, err := normalizeEmail(raw); err != nil {
+			rejected[raw] = err.Error()
+		} else {
+			emails = append(emails, email)
+		}
+	}
+
+	cxn := getDB()
+	defer cxn.Close()
+	tx, err := cxn.BeginTx(ctx, nil)
+	if err != nil {
+		panic(err)
+	}
+	defer tx.Rollback()
+	for _, email := range emails {
+		if _, err := tx.ExecContext(ctx, "insert or replace into whitelist (email) values (?)", email); err != nil {
+			panic(err)
+		}
+		if err := recordEventTx(tx, req, "whitelist added", email, ""); err != nil {
+			panic(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		panic(err)
+	}
+	invalidateSettings()
+
+	log.Status(TAG, fmt.Sprintf("added %d users to whitelist, rejected %d", len(emails), len(rejected)))
+	httputil.SendJSON(writer, http.StatusOK, &struct {
+		Users    []string
+		Rejected map[string]string
+	}{loadSettings(ctx).WhitelistedUsers, rejected})
+}
+
+func whitelistDomainsHandler(writer http.ResponseWriter, req *http.Request) {
+	// GET /whitelist/domains -- fetch the WhitelistedDomains setting
+	//   I: None
+	//   O: {Domains: [""]}
+	//   200: the object above
+	// PUT /whitelist/domains/<domain> -- whitelist every user at a domain
+	//   I: None
+	//   O: {Domains: [""]}
+	//   200: new complete list of domains; 400: malformed or missing domain
+	//   Idempotent if the domain is already whitelisted.
+	// DELETE /whitelist/domains/<domain> -- remove a domain from the whitelist
+	//   I: None
+	//   O: {Domains: [""]}
+	//   200: new complete list of domains; 404: domain not whitelisted; 400: malformed or missing
+	//   domain
+	// Non-GET/PUT/DELETE: 405 (method not allowed)
+	// Domains are bare hostnames, normalized as for PUT /settings; the returned list is sorted.
+	// Unlike PUT /settings, these leave other settings alone. Each change is recorded as a
+	// "whitelist domain added" or "whitelist domain removed" event.
+
+	TAG := "whitelistDomainsHandler"
+	ctx := req.Context()
+
+	domain := ""
+	if raw := extractSegment(req.URL.Path, 3); raw != "" {
+		domains, bad := normalizeDomains([]string{raw})
+		if len(bad) > 0 || len(domains) != 1 {
+			log.Warn(TAG, "malformed domain", req.URL.Path)
+			httputil.SendJSON(writer, http.StatusBadRequest, struct{}{})
+			return
+		}
+		domain = domains[0]
+	}
+	if (req.Method == "GET") != (domain == "") {
+		log.Warn(TAG, "domain missing or unexpected", req.Method, req.URL.Path)
+		httputil.SendJSON(writer, http.StatusBadRequest, struct{}{})
+		return
+	}
+
+	if req.Method == "GET" {
+		httputil.SendJSON(writer, http.StatusOK, struct{ Domains []string }{loadSettings(ctx).WhitelistedDomains})
+		return
+	}
+
+	// read, change, and write the one setting in a transaction, so concurrent changes aren't lost
+	cxn := getDB()
+	defer cxn.Close()
+	tx, err := cxn.BeginTx(ctx, nil)
+	if err != nil {
+		panic(err)
+	}
+	defer tx.Rollback()
+	var stored string
+	err = tx.QueryRowContext(ctx, "select value from settings where key='WhitelistedDomains'").Scan(&stored)
+	if err != nil && err != sql.ErrNoRows {
+		panic(err)
+	}
+	domains := []string{}
+	found := false
+	for _, d := range strings.Fields(stored) {
+		if d == domain {
+			found = true
+		} else {
+			domains = append(domains, d)
+		}
+	}
+
+	event := "whitelist domain added"
+	switch req.Method {
+	case "PUT":
+		domains = append(domains, domain)
+	case "DELETE":
+		if !found {
+			log.Warn(TAG, "attempt to remove domain not whitelisted", domain)
+			httputil.SendJSON(writer, http.StatusNotFound, struct{}{})
+			return
+		}
+		event = "whitelist domain removed"
 	default:
 		panic("API method sentinel misconfiguration")
 	}
+	sort.Strings(domains)
+
+	q := "insert or replace into settings (key, value) values ('WhitelistedDomains', ?)"
+	if _, err = tx.ExecContext(ctx, q, strings.Join(domains, " ")); err != nil {
+		panic(err)
+	}
+	if req.Method == "DELETE" || !found { // re-adding a domain isn't worth auditing
+		if err = recordEventTx(tx, req, event, "", domain); err != nil {
+			panic(err)
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		panic(err)
+	}
+	invalidateSettings()
+
+	log.Status(TAG, fmt.Sprintf("%s: '%s'", event, domain))
+	httputil.SendJSON(writer, http.StatusOK, struct{ Domains []string }{domains})
+}
+
+func caHandler(writer http.ResponseWriter, req *http.Request) {
+	// GET /ca -- fetch the CA certificate chain that client certs are issued under
+	//   I: None
+	//   O: the PEM-encoded cert chain, as application/x-pem-file, ordered from the signing CA up
+	//      to the root; during a CA rotation this includes both the current and next CAs' chains
+	//   200: the chain above; 400: unknown format
+	// Non-GET: 405 (method not allowed)
+	// Accepts a GET query parameter of "?format=der" to instead fetch the binary DER encoding, as
+	// application/x-x509-ca-cert. If the chain contains multiple certs, their DER encodings are
+	// concatenated.
+	// Responses carry an ETag and a Last-Modified (the newest of the CA cert files), may be cached
+	// for CACacheMaxAgeSeconds, and conditional requests get a 304 (not modified) if unchanged.
+
+	TAG := "/ca"
+
+	if err := req.ParseForm(); err != nil {
+		panic(err)
+	}
+
+	chain := exportTrustedCertChains()
+	modified := latestModTime(cfg.CACertFile, cfg.CAChainFile, cfg.NextCACertFile, cfg.NextCAChainFile)
+	maxAge := time.Duration(cfg.CACacheMaxAgeSeconds) * time.Second
+
+	switch req.FormValue("format") {
+	case "", "pem":
+		sendCacheable(writer, req, "application/x-pem-file", chain, modified, maxAge)
+	case "der":
+		var der []byte
+		for block, rest := pem.Decode(chain); block != nil; block, rest = pem.Decode(rest) {
+			if block.Type == "CERTIFICATE" {
+				der = append(der, block.Bytes...)
+			}
+		}
+		sendCacheable(writer, req, "application/x-x509-ca-cert", der, modified, maxAge)
+	default:
+		log.Warn(TAG, "unknown format requested", req.FormValue("format"))
+		httputil.SendJSON(writer, http.StatusBadRequest, struct{}{})
+	}
+}
+
+func healthzHandler(writer http.ResponseWriter, req *http.Request) {
+	// GET /healthz -- check that the server is up and its database is usable
+	//   I: None
+	//   O: {Status: "ok"}
+	//   200: healthy; 503 (service unavailable): database did not respond in time
+	// Non-GET: 405 (method not allowed)
+
+	cxn := getDB()
+	defer cxn.Close()
+	var one int
+	if err := cxn.QueryRowContext(req.Context(), "select 1").Scan(&one); err != nil {
+		panic(err)
+	}
+	httputil.SendJSON(writer, http.StatusOK, &struct{ Status string }{"ok"})
+}
+
+func statsHandler(writer http.ResponseWriter, req *http.Request) {
+	// GET /stats -- fetch summary counts for the admin dashboard
+	//   I: None
+	//   O: {TotalUsers: 0, ActiveCerts: 0, ExpiredCerts: 0, RevokedCerts: 0, ExpiringSoon: 0, EventsLast24h: 0, GlobalCertLimit: 0, CertUtilization: 0.0}
+	//   200: the object above
+	// Non-GET: 405 (method not allowed)
+	// ExpiredCerts are unrevoked certs past their expiry, which aren't counted in ActiveCerts.
+	// ExpiringSoon counts active certs expiring within the ExpiringSoonDays setting.
+	// CertUtilization is ActiveCerts as a fraction of the GlobalCertLimit setting, or 0 if that's
+	// unlimited.
+
+	ctx := req.Context()
+
+	res := struct {
+		TotalUsers, ActiveCerts, ExpiredCerts, RevokedCerts, ExpiringSoon int
+		EventsLast24h, GlobalCertLimit                                    int
+		CertUtilization                                                   float64
+	}{}
+
+	s := loadSettings(ctx)
+	window := fmt.Sprintf("+%d day", s.ExpiringSoonDays)
+	q := `select
+		(select count(*) from totp),
+		(select count(*) from certs where revoked is null and expires > datetime('now')),
+		(select count(*) from certs where revoked is null and expires <= datetime('now')),
+		(select count(*) from certs where revoked is not null),
+		(select count(*) from certs where revoked is null and date(expires) >= date('now') and date(expires) <= date('now', ?)),
+		(select count(*) from events where ts > datetime('now', '-1 day'))`
+	cxn := getReadDB()
+	defer cxn.Close()
+	if err := cxn.QueryRowContext(ctx, q, window).Scan(&res.TotalUsers, &res.ActiveCerts, &res.ExpiredCerts, &res.RevokedCerts, &res.ExpiringSoon, &res.EventsLast24h); err != nil {
+		panic(err)
+	}
+	if res.GlobalCertLimit = s.GlobalCertLimit; res.GlobalCertLimit > 0 {
+		res.CertUtilization = float64(res.ActiveCerts) / float64(res.GlobalCertLimit)
+	}
+
+	httputil.SendJSON(writer, http.StatusOK, &res)
+}
+
+func domainStatsHandler(writer http.ResponseWriter, req *http.Request) {
+	// GET /stats/domains -- fetch user and cert counts per email domain
+	//   I: None
+	//   O: [{Domain: "", Users: 0, ActiveCerts: 0, ExpiredCerts: 0}]
+	//   200: the list above, possibly empty
+	// Non-GET: 405 (method not allowed)
+	// For capacity reporting. Archived users aren't counted, as in GET /users. ExpiredCerts are
+	// unrevoked certs past their expiry, which aren't in ActiveCerts. Sorted by ActiveCerts, most
+	// first, then by Domain.
+
+	ctx := req.Context()
+
+	type domainStats struct {
+		Domain                           string
+		Users, ActiveCerts, ExpiredCerts int
+	}
+
+	q := `select substr(t.email, instr(t.email, '@') + 1) as domain, count(distinct t.email),
+	        count(case when c.expires > datetime('now') then 1 end), count(case when c.expires <= datetime('now') then 1 end)
+	      from totp as t left join certs as c on c.email=t.email and c.revoked is null
+	      where t.archived is null group by domain order by 3 desc, domain`
+	cxn := getReadDB()
+	defer cxn.Close()
+	rows, err := cxn.QueryContext(ctx, q)
+	if err != nil {
+		panic(err)
+	}
+	defer rows.Close()
+	res := []*domainStats{}
+	for rows.Next() {
+		d := &domainStats{}
+		if err := rows.Scan(&d.Domain, &d.Users, &d.ActiveCerts, &d.ExpiredCerts); err != nil {
+			panic(err)
+		}
+		res = append(res, d)
+	}
+	if err := rows.Err(); err != nil {
+		panic(err)
+	}
+
+	httputil.SendJSON(writer, http.StatusOK, res)
 }
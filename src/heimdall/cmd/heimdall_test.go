@@ -0,0 +1,226 @@
+// Copyright © 2018 Playground Global, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestNormalizeEmail(t *testing.T) {
+	valid := []struct{ raw, want string }{
+		{"user@example.com", "user@example.com"},
+		{"User@Example.COM", "user@example.com"},
+		{"  user@example.com\t", "user@example.com"},
+		{"first.last+tag@sub.example.com", "first.last+tag@sub.example.com"},
+		{"o'brien@example.com", "o'brien@example.com"},
+		{"user@localhost", "user@localhost"},
+	}
+	for _, tc := range valid {
+		if got, err := normalizeEmail(tc.raw); err != nil || got != tc.want {
+			t.Errorf("normalizeEmail(%q) = %q, %v; want %q", tc.raw, got, err, tc.want)
+		}
+	}
+
+	invalid := []string{
+		"",
+		"   ",
+		"user",
+		"user@",
+		"@example.com",
+		"user@@example.com",
+		"user example@example.com",
+		"User <user@example.com>",
+		"<user@example.com>",
+		"\"User\" <user@example.com>",
+		"a@example.com, b@example.com",
+	}
+	for _, raw := range invalid {
+		if got, err := normalizeEmail(raw); err == nil {
+			t.Errorf("normalizeEmail(%q) = %q; want an error", raw, got)
+		}
+	}
+}
+
+func TestTruncateEventValue(t *testing.T) {
+	a := func(n int) string { return strings.Repeat("a", n) }
+	for _, tc := range []struct {
+		value string
+		max   int
+		want  string
+	}{
+		{"", 16, ""},
+		{a(100), 0, a(100)},
+		{a(16), 16, a(16)},
+		{a(17), 16, a(13) + "…"},
+		// the cut falls at byte 13; a multi-byte character spanning it is dropped whole
+		{a(12) + "é" + a(10), 16, a(12) + "…"},
+		{a(11) + "€" + a(10), 16, a(11) + "…"},
+		{a(10) + "😀" + a(10), 16, a(10) + "…"},
+		// one ending just before it is kept
+		{a(11) + "é" + a(10), 16, a(11) + "é…"},
+		{"éééééééééé", 16, "éééééé…"},
+	} {
+		got := truncateEventValue(tc.value, tc.max)
+		if got != tc.want {
+			t.Errorf("truncateEventValue(%q, %d) = %q; want %q", tc.value, tc.max, got, tc.want)
+		}
+		if !utf8.ValidString(got) || (tc.max > 0 && len(got) > tc.max) {
+			t.Errorf("truncateEventValue(%q, %d) = %q, which is invalid or too long", tc.value, tc.max, got)
+		}
+	}
+}
+
+func TestRecordEventTruncates(t *testing.T) {
+	useTestDB(t)
+	saved := cfg.MaxEventValueLength
+	cfg.MaxEventValueLength = minEventValueLength
+	defer func() { cfg.MaxEventValueLength = saved }()
+
+	recordEvent(httptest.NewRequest("POST", "/certs/a@b.c", nil), "certificate issued", "a@b.c", strings.Repeat("ü", 20))
+	cxn := getDB()
+	defer cxn.Close()
+	var value string
+	if err := cxn.QueryRow("select value from events").Scan(&value); err != nil {
+		t.Fatal(err)
+	}
+	if value != strings.Repeat("ü", 6)+"…" {
+		t.Errorf("stored %q", value)
+	}
+}
+
+func TestUserPutEmptyObjectResetsTOTP(t *testing.T) {
+	useTestDB(t)
+
+	// Bifrost enrolls users with a "{}" body, which must be a TOTP reset, not a limit change
+	put := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		userHandler(rec, httptest.NewRequest("PUT", "/user/a@b.c", strings.NewReader("{}")))
+		return rec
+	}
+	if rec := put(); rec.Code != http.StatusCreated || !strings.Contains(rec.Body.String(), "TOTPURL") {
+		t.Fatalf("new user: %d %s", rec.Code, rec.Body.String())
+	}
+
+	cxn := getDB()
+	defer cxn.Close()
+	if _, err := cxn.Exec("update totp set client_limit=3, issuer='Tenant' where email='a@b.c'"); err != nil {
+		t.Fatal(err)
+	}
+	var seed string
+	cxn.QueryRow("select seed from totp where email='a@b.c'").Scan(&seed)
+
+	if rec := put(); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "TOTPURL") {
+		t.Fatalf("existing user: %d %s", rec.Code, rec.Body.String())
+	}
+	var newSeed, issuer string
+	var limit int
+	if err := cxn.QueryRow("select seed, client_limit, issuer from totp where email='a@b.c'").Scan(&newSeed, &limit, &issuer); err != nil {
+		t.Fatal(err)
+	}
+	if newSeed == seed || limit != 3 || issuer != "Tenant" {
+		t.Errorf("seed rotated %v, limit %d, issuer %q", newSeed != seed, limit, issuer)
+	}
+}
+
+func TestUserPutFields(t *testing.T) {
+	useTestDB(t)
+	put := func(body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		userHandler(rec, httptest.NewRequest("PUT", "/user/a@b.c", strings.NewReader(body)))
+		return rec
+	}
+	cxn := getDB()
+	defer cxn.Close()
+	var seed string
+	var limit *int
+	var issuer string
+	read := func() {
+		if err := cxn.QueryRow("select seed, client_limit, issuer from totp where email='a@b.c'").Scan(&seed, &limit, &issuer); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a limit alone needs an existing user
+	if rec := put(`{"ClientLimit": 2}`); rec.Code != http.StatusNotFound {
+		t.Errorf("limit for new user: %d", rec.Code)
+	}
+
+	// both fields together create the user with both set
+	if rec := put(`{"ClientLimit": 5, "Issuer": "Tenant"}`); rec.Code != http.StatusCreated || !strings.Contains(rec.Body.String(), "TOTPURL") {
+		t.Fatalf("both fields: %d %s", rec.Code, rec.Body.String())
+	}
+	read()
+	if limit == nil || *limit != 5 || issuer != "Tenant" {
+		t.Errorf("limit %v, issuer %q", limit, issuer)
+	}
+
+	// a null limit alone clears the override and leaves the seed
+	saved := seed
+	if rec := put(`{"ClientLimit": null}`); rec.Code != http.StatusOK || strings.Contains(rec.Body.String(), "TOTPURL") {
+		t.Fatalf("null limit: %d %s", rec.Code, rec.Body.String())
+	}
+	read()
+	if limit != nil || seed != saved || issuer != "Tenant" {
+		t.Errorf("limit %v, seed changed %v, issuer %q", limit, seed != saved, issuer)
+	}
+
+	// problems with either field are reported by name
+	for body, field := range map[string]string{
+		`{"ClientLimit": -1}`:                 "ClientLimit",
+		`{"ClientLimit": "x"}`:                "ClientLimit",
+		`{"Issuer": "a:b", "ClientLimit": 1}`: "Issuer",
+		`{"Bogus": 1}`:                        "Bogus",
+	} {
+		if rec := put(body); rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), `"`+field+`"`) {
+			t.Errorf("%s: %d %s", body, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func TestUserDeleteUnknown(t *testing.T) {
+	useTestDB(t)
+
+	rec := httptest.NewRecorder()
+	userHandler(rec, httptest.NewRequest("DELETE", "/user/nobody@b.c", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("unknown user: %d %s", rec.Code, rec.Body.String())
+	}
+	cxn := getDB()
+	defer cxn.Close()
+	var n int
+	if err := cxn.QueryRow("select count(*) from events where event='user archived'").Scan(&n); err != nil || n != 0 {
+		t.Error("archive of unknown user recorded", n, err)
+	}
+
+	// a known user is archived, and archiving again still finds it
+	if _, err := cxn.Exec("insert into totp (email, seed) values ('a@b.c', 's')"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		rec = httptest.NewRecorder()
+		userHandler(rec, httptest.NewRequest("DELETE", "/user/a@b.c", nil))
+		if rec.Code != http.StatusOK {
+			t.Errorf("archive %d: %d %s", i, rec.Code, rec.Body.String())
+		}
+	}
+	var archived int
+	if err := cxn.QueryRow("select count(*) from totp where email='a@b.c' and archived is not null").Scan(&archived); err != nil || archived != 1 {
+		t.Error("not archived", archived, err)
+	}
+}
@@ -0,0 +1,57 @@
+// Copyright © 2018 Playground Global, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+// sendCacheable responds with body, for endpoints whose content changes rarely: it's tagged with
+// an ETag of its hash, and a Last-Modified of modified unless that's zero, and conditional
+// requests that match get a 304 (not modified) without it. Clients may cache it for maxAge, or if
+// that's 0 must revalidate it before each use.
+func sendCacheable(writer http.ResponseWriter, req *http.Request, contentType string, body []byte, modified time.Time, maxAge time.Duration) {
+	sum := sha256.Sum256(body)
+	writer.Header().Set("ETag", fmt.Sprintf(`"%s"`, hex.EncodeToString(sum[:16])))
+	writer.Header().Set("Content-Type", contentType)
+	if maxAge > 0 {
+		writer.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(maxAge/time.Second)))
+	} else {
+		writer.Header().Set("Cache-Control", "no-cache")
+	}
+	// handles If-None-Match and If-Modified-Since, as well as HEAD and Range requests
+	http.ServeContent(writer, req, "", modified, bytes.NewReader(body))
+}
+
+// latestModTime returns the most recent modification time of the named files, ignoring "" and
+// any that can't be read; zero if there are none
+func latestModTime(files ...string) time.Time {
+	var latest time.Time
+	for _, f := range files {
+		if f == "" {
+			continue
+		}
+		if fi, err := os.Stat(f); err == nil && fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest
+}
@@ -0,0 +1,105 @@
+// Copyright © 2018 Playground Global, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Idempotency-Key support for cert issuance, so that a client retrying after e.g. a network
+// timeout gets the cert from its first attempt instead of a second one. Results are held only in
+// memory, since they contain the private key, which is never written to disk.
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// idempotencyTTL is how long a completed issuance can be replayed by its key
+const idempotencyTTL = 15 * time.Minute
+
+var idempotentIssues = struct {
+	sync.Mutex
+	entries map[string]*idempotentIssue
+}{entries: make(map[string]*idempotentIssue)}
+
+type idempotentIssue struct {
+	fingerprint string // empty while the original request is in progress
+	ovpn        []byte // likewise nil
+	expires     time.Time
+}
+
+// keys are scoped per user, so that one user's key can't replay another's cert
+func idempotencyMapKey(email, key string) string {
+	return email + "\x00" + key
+}
+
+// claimIdempotencyKey records that a request with the given key is issuing a cert for email, and
+// returns claimed = true if no other request has. Otherwise it returns the fingerprint and .ovpn
+// issued by the earlier request, which are empty if that request has not yet completed.
+func claimIdempotencyKey(email, key string) (fingerprint string, ovpn []byte, claimed bool) {
+	idempotentIssues.Lock()
+	defer idempotentIssues.Unlock()
+
+	now := time.Now()
+	for k, e := range idempotentIssues.entries {
+		if now.After(e.expires) {
+			delete(idempotentIssues.entries, k)
+		}
+	}
+
+	if e, ok := idempotentIssues.entries[idempotencyMapKey(email, key)]; ok {
+		return e.fingerprint, e.ovpn, false
+	}
+	idempotentIssues.entries[idempotencyMapKey(email, key)] = &idempotentIssue{expires: now.Add(idempotencyTTL)}
+	return "", nil, true
+}
+
+// completeIdempotencyKey stores the result of a claimed issuance for replay
+func completeIdempotencyKey(email, key, fingerprint string, ovpn []byte) {
+	idempotentIssues.Lock()
+	defer idempotentIssues.Unlock()
+	idempotentIssues.entries[idempotencyMapKey(email, key)] = &idempotentIssue{fingerprint, ovpn, time.Now().Add(idempotencyTTL)}
+}
+
+// releaseIdempotencyKey drops a claim whose issuance did not complete (e.g. it was refused or
+// panicked), so that the key can be retried; a no-op for completed issuances
+func releaseIdempotencyKey(email, key string) {
+	idempotentIssues.Lock()
+	defer idempotentIssues.Unlock()
+	if e, ok := idempotentIssues.entries[idempotencyMapKey(email, key)]; ok && e.ovpn == nil {
+		delete(idempotentIssues.entries, idempotencyMapKey(email, key))
+	}
+}
+
+// forgetIdempotencyKey drops a key's entry, completed or not
+func forgetIdempotencyKey(email, key string) {
+	idempotentIssues.Lock()
+	defer idempotentIssues.Unlock()
+	delete(idempotentIssues.entries, idempotencyMapKey(email, key))
+}
+
+// replayable reports whether a cert issued for an idempotency key may still be handed out again:
+// i.e. it hasn't been revoked, nor its user archived, since. This is checked against the database
+// rather than evicting entries as certs are revoked, since revocations also come from the admin
+// CLI, in another process.
+func replayable(ctx context.Context, fingerprint string) bool {
+	var ok bool
+	q := `select count(*) > 0 from certs as c join totp as t on c.email=t.email
+	      where c.fingerprint=? and c.revoked is null and t.archived is null`
+	cxn := getDB()
+	defer cxn.Close()
+	if err := cxn.QueryRowContext(ctx, q, fingerprint).Scan(&ok); err != nil {
+		panic(err)
+	}
+	return ok
+}
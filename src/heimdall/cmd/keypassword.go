@@ -0,0 +1,90 @@
+// Copyright © 2018 Playground Global, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// CA key passwords given indirectly, via CAKeyPasswordFile or CAKeyPasswordCommand (and their
+// NextCA counterparts), so that they needn't sit in the config file. They're resolved once at
+// startup, into CAKeyPassword and NextCAKeyPassword, and never logged.
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// keyPasswordCommandTimeout bounds how long a CAKeyPasswordCommand may take, e.g. to reach a vault
+const keyPasswordCommandTimeout = 30 * time.Second
+
+// resolveKeyPasswords replaces cfg's CA key passwords with those read from their files or commands,
+// where configured, returning a description of each that couldn't be resolved
+func resolveKeyPasswords(cfg *serverConfig) []string {
+	problems := []string{}
+	var err error
+	if cfg.CAKeyPassword, err = resolveKeyPassword(cfg.CAKeyPassword, cfg.CAKeyPasswordFile, cfg.CAKeyPasswordCommand); err != nil {
+		problems = append(problems, "CAKeyPasswordFile/CAKeyPasswordCommand: "+err.Error())
+	}
+	if cfg.NextCAKeyPassword, err = resolveKeyPassword(cfg.NextCAKeyPassword, cfg.NextCAKeyPasswordFile, cfg.NextCAKeyPasswordCommand); err != nil {
+		problems = append(problems, "NextCAKeyPasswordFile/NextCAKeyPasswordCommand: "+err.Error())
+	}
+	return problems
+}
+
+// resolveKeyPassword returns the contents of file, or the output of command (run by the shell), if
+// either is set, less any trailing newline; else plain. Errors never include the password.
+func resolveKeyPassword(plain, file, command string) (string, error) {
+	var out []byte
+	var err error
+	switch {
+	case file != "" && command != "":
+		return plain, errors.New("only one may be set")
+	case file != "":
+		if out, err = ioutil.ReadFile(file); err != nil {
+			return plain, err
+		}
+	case command != "":
+		ctx, cancel := context.WithTimeout(context.Background(), keyPasswordCommandTimeout)
+		defer cancel()
+		cmd := exec.CommandContext(ctx, "/bin/sh", "-c", command)
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		if out, err = cmd.Output(); err != nil {
+			return plain, fmt.Errorf("command failed: %s: %s", err, strings.TrimSpace(stderr.String()))
+		}
+	default:
+		return plain, nil
+	}
+	password := strings.TrimRight(string(out), "\r\n")
+	if password == "" {
+		return plain, errors.New("password is empty")
+	}
+	return password, nil
+}
+
+// keyPasswordSource names the config field a CA key password came from, for error messages; prefix
+// is "" or "Next"
+func keyPasswordSource(prefix, file, command string) string {
+	switch {
+	case file != "":
+		return prefix + "CAKeyPasswordFile"
+	case command != "":
+		return prefix + "CAKeyPasswordCommand"
+	}
+	return prefix + "CAKeyPassword"
+}
@@ -0,0 +1,123 @@
+// Copyright © 2018 Playground Global, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Size-based log rotation. The playground/log functions write via the standard library logger, so
+// installing a rotatingFile as its output makes rotation transparent to log.Status/Warn/Error.
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// rotatingFile is an io.Writer that appends to a file, renaming it aside and starting a new one
+// once it reaches a maximum size. Old files are named <path>.<timestamp> and are pruned by count
+// and age; a limit of 0 disables that limit.
+type rotatingFile struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	maxAge     time.Duration
+	file       *os.File
+	size       int64
+}
+
+func openRotatingFile(path string, maxSizeMB, maxBackups, maxAgeDays int) (*rotatingFile, error) {
+	r := &rotatingFile{
+		path:       path,
+		maxSize:    int64(maxSizeMB) * 1024 * 1024,
+		maxBackups: maxBackups,
+		maxAge:     time.Duration(maxAgeDays) * 24 * time.Hour,
+	}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// open opens r.path for appending, creating it if need be; r.file is replaced only on success
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.file, r.size = f, info.Size()
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			// keep logging to the current file rather than losing messages; since it's still over
+			// size, rotation is retried on the next write
+			fmt.Fprintln(os.Stderr, "log rotation failed:", err)
+		}
+	}
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate moves the current file aside, opens a fresh one, and prunes old backups. The current file
+// is renamed while still open, and closed only once the new one is open, so that if anything fails
+// r.file is still usable. Must be called with r.mu held.
+func (r *rotatingFile) rotate() error {
+	backup := r.path + "." + time.Now().Format("20060102T150405.000")
+	if err := os.Rename(r.path, backup); err != nil {
+		return err
+	}
+	old := r.file
+	if err := r.open(); err != nil {
+		// put it back, so that the next attempt starts over; old is open either way
+		os.Rename(backup, r.path)
+		return err
+	}
+	old.Close()
+	r.prune()
+	return nil
+}
+
+// prune removes backups beyond maxBackups (oldest first) and any older than maxAge
+func (r *rotatingFile) prune() {
+	backups, err := filepath.Glob(r.path + ".*")
+	if err != nil {
+		return
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(backups))) // i.e. newest first, given timestamped names
+	for i, name := range backups {
+		expired := false
+		if r.maxAge > 0 {
+			if info, err := os.Stat(name); err == nil && time.Since(info.ModTime()) > r.maxAge {
+				expired = true
+			}
+		}
+		if (r.maxBackups > 0 && i >= r.maxBackups) || expired {
+			os.Remove(name)
+		}
+	}
+}
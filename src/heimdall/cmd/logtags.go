@@ -0,0 +1,119 @@
+// Copyright © 2018 Playground Global, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Per-tag log levels, per the LogLevels config field. playground/log has only a global level, so
+// the rest of Heimdall logs through log, below, which drops messages below their tag's level
+// before passing the rest on. The library's level stays as configured, since other code logs
+// through it directly; messages it would drop, from tags with a lower level of their own, are
+// written to the same standard library logger by the shim itself.
+
+import (
+	"fmt"
+	stdlog "log"
+	"strings"
+
+	plog "playground/log"
+)
+
+// logLevelNames maps the level names accepted in LogLevels to playground/log's levels
+var logLevelNames = map[string]int{
+	"debug":  plog.LEVEL_DEBUG,
+	"status": plog.LEVEL_STATUS,
+	"warn":   plog.LEVEL_WARNING,
+	"error":  plog.LEVEL_ERROR,
+}
+
+// logLevelLabels label the messages that tagLogger writes itself
+var logLevelLabels = map[int]string{
+	plog.LEVEL_DEBUG:   "DEBUG",
+	plog.LEVEL_STATUS:  "STATUS",
+	plog.LEVEL_WARNING: "WARN",
+	plog.LEVEL_ERROR:   "ERROR",
+}
+
+// tagLogger has the same logging functions as playground/log, but consults a level per tag
+type tagLogger struct {
+	level  int            // for tags not in levels
+	levels map[string]int // set once at startup, so read without locking
+}
+
+var log = &tagLogger{level: plog.LEVEL_STATUS, levels: map[string]int{}}
+
+// SetLogLevel sets the level for tags without their own
+func (l *tagLogger) SetLogLevel(level int) {
+	l.level = level
+	l.apply()
+}
+
+// SetTagLevels sets per-tag levels from names, e.g. {"/certs/": "debug"}
+func (l *tagLogger) SetTagLevels(names map[string]string) error {
+	levels := map[string]int{}
+	for tag, name := range names {
+		level, ok := logLevelNames[strings.ToLower(name)]
+		if !ok {
+			return fmt.Errorf("unknown log level '%s' for tag '%s'; must be debug, status, warn, or error", name, tag)
+		}
+		levels[tag] = level
+	}
+	l.levels = levels
+	l.apply()
+	return nil
+}
+
+// apply sets playground/log's level to the one for tags without their own
+func (l *tagLogger) apply() {
+	plog.SetLogLevel(l.level)
+}
+
+func (l *tagLogger) enabled(tag string, level int) bool {
+	if tagLevel, ok := l.levels[tag]; ok {
+		return level >= tagLevel
+	}
+	return level >= l.level
+}
+
+func (l *tagLogger) SetLogFile(file string) {
+	plog.SetLogFile(file)
+}
+
+// emit logs a message at level if tag's level allows it: via logf, playground/log's function for
+// that level, if the library's own level lets it through, else directly
+func (l *tagLogger) emit(tag string, level int, logf func(string, ...interface{}), a []interface{}) {
+	if !l.enabled(tag, level) {
+		return
+	}
+	if level >= l.level {
+		logf(tag, a...)
+		return
+	}
+	stdlog.Println(append([]interface{}{logLevelLabels[level], tag}, a...)...)
+}
+
+func (l *tagLogger) Debug(tag string, a ...interface{}) {
+	l.emit(tag, plog.LEVEL_DEBUG, plog.Debug, a)
+}
+
+func (l *tagLogger) Status(tag string, a ...interface{}) {
+	l.emit(tag, plog.LEVEL_STATUS, plog.Status, a)
+}
+
+func (l *tagLogger) Warn(tag string, a ...interface{}) {
+	l.emit(tag, plog.LEVEL_WARNING, plog.Warn, a)
+}
+
+func (l *tagLogger) Error(tag string, a ...interface{}) {
+	l.emit(tag, plog.LEVEL_ERROR, plog.Error, a)
+}
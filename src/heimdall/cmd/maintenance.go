@@ -0,0 +1,139 @@
+// Copyright © 2018 Playground Global, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Maintenance mode, in which mutating requests are refused with a 503 so that e.g. a CA rotation or
+// database work can proceed without half-finished writes, while reads still work. The mode is held
+// in memory rather than in the settings table, since the database may be the thing under
+// maintenance; it's toggled by PUT /maintenance or by sending the process a SIGHUP, and is off
+// whenever the server starts.
+
+import (
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"playground/httputil"
+)
+
+// maintenanceRetryAfterSeconds is sent in the Retry-After header of requests refused for
+// maintenance
+const maintenanceRetryAfterSeconds = 300
+
+var maintenance = struct {
+	sync.RWMutex
+	on    bool
+	since time.Time
+}{}
+
+// inMaintenance reports whether maintenance mode is on
+func inMaintenance() bool {
+	maintenance.RLock()
+	defer maintenance.RUnlock()
+	return maintenance.on
+}
+
+// setMaintenance turns maintenance mode on or off, logging if that's a change
+func setMaintenance(on bool) {
+	maintenance.Lock()
+	defer maintenance.Unlock()
+	if maintenance.on == on {
+		return
+	}
+	maintenance.on, maintenance.since = on, time.Now().UTC()
+	if on {
+		log.Warn("maintenance", "maintenance mode on; refusing mutating requests")
+	} else {
+		log.Status("maintenance", "maintenance mode off")
+	}
+}
+
+// watchMaintenanceSignal toggles maintenance mode on each SIGHUP
+func watchMaintenanceSignal() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	go func() {
+		for range sig {
+			setMaintenance(!inMaintenance())
+		}
+	}()
+}
+
+// withMaintenanceMode wraps a handler such that, in maintenance mode, only GET, HEAD, and OPTIONS
+// requests reach it. Others get a 503 (service unavailable) with a Retry-After header and body
+// {Error: "maintenance mode"}.
+func withMaintenanceMode(handler http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case "GET", "HEAD", "OPTIONS":
+		default:
+			if inMaintenance() {
+				log.Warn("withMaintenanceMode", "refused request during maintenance", req.Method, req.URL.Path, requestID(req))
+				writer.Header().Set("Retry-After", strconv.Itoa(maintenanceRetryAfterSeconds))
+				httputil.SendJSON(writer, http.StatusServiceUnavailable, struct{ Error string }{"maintenance mode"})
+				return
+			}
+		}
+		handler(writer, req)
+	}
+}
+
+func maintenanceHandler(writer http.ResponseWriter, req *http.Request) {
+	// GET /maintenance -- report whether maintenance mode is on
+	//   I: None
+	//   O: {MaintenanceMode: false, Since: ""}
+	//   200: the object above
+	//   Since is when the mode last changed, or "" if it hasn't since the server started.
+	// PUT /maintenance -- turn maintenance mode on or off
+	//   I: {MaintenanceMode: true}
+	//   O: {MaintenanceMode: true, Since: ""}
+	//   200: the new state; 400 (bad request): missing or malformed JSON
+	//   In maintenance mode, requests other than GETs to other endpoints get a 503. This endpoint
+	//   itself always works, so that the mode can be turned off again. A SIGHUP also toggles it.
+	// Non-GET/PUT: 405 (method not allowed)
+
+	TAG := "/maintenance"
+
+	if req.Method == "PUT" {
+		reqBody := &struct{ MaintenanceMode *bool }{}
+		if errs := decodeStrictJSON(reqBody, req); errs != nil {
+			log.Warn(TAG, "missing or malformed request JSON", errs)
+			sendFieldErrors(writer, errs)
+			return
+		}
+		if reqBody.MaintenanceMode == nil {
+			log.Warn(TAG, "missing MaintenanceMode")
+			sendFieldErrors(writer, fieldErrors{"MaintenanceMode": "required"})
+			return
+		}
+		log.Status(TAG, "maintenance mode set by operator", *reqBody.MaintenanceMode, operator(req), requestID(req))
+		setMaintenance(*reqBody.MaintenanceMode)
+	}
+
+	maintenance.RLock()
+	res := struct {
+		MaintenanceMode bool
+		Since           string
+	}{maintenance.on, ""}
+	if !maintenance.since.IsZero() {
+		res.Since = maintenance.since.Format(time.RFC3339)
+	}
+	maintenance.RUnlock()
+	httputil.SendJSON(writer, http.StatusOK, &res)
+}
@@ -0,0 +1,384 @@
+// Copyright © 2018 Playground Global, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// A minimal RFC 6960 OCSP responder. The ASN.1 structures below mirror those in the RFC; only the
+// subset needed to answer status queries for certs issued by our own CAs is implemented. Request
+// nonces are not echoed, which is what allows responses to be cached.
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509/pkix"
+	"database/sql"
+	"encoding/asn1"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	oidOCSPBasic       = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 1}
+	oidSHA1            = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	oidSHA256          = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidSHA384          = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2}
+	oidSHA512          = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 3}
+	oidSHA256WithRSA   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 11}
+	oidECDSAWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+)
+
+// OCSPResponseStatus values
+const (
+	ocspSuccessful       = 0
+	ocspMalformedRequest = 1
+	ocspInternalError    = 2
+	ocspUnauthorized     = 6
+)
+
+type ocspCertID struct {
+	HashAlgorithm pkix.AlgorithmIdentifier
+	NameHash      []byte
+	IssuerKeyHash []byte
+	SerialNumber  *big.Int
+}
+
+type ocspSingleRequest struct {
+	Cert ocspCertID
+}
+
+type ocspTBSRequest struct {
+	Version       int           `asn1:"explicit,tag:0,default:0,optional"`
+	RequestorName asn1.RawValue `asn1:"explicit,tag:1,optional"`
+	RequestList   []ocspSingleRequest
+}
+
+type ocspRequest struct {
+	TBSRequest ocspTBSRequest
+}
+
+type ocspRevokedInfo struct {
+	RevocationTime time.Time       `asn1:"generalized"`
+	Reason         asn1.Enumerated `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspSingleResponse struct {
+	CertID     ocspCertID
+	Good       asn1.Flag       `asn1:"tag:0,optional"`
+	Revoked    ocspRevokedInfo `asn1:"tag:1,optional"`
+	Unknown    asn1.Flag       `asn1:"tag:2,optional"`
+	ThisUpdate time.Time       `asn1:"generalized"`
+	NextUpdate time.Time       `asn1:"generalized,explicit,tag:0,optional"`
+}
+
+type ocspResponseData struct {
+	Version     int `asn1:"optional,default:0,explicit,tag:0"`
+	ResponderID asn1.RawValue
+	ProducedAt  time.Time `asn1:"generalized"`
+	Responses   []ocspSingleResponse
+}
+
+type ocspBasicResponse struct {
+	TBSResponseData    ocspResponseData
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          asn1.BitString
+}
+
+type ocspResponseBytes struct {
+	ResponseType asn1.ObjectIdentifier
+	Response     []byte
+}
+
+type ocspResponse struct {
+	Status   asn1.Enumerated
+	Response ocspResponseBytes `asn1:"explicit,tag:0,optional"`
+}
+
+// ocspCache holds signed responses keyed by the DER of the request list they answer
+var ocspCache = struct {
+	sync.Mutex
+	entries map[string]*ocspCacheEntry
+}{entries: make(map[string]*ocspCacheEntry)}
+
+type ocspCacheEntry struct {
+	response []byte
+	expires  time.Time
+	mark     int64 // revocationMark when the response was built
+}
+
+// resetOCSPCache discards all cached OCSP responses; called whenever a cert is revoked, so that
+// revocations take effect immediately rather than after the cache TTL
+func resetOCSPCache() {
+	ocspCache.Lock()
+	defer ocspCache.Unlock()
+	ocspCache.entries = make(map[string]*ocspCacheEntry)
+}
+
+// revocationMark returns a value that changes with every revocation, however it was made. The
+// command line's revocations happen in another process, which can't call resetOCSPCache, so
+// cached responses are only served while this hasn't changed since they were built.
+func revocationMark(ctx context.Context) int64 {
+	var mark int64
+	cxn := getDB()
+	defer cxn.Close()
+	if err := cxn.QueryRowContext(ctx, "select coalesce(max(revocation_seq), 0) from certs").Scan(&mark); err != nil {
+		panic(err)
+	}
+	return mark
+}
+
+// hashForOID returns a hash implementation for a CertID's hash algorithm, or nil if unsupported
+func hashForOID(oid asn1.ObjectIdentifier) hash.Hash {
+	switch {
+	case oid.Equal(oidSHA1):
+		return sha1.New()
+	case oid.Equal(oidSHA256):
+		return sha256.New()
+	case oid.Equal(oidSHA384):
+		return sha512.New384()
+	case oid.Equal(oidSHA512):
+		return sha512.New()
+	}
+	return nil
+}
+
+// subjectPublicKeyBits extracts the raw public key bits from a cert, which is what OCSP key hashes
+// are computed over
+func subjectPublicKeyBits(signer *caSigner) []byte {
+	var spki struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(signer.Cert.RawSubjectPublicKeyInfo, &spki); err != nil {
+		panic(err)
+	}
+	return spki.PublicKey.RightAlign()
+}
+
+// issuedBy reports whether a CertID names the indicated CA as its issuer
+func (id *ocspCertID) issuedBy(signer *caSigner) bool {
+	h := hashForOID(id.HashAlgorithm.Algorithm)
+	if h == nil {
+		return false
+	}
+	h.Write(signer.Cert.RawSubject)
+	if !bytes.Equal(h.Sum(nil), id.NameHash) {
+		return false
+	}
+	h.Reset()
+	h.Write(subjectPublicKeyBits(signer))
+	return bytes.Equal(h.Sum(nil), id.IssuerKeyHash)
+}
+
+// ocspStatusResponse marshals an unsigned response carrying only an error status
+func ocspStatusResponse(status int) []byte {
+	der, err := asn1.Marshal(ocspResponse{Status: asn1.Enumerated(status)})
+	if err != nil {
+		panic(err)
+	}
+	return der
+}
+
+// buildOCSPResponse answers a parsed request, signing with whichever trusted CA issued the first
+// cert in the request. Any other certs in the same request from a different issuer are reported
+// with status unknown.
+func buildOCSPResponse(req *http.Request, ocspReq *ocspRequest) []byte {
+	TAG := "buildOCSPResponse"
+	ctx := req.Context()
+
+	var signer *caSigner
+	first := &ocspReq.TBSRequest.RequestList[0].Cert
+	for _, s := range loadCASigners() {
+		if first.issuedBy(s) {
+			signer = s
+			break
+		}
+	}
+	if signer == nil {
+		log.Warn(TAG, "request for cert from unknown issuer")
+		return ocspStatusResponse(ocspUnauthorized)
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	ttl := time.Duration(cfg.OCSPCacheTTLSeconds) * time.Second
+
+	cxn := getDB()
+	defer cxn.Close()
+
+	responses := []ocspSingleResponse{}
+	for _, r := range ocspReq.TBSRequest.RequestList {
+		single := ocspSingleResponse{CertID: r.Cert, ThisUpdate: now, NextUpdate: now.Add(ttl)}
+		if !r.Cert.issuedBy(signer) {
+			single.Unknown = true
+			responses = append(responses, single)
+			continue
+		}
+
+		var revoked, reason string
+		q := "select coalesce(revoked, ''), revocation_reason from certs where serial=?"
+		err := cxn.QueryRowContext(ctx, q, fmt.Sprintf("%x", r.Cert.SerialNumber)).Scan(&revoked, &reason)
+		switch {
+		case err == sql.ErrNoRows:
+			single.Unknown = true
+		case err != nil:
+			panic(err)
+		case revoked == "":
+			single.Good = true
+		default:
+			t, err := time.Parse("2006-01-02 15:04:05", revoked)
+			if err != nil {
+				panic(err)
+			}
+			// unspecified (0) is left out, as RFC 5280 recommends; a zero Reason isn't encoded
+			single.Revoked = ocspRevokedInfo{RevocationTime: t.UTC(), Reason: asn1.Enumerated(revocationReasons[reason])}
+		}
+		responses = append(responses, single)
+	}
+
+	// responder is identified by the SHA-1 hash of its key, per RFC 6960 section 4.2.1
+	keyHash := sha1.Sum(subjectPublicKeyBits(signer))
+	responderID, err := asn1.Marshal(keyHash[:])
+	if err != nil {
+		panic(err)
+	}
+
+	tbs := ocspResponseData{
+		ResponderID: asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 2, IsCompound: true, Bytes: responderID},
+		ProducedAt:  now,
+		Responses:   responses,
+	}
+	tbsDER, err := asn1.Marshal(tbs)
+	if err != nil {
+		panic(err)
+	}
+
+	var sigAlg asn1.ObjectIdentifier
+	switch signer.Key.(type) {
+	case *rsa.PrivateKey:
+		sigAlg = oidSHA256WithRSA
+	case *ecdsa.PrivateKey:
+		sigAlg = oidECDSAWithSHA256
+	default:
+		panic("unsupported CA key type for OCSP signing")
+	}
+	digest := sha256.Sum256(tbsDER)
+	sig, err := signer.Key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		panic(err)
+	}
+
+	basic, err := asn1.Marshal(ocspBasicResponse{
+		TBSResponseData:    tbs,
+		SignatureAlgorithm: pkix.AlgorithmIdentifier{Algorithm: sigAlg},
+		Signature:          asn1.BitString{Bytes: sig, BitLength: 8 * len(sig)},
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	der, err := asn1.Marshal(ocspResponse{
+		Status:   ocspSuccessful,
+		Response: ocspResponseBytes{ResponseType: oidOCSPBasic, Response: basic},
+	})
+	if err != nil {
+		panic(err)
+	}
+	return der
+}
+
+func ocspHandler(writer http.ResponseWriter, req *http.Request) {
+	// GET /ocsp/<request> -- query cert status; <request> is the base64 DER OCSP request
+	// POST /ocsp -- query cert status; the body is the DER OCSP request
+	//   I: application/ocsp-request
+	//   O: application/ocsp-response
+	//   200: a response, which may itself carry an OCSP error status (e.g. malformedRequest)
+	// Non-GET/POST: 405 (method not allowed)
+	// Responses are cached for OCSPCacheTTLSeconds, which is also their nextUpdate. Revoking a cert
+	// clears the cache, as does any revocation made elsewhere, e.g. from the command line.
+
+	TAG := "/ocsp"
+
+	var der []byte
+	var err error
+	switch req.Method {
+	case "GET":
+		encoded := strings.TrimPrefix(req.URL.Path, "/ocsp/")
+		if der, err = base64.StdEncoding.DecodeString(encoded); err != nil {
+			der, err = base64.URLEncoding.DecodeString(encoded)
+		}
+	case "POST":
+		der, err = ioutil.ReadAll(http.MaxBytesReader(writer, req.Body, 64*1024))
+	default:
+		panic("API method sentinel misconfiguration")
+	}
+
+	send := func(response []byte) {
+		writer.Header().Set("Content-Type", "application/ocsp-response")
+		writer.WriteHeader(http.StatusOK)
+		writer.Write(response)
+	}
+
+	ocspReq := &ocspRequest{}
+	if err == nil {
+		_, err = asn1.Unmarshal(der, ocspReq)
+	}
+	if err != nil || len(ocspReq.TBSRequest.RequestList) == 0 {
+		log.Warn(TAG, "malformed OCSP request", err)
+		send(ocspStatusResponse(ocspMalformedRequest))
+		return
+	}
+
+	key, err := asn1.Marshal(ocspReq.TBSRequest.RequestList)
+	if err != nil {
+		panic(err)
+	}
+
+	// read before building the response, so that a revocation made meanwhile makes it stale
+	mark := revocationMark(req.Context())
+
+	ocspCache.Lock()
+	entry, ok := ocspCache.entries[string(key)]
+	ocspCache.Unlock()
+	if ok && time.Now().Before(entry.expires) && entry.mark == mark {
+		send(entry.response)
+		return
+	}
+
+	response := buildOCSPResponse(req, ocspReq)
+
+	ocspCache.Lock()
+	now := time.Now()
+	for k, e := range ocspCache.entries {
+		if now.After(e.expires) || e.mark != mark {
+			delete(ocspCache.entries, k)
+		}
+	}
+	ocspCache.entries[string(key)] = &ocspCacheEntry{response, now.Add(time.Duration(cfg.OCSPCacheTTLSeconds) * time.Second), mark}
+	ocspCache.Unlock()
+
+	send(response)
+}
@@ -0,0 +1,49 @@
+// Copyright © 2018 Playground Global, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Scheduling for background jobs, e.g. event pruning and expired cert revocation, that run on a
+// fixed interval for the life of the server.
+
+import (
+	"context"
+	"time"
+)
+
+// runPeriodically calls job every interval, forever; run it in its own goroutine. See runJob.
+func runPeriodically(tag string, interval time.Duration, job func(ctx context.Context)) {
+	for {
+		runJob(tag, job)
+		time.Sleep(interval)
+	}
+}
+
+// runJob calls job once, with a context bounded by DBQueryTimeoutMs, unless in maintenance mode. A
+// panic is logged rather than propagated, so that a transient database error doesn't take down
+// the server; the job is simply tried again on its next run.
+func runJob(tag string, job func(ctx context.Context)) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Error(tag, "background job failed", r)
+		}
+	}()
+
+	if inMaintenance() {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.DBQueryTimeoutMs)*time.Millisecond)
+	defer cancel()
+	job(ctx)
+}
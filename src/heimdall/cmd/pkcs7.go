@@ -0,0 +1,468 @@
+// Copyright © 2018 Playground Global, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// The subset of PKCS #7 (RFC 2315) that SCEP needs: SignedData with authenticated attributes,
+// EnvelopedData using RSA key transport with AES or 3DES in CBC mode, and "degenerate" certs-only
+// SignedData. Only DER is accepted, not the indefinite-length BER some toolkits can emit.
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+)
+
+// digest and signature algorithm OIDs are shared with the OCSP responder; see ocsp.go
+var (
+	oidPKCS7Data          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidPKCS7SignedData    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidPKCS7EnvelopedData = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 3}
+	oidAttrContentType    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+	oidAttrMessageDigest  = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	oidRSAEncryption      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	oidAES128CBC          = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC          = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC          = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+	oidDESEDE3CBC         = asn1.ObjectIdentifier{1, 2, 840, 113549, 3, 7}
+)
+
+// pkcs7Digests maps the digest algorithms accepted in signed messages to their hashes
+var pkcs7Digests = map[string]crypto.Hash{
+	oidSHA1.String():   crypto.SHA1,
+	oidSHA256.String(): crypto.SHA256,
+	oidSHA384.String(): crypto.SHA384,
+	oidSHA512.String(): crypto.SHA512,
+}
+
+// pkcs7KeySizes maps the content encryption algorithms accepted in enveloped messages to their key
+// sizes in bytes
+var pkcs7KeySizes = map[string]int{
+	oidAES128CBC.String():  16,
+	oidAES192CBC.String():  24,
+	oidAES256CBC.String():  32,
+	oidDESEDE3CBC.String(): 24,
+}
+
+// Tagged fields are asn1.RawValues with their class and tag set explicitly, since encoding/asn1
+// ignores struct tags when marshaling a RawValue; "explicit" fields thus hold the whole inner
+// element in Bytes, and "implicit" ones its contents.
+
+type pkcs7ContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"optional,tag:0"` // explicit
+}
+
+type pkcs7IssuerAndSerial struct {
+	Issuer       asn1.RawValue
+	SerialNumber *big.Int
+}
+
+type pkcs7Attribute struct {
+	Type   asn1.ObjectIdentifier
+	Values asn1.RawValue // a SET; only the first value is used
+}
+
+type pkcs7SignerInfo struct {
+	Version                   int
+	IssuerAndSerialNumber     pkcs7IssuerAndSerial
+	DigestAlgorithm           pkix.AlgorithmIdentifier
+	AuthenticatedAttributes   asn1.RawValue `asn1:"optional,tag:0"` // implicit SET OF pkcs7Attribute
+	DigestEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedDigest           []byte
+	UnauthenticatedAttributes asn1.RawValue `asn1:"optional,tag:1"`
+}
+
+type pkcs7SignedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	ContentInfo      pkcs7ContentInfo
+	Certificates     asn1.RawValue     `asn1:"optional,tag:0"` // implicit SET OF Certificate
+	CRLs             asn1.RawValue     `asn1:"optional,tag:1"`
+	SignerInfos      []pkcs7SignerInfo `asn1:"set"`
+}
+
+type pkcs7RecipientInfo struct {
+	Version                int
+	IssuerAndSerialNumber  pkcs7IssuerAndSerial
+	KeyEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedKey           []byte
+}
+
+type pkcs7EncryptedContentInfo struct {
+	ContentType                asn1.ObjectIdentifier
+	ContentEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedContent           asn1.RawValue `asn1:"optional,tag:0"` // implicit OCTET STRING
+}
+
+type pkcs7EnvelopedData struct {
+	Version              int
+	RecipientInfos       []pkcs7RecipientInfo `asn1:"set"`
+	EncryptedContentInfo pkcs7EncryptedContentInfo
+}
+
+// pkcs7Signed is a verified SignedData message
+type pkcs7Signed struct {
+	Content    []byte
+	Signer     *x509.Certificate
+	Attributes map[string]asn1.RawValue // first value of each authenticated attribute, by OID
+}
+
+// newPKCS7Attribute encodes value (per encoding/asn1 params, e.g. "printable") as an attribute
+func newPKCS7Attribute(oid asn1.ObjectIdentifier, value interface{}, params string) (pkcs7Attribute, error) {
+	der, err := asn1.MarshalWithParams(value, params)
+	if err != nil {
+		return pkcs7Attribute{}, err
+	}
+	return rawPKCS7Attribute(oid, der), nil
+}
+
+// rawPKCS7Attribute makes an attribute of an already-encoded value
+func rawPKCS7Attribute(oid asn1.ObjectIdentifier, der []byte) pkcs7Attribute {
+	return pkcs7Attribute{oid, asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: der}}
+}
+
+// wrapPKCS7 encodes content as a ContentInfo of the given type
+func wrapPKCS7(contentType asn1.ObjectIdentifier, content interface{}) ([]byte, error) {
+	inner, err := asn1.Marshal(content)
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(pkcs7ContentInfo{contentType, asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: inner}})
+}
+
+// unwrapPKCS7 parses a ContentInfo of the given type into content
+func unwrapPKCS7(der []byte, contentType asn1.ObjectIdentifier, content interface{}) error {
+	var ci pkcs7ContentInfo
+	if rest, err := asn1.Unmarshal(der, &ci); err != nil {
+		return err
+	} else if len(rest) > 0 {
+		return errors.New("trailing data after PKCS #7 message")
+	}
+	if !ci.ContentType.Equal(contentType) {
+		return fmt.Errorf("PKCS #7 content type is %s, not %s", ci.ContentType, contentType)
+	}
+	if rest, err := asn1.Unmarshal(ci.Content.Bytes, content); err != nil {
+		return err
+	} else if len(rest) > 0 {
+		return errors.New("trailing data in PKCS #7 content")
+	}
+	return nil
+}
+
+// issuerAndSerial identifies cert as PKCS #7 does
+func issuerAndSerial(cert *x509.Certificate) pkcs7IssuerAndSerial {
+	return pkcs7IssuerAndSerial{asn1.RawValue{FullBytes: cert.RawIssuer}, cert.SerialNumber}
+}
+
+// matches reports whether ias identifies cert
+func (ias pkcs7IssuerAndSerial) matches(cert *x509.Certificate) bool {
+	return bytes.Equal(ias.Issuer.FullBytes, cert.RawIssuer) && ias.SerialNumber != nil && ias.SerialNumber.Cmp(cert.SerialNumber) == 0
+}
+
+// pkcs7Sign returns a SignedData ContentInfo of content (which may be nil, for no content), signed
+// by key with SHA-256, carrying cert, and with contentType and messageDigest attributes added to
+// attrs
+func pkcs7Sign(content []byte, cert *x509.Certificate, key crypto.Signer, attrs []pkcs7Attribute) ([]byte, error) {
+	digest := crypto.SHA256.New()
+	digest.Write(content)
+	contentType, err := newPKCS7Attribute(oidAttrContentType, oidPKCS7Data, "")
+	if err != nil {
+		return nil, err
+	}
+	messageDigest, err := newPKCS7Attribute(oidAttrMessageDigest, digest.Sum(nil), "")
+	if err != nil {
+		return nil, err
+	}
+
+	// DER orders the members of a SET by their encodings
+	encoded := [][]byte{}
+	for _, attr := range append([]pkcs7Attribute{contentType, messageDigest}, attrs...) {
+		der, err := asn1.Marshal(attr)
+		if err != nil {
+			return nil, err
+		}
+		encoded = append(encoded, der)
+	}
+	sort.Slice(encoded, func(i, j int) bool { return bytes.Compare(encoded[i], encoded[j]) < 0 })
+	attrSet := bytes.Join(encoded, nil)
+
+	// the signature covers the attributes, encoded as a SET rather than with their implicit tag
+	signed, err := asn1.Marshal(asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: attrSet})
+	if err != nil {
+		return nil, err
+	}
+	digest = crypto.SHA256.New()
+	digest.Write(signed)
+	sig, err := key.Sign(rand.Reader, digest.Sum(nil), crypto.SHA256)
+	if err != nil {
+		return nil, err
+	}
+	sigAlg := pkix.AlgorithmIdentifier{Algorithm: oidRSAEncryption, Parameters: asn1.NullRawValue}
+	if _, ok := key.Public().(*ecdsa.PublicKey); ok {
+		sigAlg = pkix.AlgorithmIdentifier{Algorithm: oidECDSAWithSHA256}
+	}
+
+	digestAlg := pkix.AlgorithmIdentifier{Algorithm: oidSHA256, Parameters: asn1.NullRawValue}
+	sd := pkcs7SignedData{
+		Version:          1,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{digestAlg},
+		ContentInfo:      pkcs7ContentInfo{ContentType: oidPKCS7Data},
+		Certificates:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: cert.Raw},
+		SignerInfos: []pkcs7SignerInfo{{
+			Version:                   1,
+			IssuerAndSerialNumber:     issuerAndSerial(cert),
+			DigestAlgorithm:           digestAlg,
+			AuthenticatedAttributes:   asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: attrSet},
+			DigestEncryptionAlgorithm: sigAlg,
+			EncryptedDigest:           sig,
+		}},
+	}
+	if content != nil {
+		inner, err := asn1.Marshal(content)
+		if err != nil {
+			return nil, err
+		}
+		sd.ContentInfo.Content = asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: inner}
+	}
+	return wrapPKCS7(oidPKCS7SignedData, sd)
+}
+
+// pkcs7Verify parses a SignedData ContentInfo with a single signer, whose cert must be included,
+// and checks its signature and messageDigest attribute
+func pkcs7Verify(der []byte) (*pkcs7Signed, error) {
+	var sd pkcs7SignedData
+	if err := unwrapPKCS7(der, oidPKCS7SignedData, &sd); err != nil {
+		return nil, err
+	}
+	if len(sd.SignerInfos) != 1 {
+		return nil, fmt.Errorf("expected 1 signer, found %d", len(sd.SignerInfos))
+	}
+	si := sd.SignerInfos[0]
+
+	certs, err := x509.ParseCertificates(sd.Certificates.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	res := &pkcs7Signed{Attributes: map[string]asn1.RawValue{}}
+	for _, cert := range certs {
+		if si.IssuerAndSerialNumber.matches(cert) {
+			res.Signer = cert
+			break
+		}
+	}
+	if res.Signer == nil {
+		return nil, errors.New("signer's certificate not included")
+	}
+	if len(sd.ContentInfo.Content.Bytes) > 0 {
+		if _, err := asn1.Unmarshal(sd.ContentInfo.Content.Bytes, &res.Content); err != nil {
+			return nil, err
+		}
+	}
+
+	for rest := si.AuthenticatedAttributes.Bytes; len(rest) > 0; {
+		var attr pkcs7Attribute
+		if rest, err = asn1.Unmarshal(rest, &attr); err != nil {
+			return nil, err
+		}
+		var value asn1.RawValue
+		if _, err := asn1.Unmarshal(attr.Values.Bytes, &value); err != nil {
+			return nil, err
+		}
+		res.Attributes[attr.Type.String()] = value
+	}
+
+	hash, ok := pkcs7Digests[si.DigestAlgorithm.Algorithm.String()]
+	if !ok {
+		return nil, fmt.Errorf("unsupported digest algorithm %s", si.DigestAlgorithm.Algorithm)
+	}
+	var messageDigest []byte
+	if _, err := asn1.Unmarshal(res.Attributes[oidAttrMessageDigest.String()].FullBytes, &messageDigest); err != nil {
+		return nil, errors.New("missing or malformed messageDigest attribute")
+	}
+	digest := hash.New()
+	digest.Write(res.Content)
+	if !bytes.Equal(digest.Sum(nil), messageDigest) {
+		return nil, errors.New("messageDigest does not match content")
+	}
+
+	signed, err := asn1.Marshal(asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: si.AuthenticatedAttributes.Bytes})
+	if err != nil {
+		return nil, err
+	}
+	digest = hash.New()
+	digest.Write(signed)
+	switch pub := res.Signer.PublicKey.(type) {
+	case *rsa.PublicKey:
+		err = rsa.VerifyPKCS1v15(pub, hash, digest.Sum(nil), si.EncryptedDigest)
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(pub, digest.Sum(nil), si.EncryptedDigest) {
+			err = errors.New("ECDSA signature does not verify")
+		}
+	default:
+		err = errors.New("unsupported signer key type")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// pkcs7Cipher returns a CBC-mode block cipher for a content encryption algorithm
+func pkcs7Cipher(alg asn1.ObjectIdentifier, key []byte) (cipher.Block, error) {
+	if size, ok := pkcs7KeySizes[alg.String()]; !ok {
+		return nil, fmt.Errorf("unsupported content encryption algorithm %s", alg)
+	} else if len(key) != size {
+		return nil, errors.New("content encryption key is the wrong size")
+	}
+	if alg.Equal(oidDESEDE3CBC) {
+		return des.NewTripleDESCipher(key)
+	}
+	return aes.NewCipher(key)
+}
+
+// pkcs7Encrypt returns an EnvelopedData ContentInfo of content, encrypted with alg under a random
+// key, which is in turn encrypted to recipient's RSA key
+func pkcs7Encrypt(content []byte, recipient *x509.Certificate, alg asn1.ObjectIdentifier) ([]byte, error) {
+	pub, ok := recipient.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("recipient's key is not RSA")
+	}
+	size, ok := pkcs7KeySizes[alg.String()]
+	if !ok {
+		return nil, fmt.Errorf("unsupported content encryption algorithm %s", alg)
+	}
+	key := make([]byte, size)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	block, err := pkcs7Cipher(alg, key)
+	if err != nil {
+		return nil, err
+	}
+	iv := make([]byte, block.BlockSize())
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+	pad := block.BlockSize() - len(content)%block.BlockSize()
+	ciphertext := append(append([]byte{}, content...), bytes.Repeat([]byte{byte(pad)}, pad)...)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(ciphertext, ciphertext)
+
+	encryptedKey, err := rsa.EncryptPKCS1v15(rand.Reader, pub, key)
+	if err != nil {
+		return nil, err
+	}
+	params, err := asn1.Marshal(iv)
+	if err != nil {
+		return nil, err
+	}
+	return wrapPKCS7(oidPKCS7EnvelopedData, pkcs7EnvelopedData{
+		RecipientInfos: []pkcs7RecipientInfo{{
+			IssuerAndSerialNumber:  issuerAndSerial(recipient),
+			KeyEncryptionAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidRSAEncryption, Parameters: asn1.NullRawValue},
+			EncryptedKey:           encryptedKey,
+		}},
+		EncryptedContentInfo: pkcs7EncryptedContentInfo{
+			ContentType:                oidPKCS7Data,
+			ContentEncryptionAlgorithm: pkix.AlgorithmIdentifier{Algorithm: alg, Parameters: asn1.RawValue{FullBytes: params}},
+			EncryptedContent:           asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, Bytes: ciphertext},
+		},
+	})
+}
+
+// pkcs7Decrypt decrypts an EnvelopedData ContentInfo addressed to one of recipients, whose keys
+// must be RSA. It also returns the content encryption algorithm, so a reply can use the same.
+func pkcs7Decrypt(der []byte, recipients []*caSigner) ([]byte, asn1.ObjectIdentifier, error) {
+	var ed pkcs7EnvelopedData
+	if err := unwrapPKCS7(der, oidPKCS7EnvelopedData, &ed); err != nil {
+		return nil, nil, err
+	}
+	var encryptedKey []byte
+	var decrypter crypto.Decrypter
+	for _, ri := range ed.RecipientInfos {
+		for _, r := range recipients {
+			if ri.IssuerAndSerialNumber.matches(r.Cert) {
+				encryptedKey = ri.EncryptedKey
+				decrypter, _ = r.Key.(crypto.Decrypter)
+			}
+		}
+	}
+	if decrypter == nil {
+		return nil, nil, errors.New("not encrypted to a CA with an RSA key")
+	}
+	key, err := decrypter.Decrypt(rand.Reader, encryptedKey, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	eci := ed.EncryptedContentInfo
+	alg := eci.ContentEncryptionAlgorithm.Algorithm
+	block, err := pkcs7Cipher(alg, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	var iv []byte
+	if _, err := asn1.Unmarshal(eci.ContentEncryptionAlgorithm.Parameters.FullBytes, &iv); err != nil || len(iv) != block.BlockSize() {
+		return nil, nil, errors.New("missing or malformed IV")
+	}
+	ciphertext := eci.EncryptedContent.Bytes
+	if eci.EncryptedContent.IsCompound { // i.e. split into a series of OCTET STRINGs
+		ciphertext = nil
+		for rest := eci.EncryptedContent.Bytes; len(rest) > 0; {
+			var chunk []byte
+			if rest, err = asn1.Unmarshal(rest, &chunk); err != nil {
+				return nil, nil, err
+			}
+			ciphertext = append(ciphertext, chunk...)
+		}
+	}
+	if len(ciphertext) == 0 || len(ciphertext)%block.BlockSize() != 0 {
+		return nil, nil, errors.New("encrypted content is not a whole number of blocks")
+	}
+	plaintext := make([]byte, len(ciphertext))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plaintext, ciphertext)
+	pad := int(plaintext[len(plaintext)-1])
+	if pad == 0 || pad > block.BlockSize() || !bytes.Equal(plaintext[len(plaintext)-pad:], bytes.Repeat([]byte{byte(pad)}, pad)) {
+		return nil, nil, errors.New("bad padding in decrypted content")
+	}
+	return plaintext[:len(plaintext)-pad], alg, nil
+}
+
+// pkcs7CertsOnly returns a "degenerate" SignedData ContentInfo, with no content or signers, that
+// just carries certs
+func pkcs7CertsOnly(certs []*x509.Certificate) ([]byte, error) {
+	raw := []byte{}
+	for _, cert := range certs {
+		raw = append(raw, cert.Raw...)
+	}
+	return wrapPKCS7(oidPKCS7SignedData, pkcs7SignedData{
+		Version:          1,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{},
+		ContentInfo:      pkcs7ContentInfo{ContentType: oidPKCS7Data},
+		Certificates:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: raw},
+		SignerInfos:      []pkcs7SignerInfo{},
+	})
+}
@@ -0,0 +1,102 @@
+// Copyright © 2018 Playground Global, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Masking of secrets in request data before it's logged. Anything that logs request headers or
+// bodies must go through redactedHeaders or redactedBody, so that debug logging can't leak the API
+// secret, key passphrases, TOTP codes, and the like into the log file.
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// redactedValue replaces the values of sensitive headers and JSON fields
+const redactedValue = "[redacted]"
+
+// sensitiveHeaders are the (canonical) names of request headers whose values are never logged,
+// in addition to cfg.APIHeader
+var sensitiveHeaders = map[string]bool{
+	"Authorization":       true,
+	"Cookie":              true,
+	"Proxy-Authorization": true,
+	"X-Heimdall-Secret":   true,
+}
+
+// sensitiveFields are the (lowercased) names of JSON fields whose values are never logged, at
+// any depth
+var sensitiveFields = map[string]bool{
+	"keypassphrase":     true,
+	"passphrase":        true,
+	"password":          true,
+	"challengepassword": true,
+	"secret":            true,
+	"apisecret":         true,
+	"seed":              true,
+	"seeds":             true,
+	"code":              true,
+	"totp":              true,
+	"privatekey":        true,
+}
+
+// redactedHeaders returns a copy of h with the values of sensitive headers masked
+func redactedHeaders(h http.Header) http.Header {
+	ret := http.Header{}
+	for k, v := range h {
+		ck := http.CanonicalHeaderKey(k)
+		if sensitiveHeaders[ck] || ck == http.CanonicalHeaderKey(cfg.APIHeader) {
+			v = []string{redactedValue}
+		}
+		ret[k] = v
+	}
+	return ret
+}
+
+// redactedBody returns a request body for logging, with the values of sensitive JSON fields
+// masked. A body that isn't JSON isn't logged at all, since there's no telling what's in it; only
+// its size is.
+func redactedBody(body []byte) string {
+	var v interface{}
+	if err := json.Unmarshal(body, &v); err != nil {
+		return fmt.Sprintf("[%d bytes, not JSON]", len(body))
+	}
+	b, err := json.Marshal(redactJSON(v))
+	if err != nil {
+		return fmt.Sprintf("[%d bytes]", len(body))
+	}
+	return string(b)
+}
+
+// redactJSON masks the values of sensitive fields in a decoded JSON value, recursing into objects
+// and arrays
+func redactJSON(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, fv := range t {
+			if sensitiveFields[strings.ToLower(k)] {
+				t[k] = redactedValue
+			} else {
+				t[k] = redactJSON(fv)
+			}
+		}
+	case []interface{}:
+		for i, ev := range t {
+			t[i] = redactJSON(ev)
+		}
+	}
+	return v
+}
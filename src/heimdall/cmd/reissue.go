@@ -0,0 +1,127 @@
+// Copyright © 2018 Playground Global, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net/http"
+
+	"playground/httputil"
+)
+
+// reissueUserCerts handles POST /user/<email>/reissue; see userHandler. Replacement certs are
+// generated before the transaction that swaps them in, so that slow key generation doesn't hold the
+// database's write lock; a cert revoked meanwhile is skipped, and its replacement discarded.
+func reissueUserCerts(writer http.ResponseWriter, req *http.Request, email string) {
+	TAG := "reissueUserCerts"
+	ctx := req.Context()
+	s := loadSettings(ctx)
+
+	if s.RequireApproval {
+		log.Warn(TAG, "refused reissue; RequireApproval is set", email)
+		httputil.SendJSON(writer, http.StatusConflict, struct{ Error string }{"not available when RequireApproval is set"})
+		return
+	}
+
+	type old struct{ Fingerprint, Description string }
+	olds := []old{}
+	cxn := getDB()
+	defer cxn.Close()
+	var exists int
+	if err := cxn.QueryRowContext(ctx, "select count(*) from totp where email=? and archived is null", email).Scan(&exists); err != nil {
+		panic(err)
+	}
+	if exists == 0 {
+		log.Warn(TAG, "attempt to reissue certs of nonexistent or archived user", email)
+		httputil.SendJSON(writer, http.StatusNotFound, struct{}{})
+		return
+	}
+	q := "select fingerprint, coalesce(desc, '') from certs where email=? and revoked is null and expires > datetime('now') order by rowid"
+	rows, err := cxn.QueryContext(ctx, q, email)
+	if err != nil {
+		panic(err)
+	}
+	for rows.Next() {
+		o := old{}
+		if err := rows.Scan(&o.Fingerprint, &o.Description); err != nil {
+			rows.Close()
+			panic(err)
+		}
+		olds = append(olds, o)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		panic(err)
+	}
+
+	profile := profileForEmail(s, email, "")
+	tmpl := ovpnTemplate
+	if profile != "" {
+		tmpl = ovpnProfiles[profile]
+	}
+
+	type replacement struct {
+		OldFingerprint, Fingerprint, Description, OVPNDataURL string
+		cert                                                  *x509.Certificate
+	}
+	reps := []*replacement{}
+	for _, o := range olds {
+		cert, ovpn, _, err := renderCert(req, s, email, 0, "", tmpl)
+		if err != nil {
+			// i.e. the template is broken; nothing has been revoked yet
+			log.Error(TAG, "rendered .ovpn is malformed; check the template", profile, err)
+			httputil.SendJSON(writer, http.StatusInternalServerError, struct{ Error string }{"internal"})
+			return
+		}
+		reps = append(reps, &replacement{o.Fingerprint, certFingerprint(cert), o.Description, ovpnDataURL(ovpn), cert})
+	}
+
+	tx, err := cxn.BeginTx(ctx, nil)
+	if err != nil {
+		panic(err)
+	}
+	defer tx.Rollback()
+	res := struct{ Certs []*replacement }{[]*replacement{}}
+	for _, r := range reps {
+		q := "update certs set revoked=datetime('now'), revocation_reason='superseded' where fingerprint=? and revoked is null"
+		result, err := tx.ExecContext(ctx, q, r.OldFingerprint)
+		if err != nil {
+			panic(err)
+		}
+		if n, err := result.RowsAffected(); err != nil {
+			panic(err)
+		} else if n == 0 {
+			log.Warn(TAG, "cert revoked during reissue; not replacing it", email, r.OldFingerprint)
+			continue
+		}
+		if err := recordEventTx(tx, req, "certificate revoked", email, fmt.Sprintf("%s - superseded by %s", r.OldFingerprint, r.Fingerprint)); err != nil {
+			panic(err)
+		}
+		if err := recordIssuedCertTx(tx, req, email, r.Description, r.cert); err != nil {
+			panic(err)
+		}
+		res.Certs = append(res.Certs, r)
+	}
+	if err := tx.Commit(); err != nil {
+		panic(err)
+	}
+	if len(res.Certs) > 0 {
+		resetOCSPCache()
+	}
+
+	log.Status(TAG, fmt.Sprintf("reissued %d certificates for '%s'", len(res.Certs), email), requestID(req))
+	httputil.SendJSON(writer, http.StatusOK, &res)
+}
@@ -0,0 +1,340 @@
+// Copyright © 2018 Playground Global, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// SCEP (RFC 8894) enrollment, for network devices and MDM systems that can't use the JSON API.
+// Enrollment is gated by the SCEPChallengePassword config field, which must appear as the
+// challengePassword attribute of each CSR; SCEP is disabled if it's unset. Only initial enrollment
+// (PKCSReq) is supported, not renewal or polling, since requests are never left pending.
+//
+// Those clients can't present a Bifrost client cert, so SCEP is served on its own listener, on
+// SCEPBindAddress:SCEPPort, rather than the main one. It's plain HTTP, as the protocol expects:
+// requests and responses are signed and encrypted at the message level.
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/asn1"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"playground/httputil"
+)
+
+var (
+	oidSCEPMessageType    = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 2}
+	oidSCEPPKIStatus      = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 3}
+	oidSCEPFailInfo       = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 4}
+	oidSCEPSenderNonce    = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 5}
+	oidSCEPRecipientNonce = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 6}
+	oidSCEPTransactionID  = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 7}
+	oidChallengePassword  = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 7}
+)
+
+// SCEP message types, PKI statuses, and failure reasons, which the protocol encodes as decimal
+// strings
+const (
+	scepCertRep = "3"
+	scepPKCSReq = "19"
+
+	scepSuccess = "0"
+	scepFailure = "2"
+
+	scepBadAlg     = "0"
+	scepBadRequest = "2"
+)
+
+// scepCACaps is the response to GetCACaps
+const scepCACaps = "POSTPKIOperation\nSHA-256\nAES\nSCEPStandard\n"
+
+// startSCEPListener starts serving /scep on SCEPPort in the background, unless SCEPPort is 0. A
+// failure to listen panics, as for startAdminListener.
+func startSCEPListener() {
+	TAG := "server.scep"
+
+	if cfg.SCEPPort == 0 {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/scep", withAccessLog(withRequestID(withPanicRecovery(withMethodSentry(withMaintenanceMode(withMaxBodySize(cfg.MaxRequestBodyBytes, withDBDeadline(scepHandler))), "GET", "POST")))))
+	mux.HandleFunc("/", func(writer http.ResponseWriter, req *http.Request) {
+		log.Warn(TAG, "incoming unknown request to '"+req.URL.Path+"'")
+		httputil.SendJSON(writer, http.StatusNotFound, struct{}{})
+	})
+
+	addr := net.JoinHostPort(cfg.SCEPBindAddress, strconv.Itoa(cfg.SCEPPort))
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		panic(err)
+	}
+	server := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       30 * time.Second,
+		WriteTimeout:      30 * time.Second,
+		IdleTimeout:       60 * time.Second,
+		MaxHeaderBytes:    1 << 16,
+	}
+
+	log.Status(TAG, "starting SCEP HTTP on "+addr)
+	go func() {
+		log.Error(TAG, "shutting down; error?", server.Serve(l))
+	}()
+}
+
+// scepRequest is a decoded PKIOperation message
+type scepRequest struct {
+	MessageType   string
+	TransactionID asn1.RawValue // echoed back as received
+	SenderNonce   []byte
+	Signer        *x509.Certificate
+	Alg           asn1.ObjectIdentifier
+	CSR           []byte
+}
+
+func scepHandler(writer http.ResponseWriter, req *http.Request) {
+	// GET /scep?operation=GetCACaps -- list the SCEP capabilities supported
+	//   I: None
+	//   O: text/plain, one capability per line
+	//   200: the list
+	// GET /scep?operation=GetCACert -- fetch the CA cert that enrollment requests are encrypted to
+	//   I: None
+	//   O: the signing CA's cert in DER, as application/x-x509-ca-cert; or, if it has a chain, a
+	//   certs-only PKCS #7 of it and the chain, as application/x-x509-ca-ra-cert
+	//   200: the cert(s)
+	// POST /scep?operation=PKIOperation -- enroll, i.e. issue a cert for a CSR
+	//   I: a PKCSReq pkiMessage, as application/x-pki-message
+	//   O: a CertRep pkiMessage, as application/x-pki-message
+	//   200: the CertRep, whether success or failure; 400 (bad request): message couldn't be
+	//   decoded well enough to reply to
+	//   The CSR's CN must be the email of an existing, unarchived user, and its challengePassword
+	//   the SCEPChallengePassword config field. Issuance is otherwise subject to the same settings
+	//   as POST /certs/<email>/sign, and records a "certificate issued" event. Every failure up to
+	//   and including the challengePassword check has failInfo badRequest, so that the CertRep
+	//   says nothing about how far the encrypted request got (e.g. whether its padding was valid.)
+	// Any operation: 404 if SCEPChallengePassword is unset; 400 for unknown operations
+	// Non-GET/POST: 405 (method not allowed)
+	// Served only on the SCEP listener (see startSCEPListener), not the main one.
+
+	TAG := "/scep"
+	ctx := req.Context()
+
+	if cfg.SCEPChallengePassword == "" {
+		log.Debug(TAG, "SCEP request, but SCEP is not enabled")
+		httputil.SendJSON(writer, http.StatusNotFound, struct{}{})
+		return
+	}
+
+	switch op := req.URL.Query().Get("operation"); {
+	case op == "GetCACaps":
+		writer.Header().Set("Content-Type", "text/plain")
+		writer.Write([]byte(scepCACaps))
+
+	case op == "GetCACert":
+		s := loadSettings(ctx)
+		signer := loadSigningSigner(s)
+		chainFile := cfg.CAChainFile
+		if s.SigningCA == "next" {
+			chainFile = cfg.NextCAChainFile
+		}
+		if chainFile == "" {
+			writer.Header().Set("Content-Type", "application/x-x509-ca-cert")
+			writer.Write(signer.Cert.Raw)
+			return
+		}
+		chain, _, err := readPEMCerts(chainFile)
+		if err != nil {
+			panic(err)
+		}
+		der, err := pkcs7CertsOnly(append([]*x509.Certificate{signer.Cert}, chain...))
+		if err != nil {
+			panic(err)
+		}
+		writer.Header().Set("Content-Type", "application/x-x509-ca-ra-cert")
+		writer.Write(der)
+
+	case op == "PKIOperation" && req.Method == "POST":
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			log.Warn(TAG, "unreadable request body", err)
+			httputil.SendJSON(writer, http.StatusBadRequest, struct{}{})
+			return
+		}
+		scepEnroll(writer, req, body)
+
+	default:
+		log.Warn(TAG, "unknown or unsupported SCEP operation", req.Method, op)
+		httputil.SendJSON(writer, http.StatusBadRequest, struct{}{})
+	}
+}
+
+// scepEnroll handles a PKIOperation; see scepHandler
+func scepEnroll(writer http.ResponseWriter, req *http.Request, body []byte) {
+	TAG := "/scep"
+	ctx := req.Context()
+
+	msg, err := pkcs7Verify(body)
+	if err != nil {
+		// without a verified signer, there's no one to address a CertRep to
+		log.Warn(TAG, "undecodable or unverifiable pkiMessage", err, requestID(req))
+		httputil.SendJSON(writer, http.StatusBadRequest, struct{}{})
+		return
+	}
+	sr := &scepRequest{Signer: msg.Signer, TransactionID: msg.Attributes[oidSCEPTransactionID.String()]}
+	asn1.Unmarshal(msg.Attributes[oidSCEPMessageType.String()].FullBytes, &sr.MessageType)
+	asn1.Unmarshal(msg.Attributes[oidSCEPSenderNonce.String()].FullBytes, &sr.SenderNonce)
+	if len(sr.TransactionID.FullBytes) == 0 || len(sr.SenderNonce) == 0 {
+		log.Warn(TAG, "pkiMessage without transactionID or senderNonce", requestID(req))
+		httputil.SendJSON(writer, http.StatusBadRequest, struct{}{})
+		return
+	}
+	fail := func(failInfo string, why ...interface{}) {
+		log.Warn(TAG, append([]interface{}{"refused SCEP enrollment"}, append(why, requestID(req))...)...)
+		sendSCEPResponse(writer, req, sr, nil, failInfo)
+	}
+	if sr.MessageType != scepPKCSReq {
+		fail(scepBadRequest, "unsupported messageType", sr.MessageType)
+		return
+	}
+	// until the challengePassword has been checked, every failure gets the same failInfo, lest the
+	// response become a padding oracle over the encrypted CSR
+	if sr.CSR, sr.Alg, err = pkcs7Decrypt(msg.Content, loadCASigners()); err != nil {
+		fail(scepBadRequest, "undecryptable pkcsPKIEnvelope", err)
+		return
+	}
+	if _, ok := sr.Signer.PublicKey.(*rsa.PublicKey); !ok {
+		// the issued cert is encrypted to the signer's key, and PKCS #7 key transport is RSA-only here
+		fail(scepBadRequest, "signer's key is not RSA")
+		return
+	}
+
+	csr, err := x509.ParseCertificateRequest(sr.CSR)
+	if err != nil || csr.CheckSignature() != nil {
+		fail(scepBadRequest, "malformed CSR, or its signature doesn't verify")
+		return
+	}
+	challenge, err := csrChallengePassword(csr)
+	if err != nil || subtle.ConstantTimeCompare([]byte(challenge), []byte(cfg.SCEPChallengePassword)) != 1 {
+		fail(scepBadRequest, "wrong or missing challengePassword", csr.Subject.CommonName)
+		return
+	}
+	email, err := normalizeEmail(csr.Subject.CommonName)
+	if err != nil {
+		fail(scepBadRequest, "CN is not an email", csr.Subject.CommonName)
+		return
+	}
+	if problem := checkCSRKey(csr); problem != "" {
+		fail(scepBadAlg, "CSR key", email, problem)
+		return
+	}
+
+	s := loadSettings(ctx)
+	if s.RequireApproval {
+		fail(scepBadRequest, "RequireApproval is set", email)
+		return
+	}
+	desc, problem := normalizeCertDescription(s, email, "SCEP "+time.Now().UTC().Format("2006-01-02 15:04"))
+	if problem != "" {
+		fail(scepBadRequest, "description", email, problem)
+		return
+	}
+	discard := &discardResponse{}
+	if !checkIssuable(discard, req, s, email, desc) {
+		fail(scepBadRequest, "not issuable", email, discard.status)
+		return
+	}
+
+	signer := loadSigningSigner(s)
+	backdate := time.Duration(s.CertBackdateMinutes) * time.Minute
+	cert, err := signer.signClientCert(s.IssuedCertDuration, certSubject(s, email), newCertSerial(ctx, s), csr.PublicKey, backdate)
+	if err != nil {
+		panic(err)
+	}
+	recordIssuedCert(req, email, desc, cert)
+
+	log.Status(TAG, fmt.Sprintf("issued certificate '%s' for '%s' via SCEP", certFingerprint(cert), email), requestID(req))
+	sendSCEPResponse(writer, req, sr, cert, "")
+}
+
+// sendSCEPResponse replies to sr with a CertRep: a success carrying cert if failInfo is "", or a
+// failure with that reason
+func sendSCEPResponse(writer http.ResponseWriter, req *http.Request, sr *scepRequest, cert *x509.Certificate, failInfo string) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err)
+	}
+	attrs := []pkcs7Attribute{rawPKCS7Attribute(oidSCEPTransactionID, sr.TransactionID.FullBytes)}
+	add := func(oid asn1.ObjectIdentifier, value interface{}, params string) {
+		attr, err := newPKCS7Attribute(oid, value, params)
+		if err != nil {
+			panic(err)
+		}
+		attrs = append(attrs, attr)
+	}
+	add(oidSCEPMessageType, scepCertRep, "printable")
+	add(oidSCEPSenderNonce, nonce, "")
+	add(oidSCEPRecipientNonce, sr.SenderNonce, "")
+
+	var content []byte
+	if failInfo == "" {
+		certs, err := pkcs7CertsOnly([]*x509.Certificate{cert})
+		if err != nil {
+			panic(err)
+		}
+		if content, err = pkcs7Encrypt(certs, sr.Signer, sr.Alg); err != nil {
+			panic(err)
+		}
+		add(oidSCEPPKIStatus, scepSuccess, "printable")
+	} else {
+		add(oidSCEPPKIStatus, scepFailure, "printable")
+		add(oidSCEPFailInfo, failInfo, "printable")
+	}
+
+	signer := loadSigningSigner(loadSettings(req.Context()))
+	der, err := pkcs7Sign(content, signer.Cert, signer.Key, attrs)
+	if err != nil {
+		panic(err)
+	}
+	writer.Header().Set("Content-Type", "application/x-pki-message")
+	writer.Write(der)
+}
+
+// csrChallengePassword returns the challengePassword attribute of a CSR, which x509 doesn't parse
+func csrChallengePassword(csr *x509.CertificateRequest) (string, error) {
+	var tbs struct {
+		Version    int
+		Subject    asn1.RawValue
+		PublicKey  asn1.RawValue
+		Attributes []pkcs7Attribute `asn1:"optional,tag:0"`
+	}
+	if _, err := asn1.Unmarshal(csr.RawTBSCertificateRequest, &tbs); err != nil {
+		return "", err
+	}
+	for _, attr := range tbs.Attributes {
+		if attr.Type.Equal(oidChallengePassword) {
+			var password string
+			_, err := asn1.Unmarshal(attr.Values.Bytes, &password)
+			return password, err
+		}
+	}
+	return "", fmt.Errorf("no challengePassword attribute")
+}
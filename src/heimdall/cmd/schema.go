@@ -0,0 +1,179 @@
+// Copyright © 2018 Playground Global, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+// migrations brings the database schema up to date. Each entry is applied exactly once, in order,
+// in its own transaction; the number of applied entries is tracked in SQLite's user_version pragma.
+// Only ever append to this list -- never edit or reorder existing entries, since deployed databases
+// have already applied them.
+var migrations = []string{
+	// 1: base schema, as created by the Ansible playbook; a no-op on databases created that way
+	`create table if not exists certs (rowid integer primary key, email text not null, fingerprint text not null unique, desc text, created timestamp not null default current_timestamp, expires timestamp not null, revoked timestamp default null);
+	create index if not exists certs_email_idx on certs (email);
+	create index if not exists certs_fp_idx on certs (fingerprint);
+	create index if not exists certs_created_idx on certs (created);
+	create index if not exists certs_revoked_idx on certs (revoked);
+	create table if not exists totp (rowid integer primary key, email text not null unique, seed text not null, created timestamp not null default current_timestamp, updated timestamp not null default current_timestamp);
+	create index if not exists totp_email_idx on totp (email);
+	create table if not exists events (rowid integer primary key, event text not null, email text not null, value text not null, ts timestamp not null default current_timestamp);
+	create index if not exists events_evt_idx on events (event);
+	create index if not exists events_email_idx on events (email);
+	create index if not exists events_value_idx on events (value);
+	create index if not exists events_ts_idx on events (ts);
+	create table if not exists settings (rowid integer primary key, key text not null unique, value text not null, modified timestamp not null default current_timestamp);
+	create index if not exists settings_key_idx on settings (key);
+	create index if not exists settings_mod_idx on settings (modified);
+	create table if not exists whitelist (rowid integer primary key, email text not null unique, modified timestamp not null default current_timestamp);
+	create index if not exists whitelist_email_idx on whitelist (email);
+	create index if not exists whitelist_mod_idx on whitelist (modified);`,
+
+	// 2: record who performed each audited action
+	`alter table events add column source_ip text not null default '';
+	alter table events add column user_agent text not null default '';`,
+
+	// 3: soft-delete for users
+	`alter table totp add column archived timestamp default null;
+	create index if not exists totp_archived_idx on totp (archived);`,
+
+	// 4: cert serial numbers, for OCSP lookups; certs issued before this have no serial recorded
+	`alter table certs add column serial text not null default '';
+	create index if not exists certs_serial_idx on certs (serial);`,
+
+	// 5: why a cert was revoked; one of the revocationReasons keys, or '' if none was given
+	`alter table certs add column revocation_reason text not null default '';`,
+
+	// 6: per-user override of the ClientLimit setting; null means use the setting
+	`alter table totp add column client_limit integer default null;`,
+
+	// 7: the ID of the API request that caused each event, for correlation with logs
+	`alter table events add column request_id text not null default '';`,
+
+	// 8: make certs.email a foreign key to totp. Users are archived rather than deleted, so
+	// deleting a user who has certs is refused (the default "no action", checked at the end of the
+	// statement, which lets "insert or replace" re-create a user's row); renaming one cascades.
+	// Certs already orphaned are kept, under archived placeholder users with no TOTP seed.
+	`insert into totp (email, seed, archived)
+		select distinct email, '', datetime('now') from certs where email not in (select email from totp);
+	create table certs_new (rowid integer primary key,
+		email text not null references totp (email) on update cascade,
+		fingerprint text not null unique, desc text, created timestamp not null default current_timestamp,
+		expires timestamp not null, revoked timestamp default null, serial text not null default '',
+		revocation_reason text not null default '');
+	insert into certs_new (rowid, email, fingerprint, desc, created, expires, revoked, serial, revocation_reason)
+		select rowid, email, fingerprint, desc, created, expires, revoked, serial, revocation_reason from certs;
+	drop table certs;
+	alter table certs_new rename to certs;
+	create index if not exists certs_email_idx on certs (email);
+	create index if not exists certs_fp_idx on certs (fingerprint);
+	create index if not exists certs_created_idx on certs (created);
+	create index if not exists certs_revoked_idx on certs (revoked);
+	create index if not exists certs_serial_idx on certs (serial);`,
+
+	// 9: the client cert CN of the operator responsible for each event
+	`alter table events add column operator text not null default '';`,
+
+	// 10: the issued cert itself (not its key), in PEM; '' for certs issued before this
+	`alter table certs add column pem text not null default '';`,
+
+	// 11: when each cert was last seen connected to the VPN, per POST /cert/<fingerprint>/seen
+	`alter table certs add column last_seen timestamp default null;`,
+
+	// 12: cert requests awaiting approval, when the RequireApproval setting is on. status is one of
+	// "pending", "approved", or "rejected"; requested_by and decided_by are operator CNs.
+	`create table if not exists pending_certs (rowid integer primary key,
+		email text not null references totp (email) on update cascade,
+		desc text not null, key_bits integer not null default 0, profile text not null default '',
+		requested timestamp not null default current_timestamp, requested_by text not null default '',
+		status text not null default 'pending', decided timestamp default null,
+		decided_by text not null default '', fingerprint text not null default '');
+	create index if not exists pending_certs_status_idx on pending_certs (status);`,
+
+	// 13: the last serial number issued when the SerialMode setting is "sequential"; a single row
+	`create table if not exists serial_counter (rowid integer primary key check (rowid = 1), value integer not null);
+	insert into serial_counter (rowid, value) values (1, 0);`,
+
+	// 14: the issuer shown by authenticator apps for the user's TOTP seed; '' means ServiceName
+	`alter table totp add column issuer text not null default '';`,
+
+	// 15: whether each cert was issued outside Heimdall and imported by POST /certs/<email>/import
+	`alter table certs add column imported integer not null default 0;`,
+
+	// 16: the order in which certs were revoked, as a strictly increasing cursor for GET /revocations,
+	// since revoked has only one-second resolution. Triggers number every revocation, however it's
+	// made (including by the CLI, or a restore); existing ones are numbered in order of revocation.
+	`alter table certs add column revocation_seq integer default null;
+	update certs set revocation_seq = (select count(*) from certs c where c.revoked is not null and
+		(c.revoked < certs.revoked or (c.revoked = certs.revoked and c.rowid <= certs.rowid)))
+		where revoked is not null;
+	create unique index if not exists certs_revocation_seq_idx on certs (revocation_seq);
+	create trigger if not exists certs_revocation_seq_update after update of revoked on certs
+		when new.revoked is not null and new.revoked is not old.revoked
+		begin update certs set revocation_seq = (select coalesce(max(revocation_seq), 0) + 1 from certs) where rowid = new.rowid; end;
+	create trigger if not exists certs_revocation_seq_insert after insert on certs
+		when new.revoked is not null
+		begin update certs set revocation_seq = (select coalesce(max(revocation_seq), 0) + 1 from certs) where rowid = new.rowid; end;`,
+
+	// 17: normalize emails stored before normalizeEmail, which can't otherwise be reached. Users are
+	// renamed (cascading to certs and pending_certs) only where that merges none; the rest are left
+	// for POST /diagnostics/repair, and warned of at startup. Whitelist duplicates are equivalent, so
+	// only one of each is kept.
+	`update totp set email = lower(trim(email))
+		where email != lower(trim(email)) and lower(trim(email)) in
+			(select lower(trim(email)) from totp group by lower(trim(email)) having count(*) = 1);
+	update events set email = lower(trim(email)) where email != lower(trim(email));
+	delete from whitelist where rowid not in (select max(rowid) from whitelist group by lower(trim(email)));
+	update whitelist set email = lower(trim(email)) where email != lower(trim(email));`,
+}
+
+// migrateDatabase applies any migrations not yet recorded in the database. Called once at startup,
+// before the server accepts requests; panics if any migration fails.
+func migrateDatabase() {
+	TAG := "migrateDatabase"
+	ctx := context.Background()
+
+	cxn := getDB()
+	defer cxn.Close()
+
+	var version int
+	if err := cxn.QueryRowContext(ctx, "pragma user_version").Scan(&version); err != nil {
+		panic(err)
+	}
+
+	for version < len(migrations) {
+		tx, err := cxn.BeginTx(ctx, nil)
+		if err != nil {
+			panic(err)
+		}
+		if _, err = tx.ExecContext(ctx, migrations[version]); err != nil {
+			tx.Rollback()
+			panic(fmt.Sprintf("schema migration %d failed: %s", version+1, err))
+		}
+		// pragmas can't take bound parameters
+		if _, err = tx.ExecContext(ctx, fmt.Sprintf("pragma user_version = %d", version+1)); err != nil {
+			tx.Rollback()
+			panic(err)
+		}
+		if err = tx.Commit(); err != nil {
+			panic(err)
+		}
+		version++
+		log.Status(TAG, fmt.Sprintf("applied schema migration %d", version))
+	}
+}
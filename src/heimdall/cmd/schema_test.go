@@ -0,0 +1,119 @@
+// Copyright © 2018 Playground Global, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// useTestDB points cfg at a new, fully migrated database, removed when the test ends
+func useTestDB(t *testing.T) {
+	dir, err := ioutil.TempDir("", "heimdall")
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := cfg.SQLiteDBFile
+	cfg.SQLiteDBFile = filepath.Join(dir, "heimdall.sqlite3")
+	t.Cleanup(func() {
+		cfg.SQLiteDBFile = saved
+		os.RemoveAll(dir)
+	})
+	migrateDatabase()
+}
+
+func TestCertsEmailForeignKey(t *testing.T) {
+	useTestDB(t)
+	cxn := getDB()
+	defer cxn.Close()
+
+	if _, err := cxn.Exec("insert into totp (email, seed) values ('a@b.c', 's')"); err != nil {
+		t.Fatal(err)
+	}
+	insertCert := "insert into certs (email, fingerprint, desc, expires) values (?, ?, 'd', datetime('now', '+1 day'))"
+	if _, err := cxn.Exec(insertCert, "a@b.c", "fp1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// orphans can't be created, either directly or by deleting their user
+	if _, err := cxn.Exec(insertCert, "nobody@b.c", "fp2"); err == nil {
+		t.Error("cert inserted for nonexistent user")
+	}
+	if _, err := cxn.Exec("delete from totp where email='a@b.c'"); err == nil {
+		t.Error("user with certs deleted")
+	}
+
+	// a TOTP reset re-creates the user's row within one statement, which must still work
+	if _, err := cxn.Exec("insert or replace into totp (email, seed) values ('a@b.c', 't')"); err != nil {
+		t.Error("TOTP reset refused:", err)
+	}
+
+	// renaming a user carries their certs along
+	if _, err := cxn.Exec("update totp set email='x@b.c' where email='a@b.c'"); err != nil {
+		t.Fatal(err)
+	}
+	var email string
+	if err := cxn.QueryRow("select email from certs where fingerprint='fp1'").Scan(&email); err != nil || email != "x@b.c" {
+		t.Error("rename didn't cascade:", email, err)
+	}
+}
+
+func TestEmailNormalizationMigration(t *testing.T) {
+	useTestDB(t)
+	cxn := getDB()
+	defer cxn.Close()
+
+	// rows as they could be stored before normalizeEmail; migration 17 is rerun over them
+	for _, q := range []string{
+		"insert into totp (email, seed) values ('Alice@Example.com', 's'), (' bob@example.com', 's'), ('Carol@Example.com', 's'), ('carol@example.com', 's')",
+		"insert into certs (email, fingerprint, desc, expires) values ('Alice@Example.com', 'fp1', 'd', datetime('now', '+1 day'))",
+		"insert into events (event, email, value) values ('certificate issued', 'Alice@Example.com', 'fp1')",
+		"insert into whitelist (email) values ('Dave@Example.com'), ('dave@example.com'), ('Erin@Example.com')",
+		"pragma user_version = 16",
+	} {
+		if _, err := cxn.Exec(q); err != nil {
+			t.Fatal(q, err)
+		}
+	}
+	migrateDatabase()
+
+	count := func(q string, args ...interface{}) int {
+		var n int
+		if err := cxn.QueryRow(q, args...).Scan(&n); err != nil {
+			t.Fatal(q, err)
+		}
+		return n
+	}
+	for _, email := range []string{"alice@example.com", "bob@example.com"} {
+		if count("select count(*) from totp where email=?", email) != 1 {
+			t.Errorf("user %s not normalized", email)
+		}
+	}
+	if count("select count(*) from certs where email='alice@example.com'") != 1 {
+		t.Error("rename didn't cascade to certs")
+	}
+	if count("select count(*) from events where email='alice@example.com'") != 1 {
+		t.Error("events not normalized")
+	}
+	// users that would collide are left for POST /diagnostics/repair
+	if count("select count(*) from totp where lower(email)='carol@example.com'") != 2 {
+		t.Error("colliding users were merged or dropped")
+	}
+	if count("select count(*) from whitelist") != 2 || count("select count(*) from whitelist where email in ('dave@example.com', 'erin@example.com')") != 2 {
+		t.Error("whitelist not normalized")
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright © 2018 Playground Global, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Optional encryption at rest for TOTP seeds, so that a leaked copy of the database doesn't also
+// leak every user's second factor. When SeedEncryptionKey is set, seeds are stored as
+// "enc:v1:" + base64(nonce + AES-256-GCM ciphertext), keyed by the SHA-256 of SeedEncryptionKey.
+// ansible/files/bin/ovpn-auth-user-pass-verify.py decrypts them the same way at login.
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strings"
+)
+
+const encryptedSeedPrefix = "enc:v1:"
+
+func seedCipher() cipher.AEAD {
+	key := sha256.Sum256([]byte(cfg.SeedEncryptionKey))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		panic(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+	return aead
+}
+
+// encryptSeed returns seed as it should be stored: encrypted if SeedEncryptionKey is set, else as-is
+func encryptSeed(seed string) string {
+	if cfg.SeedEncryptionKey == "" || seed == "" || strings.HasPrefix(seed, encryptedSeedPrefix) {
+		return seed
+	}
+	aead := seedCipher()
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err)
+	}
+	return encryptedSeedPrefix + base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, []byte(seed), nil))
+}
+
+// decryptSeed returns the plaintext of a stored seed, which is returned as-is if it isn't encrypted
+func decryptSeed(stored string) (string, error) {
+	if !strings.HasPrefix(stored, encryptedSeedPrefix) {
+		return stored, nil
+	}
+	if cfg.SeedEncryptionKey == "" {
+		return "", errors.New("seed is encrypted but SeedEncryptionKey is not set")
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(stored, encryptedSeedPrefix))
+	if err != nil {
+		return "", err
+	}
+	aead := seedCipher()
+	if len(raw) < aead.NonceSize() {
+		return "", errors.New("encrypted seed is truncated")
+	}
+	seed, err := aead.Open(nil, raw[:aead.NonceSize()], raw[aead.NonceSize():], nil)
+	if err != nil {
+		return "", err
+	}
+	return string(seed), nil
+}
+
+// encryptStoredSeeds is a one-time migration run at startup: if SeedEncryptionKey is set, it
+// encrypts any seeds stored before it was; otherwise it warns if encrypted seeds are present,
+// since users with them can't log in.
+func encryptStoredSeeds() {
+	TAG := "encryptStoredSeeds"
+	ctx := context.Background()
+
+	cxn := getDB()
+	defer cxn.Close()
+
+	if cfg.SeedEncryptionKey == "" {
+		var n int
+		if err := cxn.QueryRowContext(ctx, "select count(*) from totp where seed like ?", encryptedSeedPrefix+"%").Scan(&n); err != nil {
+			panic(err)
+		}
+		if n > 0 {
+			log.Warn(TAG, "SeedEncryptionKey is not set, but seeds are encrypted", n)
+		}
+		return
+	}
+
+	tx, err := cxn.BeginTx(ctx, nil)
+	if err != nil {
+		panic(err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, "select email, seed from totp where seed != '' and seed not like ?", encryptedSeedPrefix+"%")
+	if err != nil {
+		panic(err)
+	}
+	seeds := make(map[string]string)
+	for rows.Next() {
+		var email, seed string
+		if err := rows.Scan(&email, &seed); err != nil {
+			panic(err)
+		}
+		seeds[email] = seed
+	}
+	rows.Close()
+
+	for email, seed := range seeds {
+		if _, err := tx.ExecContext(ctx, "update totp set seed=? where email=?", encryptSeed(seed), email); err != nil {
+			panic(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		panic(err)
+	}
+	if len(seeds) > 0 {
+		log.Status(TAG, "encrypted stored TOTP seeds", len(seeds))
+	}
+}
@@ -0,0 +1,146 @@
+// Copyright © 2018 Playground Global, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Self-service endpoints, which users call directly rather than via an admin holding the API secret.
+// Users authenticate with a current TOTP code instead, so failed attempts are counted per user to
+// keep the code from being brute-forced.
+
+import (
+	"database/sql"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pquerna/otp/totp"
+
+	"playground/httputil"
+)
+
+// selfServiceMaxFailures is how many bad TOTP codes a user may send per selfServiceLockout before
+// further attempts are refused outright
+const selfServiceMaxFailures = 5
+const selfServiceLockout = 15 * time.Minute
+
+var selfServiceFailures = struct {
+	sync.Mutex
+	entries map[string][]time.Time
+}{entries: make(map[string][]time.Time)}
+
+// selfServiceLocked indicates whether email has had too many recent failed attempts
+func selfServiceLocked(email string) bool {
+	selfServiceFailures.Lock()
+	defer selfServiceFailures.Unlock()
+
+	recent := []time.Time{}
+	for _, t := range selfServiceFailures.entries[email] {
+		if time.Since(t) < selfServiceLockout {
+			recent = append(recent, t)
+		}
+	}
+	if len(recent) == 0 {
+		delete(selfServiceFailures.entries, email)
+	} else {
+		selfServiceFailures.entries[email] = recent
+	}
+	return len(recent) >= selfServiceMaxFailures
+}
+
+func recordSelfServiceFailure(email string) {
+	selfServiceFailures.Lock()
+	defer selfServiceFailures.Unlock()
+	selfServiceFailures.entries[email] = append(selfServiceFailures.entries[email], time.Now())
+}
+
+func selfRevokeHandler(writer http.ResponseWriter, req *http.Request) {
+	// POST /self/revoke -- a user revokes one of their own certs; requires no API key
+	//   I: {Email: "", Code: "", Fingerprint: ""}
+	//   O: {}
+	//   200: the cert is revoked; 400 (bad request): missing or malformed fields, with body
+	//   {Errors: {<field>: "problem"}}; 403 (forbidden): the code is wrong, or the user or cert
+	//   doesn't exist or isn't the user's; 429 (too many requests): too many recent failures
+	//   Code is the user's current TOTP code. The various 403 cases are indistinguishable, so
+	//   that this can't be used to discover who owns which cert. Revoking an already-revoked cert
+	//   succeeds without changing it.
+	// Non-POST: 405 (method not allowed)
+
+	TAG := "/self/revoke"
+	ctx := req.Context()
+
+	reqBody := &struct{ Email, Code, Fingerprint string }{}
+	if errs := decodeStrictJSON(reqBody, req); errs != nil {
+		log.Warn(TAG, "missing or malformed request JSON", errs)
+		sendFieldErrors(writer, errs)
+		return
+	}
+	errs := fieldErrors{}
+	email, err := normalizeEmail(reqBody.Email)
+	if err != nil {
+		errs["Email"] = err.Error()
+	}
+	if reqBody.Code == "" {
+		errs["Code"] = "required"
+	}
+	if reqBody.Fingerprint == "" {
+		errs["Fingerprint"] = "required"
+	}
+	if len(errs) > 0 {
+		log.Warn(TAG, "invalid JSON request", errs)
+		sendFieldErrors(writer, errs)
+		return
+	}
+
+	if selfServiceLocked(email) {
+		log.Warn(TAG, "too many failed attempts", email)
+		httputil.SendJSON(writer, http.StatusTooManyRequests, struct{}{})
+		return
+	}
+
+	// fetch the user's seed, and the cert if it's theirs
+	var seed string
+	var revoked sql.NullString
+	q := `select t.seed, c.revoked from totp as t, certs as c
+	      where t.email=? and t.archived is null and c.email=t.email and c.fingerprint=?`
+	cxn := getDB()
+	defer cxn.Close()
+	err = cxn.QueryRowContext(ctx, q, email, reqBody.Fingerprint).Scan(&seed, &revoked)
+	if err != nil && err != sql.ErrNoRows {
+		panic(err)
+	}
+	if err == nil {
+		if seed, err = decryptSeed(seed); err != nil {
+			panic(err)
+		}
+	}
+	if err == sql.ErrNoRows || seed == "" || !totp.Validate(reqBody.Code, seed) {
+		recordSelfServiceFailure(email)
+		log.Warn(TAG, "self-service revocation refused", email, reqBody.Fingerprint)
+		httputil.SendJSON(writer, http.StatusForbidden, struct{}{})
+		return
+	}
+
+	if revoked.Valid {
+		log.Status(TAG, "cert already revoked", email, reqBody.Fingerprint)
+		httputil.SendJSON(writer, http.StatusOK, struct{}{})
+		return
+	}
+	q = "update certs set revoked=datetime('now'), revocation_reason=? where fingerprint=?"
+	writeDatabaseByQuery(ctx, q, "cessation-of-operation", reqBody.Fingerprint)
+	resetOCSPCache()
+	recordEvent(req, "certificate revoked", email, reqBody.Fingerprint+" - self-service")
+
+	log.Status(TAG, "user revoked own certificate", email, reqBody.Fingerprint)
+	httputil.SendJSON(writer, http.StatusOK, struct{}{})
+}
@@ -0,0 +1,124 @@
+// Copyright © 2018 Playground Global, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// A self-test of the files issuance depends on, since a mismatched CA key or a missing tls-auth
+// file otherwise only shows up when the first user asks for a cert.
+
+import (
+	"crypto"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"text/template"
+	"time"
+
+	"playground/ca"
+	"playground/httputil"
+)
+
+type selftestCheck struct {
+	Name   string
+	Passed bool
+	Error  string
+}
+
+// checkCAFiles loads a CA's cert and key both as ca.Authority does and directly, and confirms the
+// key belongs to the cert and the cert is currently valid
+func checkCAFiles(certFile, keyFile, password string) error {
+	if err := (&ca.Authority{}).LoadFromPEM(certFile, keyFile, password); err != nil {
+		return err
+	}
+	signer, err := loadCASigner(certFile, keyFile, password)
+	if err != nil {
+		return err
+	}
+	pub, ok := signer.Key.Public().(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !pub.Equal(signer.Cert.PublicKey) {
+		return errors.New("private key does not match certificate")
+	}
+	if now := time.Now(); now.Before(signer.Cert.NotBefore) || now.After(signer.Cert.NotAfter) {
+		return fmt.Errorf("certificate is valid only from %s to %s", signer.Cert.NotBefore, signer.Cert.NotAfter)
+	}
+	return nil
+}
+
+// checkTemplateFile parses and trial-runs a .ovpn template, as initConfig does at startup; rerun
+// here since the file may have changed since
+func checkTemplateFile(file string) error {
+	tmpl, err := template.ParseFiles(file)
+	if err != nil {
+		return err
+	}
+	return trialOVPNTemplate(tmpl)
+}
+
+func selftestHandler(writer http.ResponseWriter, req *http.Request) {
+	// GET /selftest -- check the CA and other files that cert issuance depends on
+	//   I: None
+	//   O: {Passed: false, Checks: [{Name: "", Passed: false, Error: ""}]}
+	//   200: all checks passed; 503 (service unavailable): some check failed; 403 (forbidden): not
+	//   an admin-scoped API key
+	//   Checks that the CA cert and key (and the next CA's, during a rotation) load and match, and
+	//   that the cert is currently valid; that TLSAuthFile is readable and not empty; and that
+	//   OVPNTemplateFile and any OVPNTemplateProfiles parse and render. Error is "" for checks
+	//   that passed. Nothing is issued or written.
+	// Non-GET: 405 (method not allowed)
+
+	TAG := "/selftest"
+
+	res := struct {
+		Passed bool
+		Checks []*selftestCheck
+	}{true, []*selftestCheck{}}
+	check := func(name string, err error) {
+		c := &selftestCheck{Name: name, Passed: err == nil}
+		if err != nil {
+			c.Error = err.Error()
+			res.Passed = false
+			log.Warn(TAG, "self-test check failed", name, err)
+		}
+		res.Checks = append(res.Checks, c)
+	}
+
+	check("CA", checkCAFiles(cfg.CACertFile, cfg.CAKeyFile, cfg.CAKeyPassword))
+	if cfg.NextCACertFile != "" {
+		check("next CA", checkCAFiles(cfg.NextCACertFile, cfg.NextCAKeyFile, cfg.NextCAKeyPassword))
+	}
+
+	tlsauth, err := ioutil.ReadFile(cfg.TLSAuthFile)
+	if err == nil && len(tlsauth) == 0 {
+		err = errors.New("file is empty")
+	}
+	check("TLSAuthFile", err)
+
+	check("OVPNTemplateFile", checkTemplateFile(cfg.OVPNTemplateFile))
+	profiles := []string{}
+	for profile := range cfg.OVPNTemplateProfiles {
+		profiles = append(profiles, profile)
+	}
+	sort.Strings(profiles)
+	for _, profile := range profiles {
+		check(fmt.Sprintf("OVPNTemplateProfiles[%s]", profile), checkTemplateFile(cfg.OVPNTemplateProfiles[profile]))
+	}
+
+	status := http.StatusOK
+	if !res.Passed {
+		status = http.StatusServiceUnavailable
+	}
+	httputil.SendJSON(writer, status, &res)
+}
@@ -0,0 +1,74 @@
+// Copyright © 2018 Playground Global, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// In-memory cache of the settings table (and whitelist), which is read by most requests but
+// changes rarely. Everything that writes either table must call invalidateSettings afterward.
+
+import (
+	"context"
+	"sync"
+)
+
+var settingsCache = struct {
+	sync.RWMutex
+	current    *settings // nil when not cached
+	generation int       // bumped by each invalidation
+}{}
+
+// loadSettings returns the current settings, from the cache if possible. The result is the
+// caller's own copy, and so can be modified freely.
+func loadSettings(ctx context.Context) *settings {
+	settingsCache.RLock()
+	cached, generation := settingsCache.current, settingsCache.generation
+	settingsCache.RUnlock()
+	if cached != nil {
+		return cached.clone()
+	}
+
+	fresh := readSettings(ctx)
+
+	// only cache what was read if nothing was written in the meantime; otherwise fresh may predate
+	// the write, and caching it would serve stale values until the next invalidation
+	settingsCache.Lock()
+	if settingsCache.generation == generation {
+		settingsCache.current = fresh.clone()
+	}
+	settingsCache.Unlock()
+	return fresh
+}
+
+// invalidateSettings discards the cached settings, so that the next loadSettings reads them anew
+func invalidateSettings() {
+	settingsCache.Lock()
+	defer settingsCache.Unlock()
+	settingsCache.current = nil
+	settingsCache.generation++
+}
+
+func (s *settings) clone() *settings {
+	ret := *s
+	ret.DomainProfiles = make(map[string]string, len(s.DomainProfiles))
+	for k, v := range s.DomainProfiles {
+		ret.DomainProfiles[k] = v
+	}
+	ret.TemplateExtra = make(map[string]string, len(s.TemplateExtra))
+	for k, v := range s.TemplateExtra {
+		ret.TemplateExtra[k] = v
+	}
+	ret.WhitelistedDomains = append([]string{}, s.WhitelistedDomains...)
+	ret.WhitelistedUsers = append([]string{}, s.WhitelistedUsers...)
+	return &ret
+}
@@ -0,0 +1,258 @@
+// Copyright © 2018 Playground Global, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"time"
+)
+
+// caSigner is a CA cert and its private key, parsed directly rather than via ca.Authority, for
+// the operations (e.g. OCSP) that need lower-level access than that type provides.
+type caSigner struct {
+	Cert *x509.Certificate
+	Key  crypto.Signer
+}
+
+// loadCASigner reads a PEM CA cert and (optionally password-protected) PEM private key
+func loadCASigner(certFile, keyFile, password string) (*caSigner, error) {
+	certPEM, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(certPEM)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("no certificate found in '%s'", certFile)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	keyPEM, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	if block, _ = pem.Decode(keyPEM); block == nil {
+		return nil, fmt.Errorf("no private key found in '%s'", keyFile)
+	}
+	der := block.Bytes
+	if x509.IsEncryptedPEMBlock(block) {
+		if der, err = x509.DecryptPEMBlock(block, []byte(password)); err != nil {
+			return nil, err
+		}
+	}
+	key, err := parsePrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+
+	return &caSigner{cert, key}, nil
+}
+
+// parsePrivateKey accepts PKCS#1 RSA, SEC 1 EC, or PKCS#8 private keys in DER
+func parsePrivateKey(der []byte) (crypto.Signer, error) {
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(der); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, errors.New("unrecognized private key format")
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("private key type cannot sign")
+	}
+	return signer, nil
+}
+
+// loadCASigners returns the signers for all currently-trusted CAs, i.e. the current CA and, during
+// a rotation, the next CA
+func loadCASigners() []*caSigner {
+	current, err := loadCASigner(cfg.CACertFile, cfg.CAKeyFile, cfg.CAKeyPassword)
+	if err != nil {
+		panic(err)
+	}
+	signers := []*caSigner{current}
+	if cfg.NextCACertFile != "" {
+		next, err := loadCASigner(cfg.NextCACertFile, cfg.NextCAKeyFile, cfg.NextCAKeyPassword)
+		if err != nil {
+			panic(err)
+		}
+		signers = append(signers, next)
+	}
+	return signers
+}
+
+// loadSigningSigner returns the signer for whichever CA the settings select for issuing new certs;
+// see loadSigningAuthority
+func loadSigningSigner(s *settings) *caSigner {
+	if s.SigningCA == "next" {
+		if cfg.NextCACertFile == "" {
+			panic("SigningCA setting selects next CA, but none is configured")
+		}
+		next, err := loadCASigner(cfg.NextCACertFile, cfg.NextCAKeyFile, cfg.NextCAKeyPassword)
+		if err != nil {
+			panic(err)
+		}
+		return next
+	}
+	current, err := loadCASigner(cfg.CACertFile, cfg.CAKeyFile, cfg.CAKeyPassword)
+	if err != nil {
+		panic(err)
+	}
+	return current
+}
+
+// clientKeypair is a newly issued client cert and its private key
+type clientKeypair struct {
+	Cert *x509.Certificate
+	Key  *rsa.PrivateKey
+}
+
+// createClientKeypair generates an RSA key of the given size and issues a client-auth cert for it,
+// valid for the given number of days from now. This does what ca.Authority.CreateClientKeypair
+// does, except that the cert's validity may start up to backdate in the past, to accommodate
+// clients with skewed clocks.
+func (s *caSigner) createClientKeypair(days int, subject *pkix.Name, serial *big.Int, bits int, backdate time.Duration) (*clientKeypair, error) {
+	key, err := rsa.GenerateKey(rand.Reader, bits)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := s.signClientCert(days, subject, serial, &key.PublicKey, backdate)
+	if err != nil {
+		return nil, err
+	}
+	return &clientKeypair{cert, key}, nil
+}
+
+// signClientCert issues a client-auth cert for pub, as createClientKeypair does for the key it
+// generates
+func (s *caSigner) signClientCert(days int, subject *pkix.Name, serial *big.Int, pub crypto.PublicKey, backdate time.Duration) (*x509.Certificate, error) {
+	now := time.Now().UTC().Truncate(time.Second)
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               *subject,
+		NotBefore:             now.Add(-backdate),
+		NotAfter:              now.AddDate(0, 0, days),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		ExtraExtensions:       certExtensions,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, s.Cert, pub, s.Key)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(der)
+}
+
+// fingerprint returns the hex SHA-256 of the cert's DER, as OpenVPN reports it to the TLS verify
+// script (minus colons)
+func (kp *clientKeypair) fingerprint() string {
+	return certFingerprint(kp.Cert)
+}
+
+// certFingerprint returns a cert's fingerprint, as recorded in the certs table
+func certFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// toPEM returns the PEM encodings of the cert and its private key. If passphrase is set, the key is
+// encrypted with it, using the legacy PEM encryption OpenSSL (and so OpenVPN) understands.
+func (kp *clientKeypair) toPEM(passphrase string) (crt, key []byte, err error) {
+	crt = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: kp.Cert.Raw})
+	block := &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(kp.Key)}
+	if passphrase != "" {
+		if block, err = x509.EncryptPEMBlock(rand.Reader, block.Type, block.Bytes, []byte(passphrase), x509.PEMCipherAES256); err != nil {
+			return nil, nil, err
+		}
+	}
+	return crt, pem.EncodeToMemory(block), nil
+}
+
+// readPEMCerts parses all certificates in a PEM file, returning them along with the raw PEM
+func readPEMCerts(file string) ([]*x509.Certificate, []byte, error) {
+	raw, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	certs := []*x509.Certificate{}
+	for block, rest := pem.Decode(raw); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, nil, fmt.Errorf("no certificates found in '%s'", file)
+	}
+	return certs, raw, nil
+}
+
+// verifyCAChain checks, when chainFile is set, that the intermediate cert in certFile is permitted
+// to sign certs and that it chains through the certs in chainFile (ordered issuer-first, i.e. with
+// the root last) up to a self-signed root
+func verifyCAChain(certFile, chainFile string) error {
+	if chainFile == "" {
+		return nil
+	}
+	certs, _, err := readPEMCerts(certFile)
+	if err != nil {
+		return err
+	}
+	signing := certs[0]
+	if !signing.BasicConstraintsValid || !signing.IsCA {
+		return fmt.Errorf("'%s' is not a CA certificate", certFile)
+	}
+	if signing.KeyUsage != 0 && signing.KeyUsage&x509.KeyUsageCertSign == 0 {
+		return fmt.Errorf("key usage of '%s' does not permit signing certificates", certFile)
+	}
+
+	chain, _, err := readPEMCerts(chainFile)
+	if err != nil {
+		return err
+	}
+	child := signing
+	for _, parent := range chain {
+		if err = child.CheckSignatureFrom(parent); err != nil {
+			return fmt.Errorf("'%s' is not signed by '%s' in '%s': %s", child.Subject.CommonName, parent.Subject.CommonName, chainFile, err)
+		}
+		child = parent
+	}
+	if err = child.CheckSignatureFrom(child); err != nil {
+		return fmt.Errorf("chain in '%s' does not end in a self-signed root", chainFile)
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+// Copyright © 2018 Playground Global, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+)
+
+// tlsVersions maps the accepted MinTLSVersion values to their protocol versions
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// defaultCipherSuites are the TLS 1.2 suites allowed if CipherSuites is empty: only those with
+// forward secrecy and AEAD ciphers
+var defaultCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+}
+
+// tlsPolicy returns the minimum protocol version and TLS 1.2 cipher suites described by
+// MinTLSVersion and CipherSuites, or an error if they're unknown, insecure, or inconsistent. Suites
+// are named as in crypto/tls, e.g. "TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384"; none means
+// defaultCipherSuites. TLS 1.3 suites aren't configurable, so naming suites along with a minimum of
+// 1.3 is an error, since they'd silently have no effect.
+func tlsPolicy() (uint16, []uint16, error) {
+	version, ok := tlsVersions[cfg.MinTLSVersion]
+	if !ok {
+		return 0, nil, fmt.Errorf("MinTLSVersion '%s' must be \"1.2\" or \"1.3\"", cfg.MinTLSVersion)
+	}
+	if len(cfg.CipherSuites) == 0 {
+		return version, defaultCipherSuites, nil
+	}
+	if version == tls.VersionTLS13 {
+		return 0, nil, fmt.Errorf("CipherSuites can't be set when MinTLSVersion is \"1.3\"")
+	}
+
+	known := map[string]uint16{}
+	for _, s := range tls.CipherSuites() { // i.e. only those without known security issues
+		for _, v := range s.SupportedVersions {
+			if v == tls.VersionTLS12 {
+				known[s.Name] = s.ID
+			}
+		}
+	}
+	suites := []uint16{}
+	for _, name := range cfg.CipherSuites {
+		id, ok := known[name]
+		if !ok {
+			return 0, nil, fmt.Errorf("CipherSuites entry '%s' is unknown, insecure, or not a TLS 1.2 suite", name)
+		}
+		suites = append(suites, id)
+	}
+	return version, suites, nil
+}
+
+// applyTLSPolicy sets the server's TLS protocol and cipher suite policy; see tlsPolicy. The
+// configuration is validated by validateConfig, so this only panics if that was skipped.
+func applyTLSPolicy(c *tls.Config) {
+	version, suites, err := tlsPolicy()
+	if err != nil {
+		panic(err)
+	}
+	c.MinVersion = version
+	c.CipherSuites = suites
+}
@@ -0,0 +1,75 @@
+// Copyright © 2018 Playground Global, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Support for listening on a Unix domain socket, selected by a BindAddress of the form
+// "unix:///path/to.sock", so that access can be limited by filesystem permissions (e.g. to a
+// sidecar.) TLS, including the client cert requirement, still applies over the socket.
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+const unixBindPrefix = "unix://"
+
+// unixSocketPath returns the socket path named by BindAddress, or "" if it names a TCP address
+func unixSocketPath() string {
+	if !strings.HasPrefix(cfg.BindAddress, unixBindPrefix) {
+		return ""
+	}
+	return strings.TrimPrefix(cfg.BindAddress, unixBindPrefix)
+}
+
+// listenUnix listens on the socket at path, readable and writable only by its owner and group. A
+// socket left behind by an unclean exit is replaced, but any other kind of file is an error. The
+// socket is removed when the listener is closed, which happens on SIGINT or SIGTERM.
+func listenUnix(path string) net.Listener {
+	TAG := "listenUnix"
+
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			panic(fmt.Sprintf("'%s' exists and is not a socket", path))
+		}
+		log.Warn(TAG, "removing stale socket", path)
+		if err := os.Remove(path); err != nil {
+			panic(err)
+		}
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		panic(err)
+	}
+	if err := os.Chmod(path, 0660); err != nil {
+		l.Close()
+		panic(err)
+	}
+
+	// closing the listener unlinks the socket, and makes Serve return so main can exit normally
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		s := <-sig
+		log.Status(TAG, "closing socket on signal", s)
+		l.Close()
+	}()
+
+	return l
+}
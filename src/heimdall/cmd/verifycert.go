@@ -0,0 +1,104 @@
+// Copyright © 2018 Playground Global, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"database/sql"
+	"encoding/hex"
+	"encoding/pem"
+	"net/http"
+	"strings"
+	"time"
+
+	"playground/httputil"
+)
+
+func verifyCertHandler(writer http.ResponseWriter, req *http.Request) {
+	// POST /verify-cert -- check whether a cert is currently good, so that other services needn't
+	// parse the CRL themselves
+	//   I: {PEM: ""} or {Fingerprint: ""}
+	//   O: {Valid: false, Revoked: false, Expired: false, Email: "", Expires: ""}
+	//   200: the object above; 400: neither or both of PEM and Fingerprint given, or PEM is not a
+	//   cert, with body {Errors: {Field: "problem"}}
+	//   Valid is true only if the cert was issued by Heimdall, is not revoked, and is within its
+	//   validity window. A cert Heimdall has no record of is simply not Valid, with Email "".
+	// Non-POST: 405 (method not allowed)
+
+	TAG := "/verify-cert"
+	ctx := req.Context()
+
+	reqBody := &struct{ PEM, Fingerprint string }{}
+	if errs := decodeStrictJSON(reqBody, req); errs != nil {
+		log.Warn(TAG, "malformed request JSON", errs)
+		sendFieldErrors(writer, errs)
+		return
+	}
+	if (reqBody.PEM == "") == (reqBody.Fingerprint == "") {
+		log.Warn(TAG, "need exactly one of PEM and Fingerprint")
+		sendFieldErrors(writer, fieldErrors{"PEM": "exactly one of PEM and Fingerprint is required"})
+		return
+	}
+
+	res := struct {
+		Valid, Revoked, Expired bool
+		Email, Expires          string
+	}{}
+
+	// a presented cert's own validity window is checked too, so a backdated or not-yet-valid cert
+	// isn't reported Valid on the strength of the expiry date in the database alone
+	fp := strings.ToLower(strings.TrimSpace(reqBody.Fingerprint))
+	var cert *x509.Certificate
+	if reqBody.PEM != "" {
+		block, _ := pem.Decode([]byte(reqBody.PEM))
+		if block == nil || block.Type != "CERTIFICATE" {
+			log.Warn(TAG, "PEM does not contain a certificate")
+			sendFieldErrors(writer, fieldErrors{"PEM": "must be a PEM-encoded certificate"})
+			return
+		}
+		var err error
+		if cert, err = x509.ParseCertificate(block.Bytes); err != nil {
+			log.Warn(TAG, "unparseable certificate", err)
+			sendFieldErrors(writer, fieldErrors{"PEM": "must be a PEM-encoded certificate"})
+			return
+		}
+		sum := sha256.Sum256(cert.Raw)
+		fp = hex.EncodeToString(sum[:])
+	}
+
+	var revoked, expired bool
+	q := "select email, expires, revoked is not null, expires <= datetime('now') from certs where fingerprint=?"
+	cxn := getDB()
+	defer cxn.Close()
+	err := cxn.QueryRowContext(ctx, q, fp).Scan(&res.Email, &res.Expires, &revoked, &expired)
+	if err == sql.ErrNoRows {
+		log.Debug(TAG, "verification of unknown cert", fp)
+		httputil.SendJSON(writer, http.StatusOK, &res)
+		return
+	} else if err != nil {
+		panic(err)
+	}
+
+	res.Revoked, res.Expired = revoked, expired
+	if cert != nil {
+		now := time.Now()
+		res.Expired = res.Expired || now.After(cert.NotAfter) || now.Before(cert.NotBefore)
+	}
+	res.Valid = !res.Revoked && !res.Expired
+
+	log.Debug(TAG, "verified cert", fp, res.Valid)
+	httputil.SendJSON(writer, http.StatusOK, &res)
+}
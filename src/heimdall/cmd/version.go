@@ -0,0 +1,46 @@
+// Copyright © 2018 Playground Global, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Build metadata, reported by GET /version so that bug reports can be matched to the binary that
+// produced them. Set at build time, e.g.:
+//
+//   go build -ldflags "-X main.version=1.2.0 -X main.gitCommit=$(git rev-parse HEAD) -X main.buildTime=$(date -u +%FT%TZ)"
+
+import (
+	"net/http"
+	"runtime"
+
+	"playground/httputil"
+)
+
+var (
+	version   = "dev"
+	gitCommit = ""
+	buildTime = ""
+)
+
+func versionHandler(writer http.ResponseWriter, req *http.Request) {
+	// GET /version -- report which build is running; requires no API key
+	//   I: None
+	//   O: {Version: "", GitCommit: "", BuildTime: "", GoVersion: ""}
+	//   200: the object above
+	//   GitCommit and BuildTime are "" if not set at build time.
+	// Non-GET: 405 (method not allowed)
+
+	httputil.SendJSON(writer, http.StatusOK, &struct{ Version, GitCommit, BuildTime, GoVersion string }{
+		version, gitCommit, buildTime, runtime.Version(),
+	})
+}
@@ -0,0 +1,85 @@
+// Copyright © 2018 Playground Global, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strings"
+
+	"playground/httputil"
+)
+
+func whoisHandler(writer http.ResponseWriter, req *http.Request) {
+	// GET /whois/<fingerprint> -- fetch the user who owns a cert, e.g. one seen in a VPN log
+	//   I: None
+	//   O: {Email: "", Fingerprint: "", CertStatus: "", ActiveCerts: 0, ExpiredCerts: 0, RevokedCerts: 0, Whitelisted: false, Archived: ""}
+	//   200: the object above; 404: no such fingerprint
+	//   CertStatus is that of the cert itself: "active", "revoked", or "expired". The counts are of
+	//   all the user's certs, split by status in the same way. Whitelisted is true if the user is
+	//   whitelisted by email or by domain (see the WhitelistedDomains setting.) Archived is "" for
+	//   users that are not archived.
+	// Non-GET: 405 (method not allowed)
+
+	TAG := "/whois/"
+	ctx := req.Context()
+
+	fp := strings.ToLower(strings.TrimSpace(extractSegment(req.URL.Path, 2)))
+	if fp == "" {
+		log.Warn(TAG, "missing fingerprint")
+		httputil.SendJSON(writer, http.StatusBadRequest, struct{}{})
+		return
+	}
+
+	res := struct {
+		Email, Fingerprint, CertStatus string
+		ActiveCerts, ExpiredCerts      int
+		RevokedCerts                   int
+		Whitelisted                    bool
+		Archived                       string
+	}{Fingerprint: fp}
+
+	q := `select c.email,
+		case when c.revoked is not null then 'revoked' when c.expires <= datetime('now') then 'expired' else 'active' end,
+		(select count(*) from certs where email=c.email and revoked is null and expires > datetime('now')),
+		(select count(*) from certs where email=c.email and revoked is null and expires <= datetime('now')),
+		(select count(*) from certs where email=c.email and revoked is not null),
+		exists (select 1 from whitelist where email=c.email),
+		coalesce(strftime('%Y-%m-%dT%H:%M:%SZ', t.archived), '')
+		from certs as c join totp as t on t.email=c.email where c.fingerprint=?`
+	cxn := getReadDB()
+	defer cxn.Close()
+	err := cxn.QueryRowContext(ctx, q, fp).Scan(&res.Email, &res.CertStatus, &res.ActiveCerts, &res.ExpiredCerts, &res.RevokedCerts, &res.Whitelisted, &res.Archived)
+	if err == sql.ErrNoRows {
+		log.Warn(TAG, "request for nonexistent fingerprint", fp)
+		httputil.SendJSON(writer, http.StatusNotFound, struct{}{})
+		return
+	} else if err != nil {
+		panic(err)
+	}
+	cxn.Close()
+
+	if !res.Whitelisted {
+		for _, domain := range loadSettings(ctx).WhitelistedDomains {
+			if strings.HasSuffix(res.Email, "@"+domain) {
+				res.Whitelisted = true
+				break
+			}
+		}
+	}
+
+	log.Debug(TAG, "whois", fp, res.Email)
+	httputil.SendJSON(writer, http.StatusOK, &res)
+}